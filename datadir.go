@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"map/storage"
+
+	"github.com/ontio/ontology/common/log"
+	"github.com/ontio/ontology/p2pserver/common"
+)
+
+const DATADIR_LOCK_FILE_NAME = "LOCK"
+
+// DataDir is the directory holding every state file of an instance.
+type DataDir string
+
+// OpenDataDir creates dir if needed and locks it, so that no other instance
+// uses it until the returned release is called.
+func OpenDataDir(dir string) (DataDir, func(), error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", nil, fmt.Errorf("create data directory %s: %s", dir, err)
+	}
+	lock := filepath.Join(dir, DATADIR_LOCK_FILE_NAME)
+	release, err := lockFile(lock)
+	if err != nil {
+		return "", nil, fmt.Errorf("lock data directory %s, is another instance using it? %s", dir, err)
+	}
+	return DataDir(dir), release, nil
+}
+
+func (self DataDir) NodeDbFile() string {
+	return filepath.Join(string(self), storage.NODE_DB_FILE_NAME)
+}
+
+func (self DataDir) RecentPeersFile() string {
+	return filepath.Join(string(self), common.RECENT_FILE_NAME)
+}
+
+// LogDir ends with a separator, as expected by the log packages.
+func (self DataDir) LogDir() string {
+	return filepath.Join(string(self), log.PATH) + string(os.PathSeparator)
+}
+
+// OpenNodeDb opens the node db of the data directory, see storage.NewBoltNodeDb.
+func (self DataDir) OpenNodeDb(network uint32) (*storage.BoltNodeDb, error) {
+	db, err := storage.NewBoltNodeDb(self.NodeDbFile(), network)
+	if err != nil {
+		return nil, fmt.Errorf("open node db %s: %s", self.NodeDbFile(), err)
+	}
+	return db, nil
+}
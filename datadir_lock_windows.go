@@ -0,0 +1,18 @@
+package main
+
+import (
+	"os"
+)
+
+// lockFile creates path exclusively, a stale one left by a crash has to be
+// removed by hand.
+func lockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		_ = f.Close()
+		_ = os.Remove(path)
+	}, nil
+}
@@ -7,10 +7,13 @@ require (
 	github.com/ethereum/go-ethereum v1.9.13
 	github.com/gin-contrib/cors v1.3.0
 	github.com/gin-gonic/gin v1.4.0
+	github.com/gorilla/websocket v1.4.2
 	github.com/hashicorp/golang-lru v0.5.3
 	github.com/imroc/req v0.2.3
 	github.com/ontio/ontology v2.0.0+incompatible
 	github.com/ontio/ontology-eventbus v0.9.1
+	github.com/oschwald/maxminddb-golang v1.6.0
+	github.com/prometheus/client_golang v1.7.1
 	github.com/scylladb/go-set v1.0.2
 	github.com/urfave/cli v1.22.1
 	go.etcd.io/bbolt v1.3.2
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"fmt"
+	"io"
+	"map/metrics"
 	"map/p2pserver"
 	"map/storage"
+	geo "map/utils"
 	"map/web"
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
 	"syscall"
 
 	"github.com/ethereum/go-ethereum/common/fdlimit"
@@ -19,8 +24,6 @@ import (
 )
 
 func main() {
-	storage.InitNodeDb()
-	defer storage.CloseNodeDb()
 	if err := setupAPP().Run(os.Args); err != nil {
 		cmd.PrintErrorMsg(err.Error())
 		os.Exit(1)
@@ -33,7 +36,57 @@ func setupAPP() *cli.App {
 	app.Action = Start
 	app.Version = "1.0.0"
 	app.Copyright = "Copyright in 2019 @FYZ"
-	app.Commands = []cli.Command{}
+	app.Commands = []cli.Command{
+		{
+			Name:   "migrate",
+			Usage:  "Upgrade the node db to the latest schema",
+			Action: migrateNodeDb,
+		},
+		{
+			Name:   "check",
+			Usage:  "Report the undecodable node records of the node db",
+			Action: checkNodeDb,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "repair",
+					Usage: "Re-encode outdated records and move undecodable ones aside",
+				},
+			},
+		},
+		{
+			Name:   "relocate",
+			Usage:  "Mark the location of every node pending, to look them all up again on the next start",
+			Action: relocateNodes,
+		},
+		{
+			Name:   "export",
+			Usage:  "Export the nodes of the network as JSONL or CSV",
+			Action: exportNodeDb,
+			Flags: []cli.Flag{
+				exportFormatFlag,
+				cli.StringFlag{
+					Name:  "output",
+					Usage: "Output `<file>`, stdout if omitted",
+				},
+				cli.BoolFlag{
+					Name:  "history",
+					Usage: "Include the node history, written to <file>.history.csv for CSV",
+				},
+			},
+		},
+		{
+			Name:   "import",
+			Usage:  "Merge the nodes of an export into the network, keeping the most recently active",
+			Action: importNodeDb,
+			Flags: []cli.Flag{
+				exportFormatFlag,
+				cli.StringFlag{
+					Name:  "input",
+					Usage: "Input `<file>`, stdin if omitted. For CSV, <file>.history.csv is imported too if present",
+				},
+			},
+		},
+	}
 	app.Flags = []cli.Flag{
 		//common setting
 		cli.StringFlag{
@@ -51,6 +104,52 @@ func setupAPP() *cli.App {
 			Name:  "disablecors",
 			Usage: "disable cors",
 		},
+		cli.StringFlag{
+			Name:  "cors-origins",
+			Usage: "Comma separated `<origins>` allowed by CORS and to open the websocket stream, every origin by CORS only if omitted",
+		},
+		cli.StringFlag{
+			Name:  "datadir",
+			Usage: "Directory `<path>` of the node db, the recent peers and the logs",
+			Value: ".",
+		},
+		cli.StringFlag{
+			Name:  "webroot",
+			Usage: "Directory `<path>` of the built web app",
+			Value: web.DEFAULT_WEB_ROOT,
+		},
+		cli.StringFlag{
+			Name:  "geo-provider",
+			Usage: "Comma separated geo location `<providers>` tried in order: mmdb, ip-api",
+			Value: geo.GEO_PROVIDER_IP_API,
+		},
+		cli.StringFlag{
+			Name:  "geo-db",
+			Usage: "MaxMind or DB-IP city database `<file>` of the mmdb geo provider",
+		},
+		cli.StringFlag{
+			Name:  "asn-db",
+			Usage: "MaxMind or DB-IP ASN database `<file>`, to record the autonomous system of the nodes",
+		},
+		cli.UintFlag{
+			Name:  "geo-rate",
+			Usage: "Max ip-api geo location lookups per minute",
+			Value: geo.IP_API_RATE,
+		},
+		cli.DurationFlag{
+			Name:  "geo-cache-ttl",
+			Usage: "Cache the geo location of an ip for `<duration>`",
+			Value: storage.DefaultGeoLocatorConfig().CacheTTL,
+		},
+		cli.StringFlag{
+			Name:  "dns-server",
+			Usage: "DNS server `<host:port>` of the reverse lookups of the nodes, the system resolver if omitted",
+		},
+		cli.DurationFlag{
+			Name:  "dns-timeout",
+			Usage: "Give up a reverse lookup after `<duration>`",
+			Value: storage.DefaultHostnameResolverConfig().Timeout,
+		},
 		utils.NetworkIdFlag,
 		utils.NodePortFlag,
 		cli.UintFlag{
@@ -64,6 +163,21 @@ func setupAPP() *cli.App {
 			Value: 10240,
 		},
 		utils.MaxConnInBoundForSingleIPFlag,
+		cli.DurationFlag{
+			Name:  "offline-after",
+			Usage: "Mark a node offline after `<duration>` without activity, 0 to disable",
+			Value: storage.DefaultPrunePolicy().OfflineAfter,
+		},
+		cli.DurationFlag{
+			Name:  "tombstone-after",
+			Usage: "Tombstone a node after `<duration>` without activity, 0 to disable",
+			Value: storage.DefaultPrunePolicy().TombstoneAfter,
+		},
+		cli.DurationFlag{
+			Name:  "purge-after",
+			Usage: "Delete a node after `<duration>` without activity, 0 to disable",
+			Value: storage.DefaultPrunePolicy().PurgeAfter,
+		},
 	}
 	app.Before = func(context *cli.Context) error {
 		runtime.GOMAXPROCS(runtime.NumCPU())
@@ -72,47 +186,156 @@ func setupAPP() *cli.App {
 	return app
 }
 
-func initLog(ctx *cli.Context) {
+func initLog(ctx *cli.Context, dataDir DataDir) {
 	//init log module
 	logLevel := ctx.GlobalInt(utils.GetFlagName(utils.LogLevelFlag))
-	alog.InitLog(log.PATH)
-	log.InitLog(logLevel, log.PATH, log.Stdout)
+	alog.InitLog(dataDir.LogDir())
+	log.InitLog(logLevel, dataDir.LogDir(), log.Stdout)
 }
 
-func Start(ctx *cli.Context) {
-	initLog(ctx)
+func Start(ctx *cli.Context) error {
+	dataDir, release, err := OpenDataDir(ctx.String("datadir"))
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := web.CheckWebRoot(ctx.String("webroot")); err != nil {
+		return err
+	}
+	var corsOrigins []string
+	if origins := ctx.String("cors-origins"); origins != "" {
+		corsOrigins = strings.Split(origins, ",")
+	}
+	if err := web.CheckCorsOrigins(corsOrigins); err != nil {
+		return fmt.Errorf("--cors-origins: %s", err)
+	}
+
+	initLog(ctx, dataDir)
 
 	log.Infof("ontology version %s", config.Version)
 
 	setMaxOpenFiles()
 
-	_, err := initConfig(ctx)
+	_, err = initConfig(ctx)
 	if err != nil {
-		log.Errorf("initConfig error: %s", err)
-		return
+		return fmt.Errorf("init config: %s", err)
 	}
 
-	p2p, err := p2pserver.NewServer(nil)
+	if ctx.Uint("geo-rate") == 0 {
+		return fmt.Errorf("--geo-rate must be positive")
+	}
+	geoLimit := geo.NewRateLimit(int(ctx.Uint("geo-rate")))
+	defer geoLimit.Stop()
+	geoProvider, err := geo.NewGeoProvider(ctx.String("geo-provider"), ctx.String("geo-db"), geoLimit)
 	if err != nil {
-		log.Errorf("instance p2p server err: %v", err)
-		return
+		return fmt.Errorf("init geo provider: %s", err)
+	}
+	defer geoProvider.Close()
+	var asnDb *geo.AsnDb
+	if file := ctx.String("asn-db"); file != "" {
+		if asnDb, err = geo.NewAsnDb(file); err != nil {
+			return fmt.Errorf("open asn db: %s", err)
+		}
+		defer asnDb.Close()
+	}
+
+	networkMagic := config.DefConfig.P2PNode.NetworkMagic
+	db, err := dataDir.OpenNodeDb(networkMagic)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	feed := storage.NewNodeFeed(storage.DefaultNodeFeedConfig())
+	writeBehind := storage.NewWriteBehindStore(db.Network(networkMagic), storage.DefaultWriteBehindConfig())
+	store := storage.NewFeedStore(writeBehind, feed)
+	defer store.Close()
+	metrics.RegisterWriteBuffer(func() metrics.WriteBufferStats {
+		stats := writeBehind.Stats()
+		return metrics.WriteBufferStats{
+			Pending:     stats.Pending,
+			Stalls:      stats.Stalls,
+			FlushErrors: stats.FlushErrors,
+			Dropped:     stats.Dropped,
+		}
+	})
+	if asnDb != nil {
+		count, err := storage.BackfillAsns(store, asnDb)
+		if err != nil {
+			return fmt.Errorf("backfill asns: %s", err)
+		}
+		log.Infof("recorded the autonomous system of %d nodes", count)
+	}
+	compactor := storage.NewHistoryCompactor(store, storage.DefaultHistoryPolicy())
+	compactor.Start()
+	defer compactor.Stop()
+	census := storage.NewCensusRecorder(store, storage.DEFAULT_CENSUS_INTERVAL)
+	census.Start()
+	defer census.Stop()
+	prunePolicy := storage.DefaultPrunePolicy()
+	prunePolicy.OfflineAfter = ctx.Duration("offline-after")
+	prunePolicy.TombstoneAfter = ctx.Duration("tombstone-after")
+	prunePolicy.PurgeAfter = ctx.Duration("purge-after")
+	pruner := storage.NewNodePruner(store, prunePolicy)
+	pruner.Start()
+	defer pruner.Stop()
+	geoConfig := storage.DefaultGeoLocatorConfig()
+	geoConfig.CacheTTL = ctx.Duration("geo-cache-ttl")
+	locator := storage.NewGeoLocator(geoConfig, geoProvider, asnDb)
+	defer locator.Stop()
+	metrics.RegisterQueue("geo", func() int { return locator.Stats().Queued })
+	dnsConfig := storage.DefaultHostnameResolverConfig()
+	dnsConfig.Server = ctx.String("dns-server")
+	dnsConfig.Timeout = ctx.Duration("dns-timeout")
+	resolver := storage.NewHostnameResolver(dnsConfig)
+	defer resolver.Stop()
+	metrics.RegisterQueue("dns", func() int { return resolver.Stats().Queued })
+	refresher := storage.NewLocationRefresher(store, locator, storage.DEFAULT_LOCATION_REFRESH_INTERVAL)
+	refresher.Start()
+	defer refresher.Stop()
+
+	// an exit signal received from now on runs the deferred calls, which flush
+	// the store
+	exit := make(chan os.Signal, 1)
+	signal.Notify(exit, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(exit)
+
+	p2p, err := p2pserver.NewServer(nil, store, &storage.NodeLookups{Locator: locator, Resolver: resolver}, dataDir.RecentPeersFile())
+	if err != nil {
+		return fmt.Errorf("instance p2p server: %s", err)
 	}
+	metrics.RegisterConnections(p2p.ConnectController())
 	if err := p2p.Start(); err != nil {
-		log.Errorf("start p2p server err: %v", err)
-		return
+		return fmt.Errorf("start p2p server: %s", err)
+	}
+	// the deferred calls stop the crawl first, then the background services,
+	// and close the store last
+	defer p2p.Stop()
+	peersStarted := make(chan bool)
+	go func() {
+		p2p.WaitForPeersStart()
+		close(peersStarted)
+	}()
+	select {
+	case sig := <-exit:
+		log.Infof("Ontology received exit signal: %v.", sig.String())
+		return nil
+	case <-peersStarted:
 	}
-	p2p.WaitForPeersStart()
 	log.Infof("P2P init success")
 
 	port := ctx.Uint("port")
 	disableCors := ctx.Bool("disablecors")
-	err = web.StartRestServer(port, disableCors)
-	if err != nil {
-		log.Error("start rest server failed", err)
-		return
-	}
+	stores := storage.NewNetworkStores(db, networkMagic, store)
+	web.RegisterNetworkMetrics(stores)
+	restErr := make(chan error, 1)
+	go func() {
+		restErr <- web.StartRestServer(port, disableCors, corsOrigins, ctx.String("webroot"), stores, p2p, feed)
+	}()
 
-	waitToExit()
+	if err := waitToExit(exit, restErr); err != nil {
+		return fmt.Errorf("start rest server: %s", err)
+	}
+	return nil
 }
 
 func setMaxOpenFiles() {
@@ -138,16 +361,191 @@ func initConfig(ctx *cli.Context) (*config.OntologyConfig, error) {
 	return cfg, nil
 }
 
-func waitToExit() {
-	exit := make(chan bool, 0)
-	sc := make(chan os.Signal, 1)
-	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
-	go func() {
-		for sig := range sc {
-			log.Infof("Ontology received exit signal: %v.", sig.String())
-			close(exit)
-			break
+// migrateNodeDb relies on NewBoltNodeDb running the pending migrations.
+func migrateNodeDb(ctx *cli.Context) error {
+	db, closeDb, err := openNodeDb(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeDb()
+	version, err := db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("node db is at schema version %d\n", version)
+	return nil
+}
+
+func checkNodeDb(ctx *cli.Context) error {
+	db, closeDb, err := openNodeDb(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeDb()
+	networks, err := db.Networks()
+	if err != nil {
+		return err
+	}
+	for _, network := range networks {
+		report, err := db.Network(network).CheckNodeRecords(ctx.Bool("repair"))
+		if err != nil {
+			return err
 		}
-	}()
-	<-exit
+		fmt.Printf("network %x: %d node records, %d outdated, %d corrupt\n",
+			network, report.Total, len(report.Outdated), len(report.Corrupt))
+		for _, addr := range report.Corrupt {
+			fmt.Printf("corrupt record: %s\n", addr)
+		}
+		if report.Repaired {
+			fmt.Println("repaired")
+		}
+	}
+	return nil
+}
+
+func relocateNodes(ctx *cli.Context) error {
+	network := networkMagicFromFlag(ctx)
+	db, closeDb, err := openNodeDb(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeDb()
+	count, err := storage.ResetLocations(db.Network(network))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d nodes will be located again\n", count)
+	return nil
+}
+
+var exportFormatFlag = cli.StringFlag{
+	Name:  "format",
+	Usage: "File format, jsonl or csv",
+	Value: storage.EXPORT_FORMAT_JSONL,
+}
+
+// historyFileName is the file of the node history of a CSV export.
+func historyFileName(file string) string {
+	return strings.TrimSuffix(file, ".csv") + ".history.csv"
+}
+
+func exportNodeDb(ctx *cli.Context) error {
+	format, file := ctx.String("format"), ctx.String("output")
+	if format != storage.EXPORT_FORMAT_JSONL && format != storage.EXPORT_FORMAT_CSV {
+		return fmt.Errorf("unknown format %s", format)
+	}
+	if format == storage.EXPORT_FORMAT_CSV && ctx.Bool("history") && file == "" {
+		return fmt.Errorf("exporting the history as CSV requires --output")
+	}
+	network := networkMagicFromFlag(ctx)
+	db, closeDb, err := openNodeDb(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeDb()
+
+	out := os.Stdout
+	if file != "" {
+		if out, err = os.Create(file); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	var count int
+	if format == storage.EXPORT_FORMAT_JSONL {
+		count, err = storage.ExportJSONL(db.Network(network), out, ctx.Bool("history"))
+	} else if ctx.Bool("history") {
+		var history *os.File
+		if history, err = os.Create(historyFileName(file)); err != nil {
+			return err
+		}
+		defer history.Close()
+		count, err = storage.ExportCSV(db.Network(network), out, history)
+	} else {
+		count, err = storage.ExportCSV(db.Network(network), out, nil)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d nodes\n", count)
+	return nil
+}
+
+func importNodeDb(ctx *cli.Context) error {
+	format, file := ctx.String("format"), ctx.String("input")
+	if format != storage.EXPORT_FORMAT_JSONL && format != storage.EXPORT_FORMAT_CSV {
+		return fmt.Errorf("unknown format %s", format)
+	}
+	network := networkMagicFromFlag(ctx)
+	db, closeDb, err := openNodeDb(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeDb()
+
+	in := os.Stdin
+	if file != "" {
+		if in, err = os.Open(file); err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+	var stats *storage.ImportStats
+	if format == storage.EXPORT_FORMAT_JSONL {
+		stats, err = storage.ImportJSONL(db.Network(network), in)
+	} else {
+		var history io.Reader
+		if file != "" {
+			if f, err := os.Open(historyFileName(file)); err == nil {
+				defer f.Close()
+				history = f
+			}
+		}
+		stats, err = storage.ImportCSV(db.Network(network), in, history)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %d nodes, %d newer than the stored ones, %d observations\n",
+		stats.Nodes, stats.Merged, stats.Observations)
+	return nil
+}
+
+// openNodeDb locks the data directory and opens its node db, until close is called.
+// The records written before networks were namespaced are migrated only into
+// a network given explicitly with --networkid.
+func openNodeDb(ctx *cli.Context) (db *storage.BoltNodeDb, close func(), err error) {
+	dataDir, release, err := OpenDataDir(ctx.GlobalString("datadir"))
+	if err != nil {
+		return nil, nil, err
+	}
+	network := storage.NETWORK_UNSPECIFIED
+	if ctx.GlobalIsSet(utils.GetFlagName(utils.NetworkIdFlag)) {
+		network = networkMagicFromFlag(ctx)
+	}
+	db, err = dataDir.OpenNodeDb(network)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	return db, func() {
+		_ = db.Close()
+		release()
+	}, nil
+}
+
+// networkMagicFromFlag returns the magic of the network selected by --networkid.
+func networkMagicFromFlag(ctx *cli.Context) uint32 {
+	return config.GetNetworkMagic(uint32(ctx.GlobalUint(utils.GetFlagName(utils.NetworkIdFlag))))
+}
+
+// waitToExit returns on an exit signal, or with the error of the failed server.
+func waitToExit(exit <-chan os.Signal, failed <-chan error) error {
+	select {
+	case sig := <-exit:
+		log.Infof("Ontology received exit signal: %v.", sig.String())
+		return nil
+	case err := <-failed:
+		return err
+	}
 }
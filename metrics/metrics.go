@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const NAMESPACE = "ontmap"
+
+var (
+	// DialAttempts counts the outbound connection attempts by result, the
+	// storage.CONNECT_* reason of the attempt, "ok" if it succeeded
+	DialAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "dial_attempts_total",
+		Help:      "Outbound connection attempts by result.",
+	}, []string{"result"})
+	HandshakeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "handshake_duration_seconds",
+		Help:      "Duration of the handshakes by direction and result.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"direction", "result"})
+	MessagesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "messages_received_total",
+		Help:      "Messages received from the peers after the handshake, by command.",
+	}, []string{"cmd"})
+	StoreWriteDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "store_write_duration_seconds",
+		Help:      "Duration of the write transactions of the node db.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	})
+)
+
+func init() {
+	prometheus.MustRegister(DialAttempts, HandshakeDuration, MessagesReceived, StoreWriteDuration)
+}
+
+// ObserveHandshake records the duration of a handshake started at start.
+func ObserveHandshake(inbound bool, start time.Time, err error) {
+	direction := "outbound"
+	if inbound {
+		direction = "inbound"
+	}
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	HandshakeDuration.WithLabelValues(direction, result).Observe(time.Since(start).Seconds())
+}
+
+// ConnectionCounter counts the connected peers, as the ConnectController.
+type ConnectionCounter interface {
+	InboundsCount() uint
+	OutboundsCount() uint
+}
+
+// RegisterConnections exposes the connected peers of counter by direction.
+func RegisterConnections(counter ConnectionCounter) {
+	gauge := func(direction string, count func() uint) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   NAMESPACE,
+			Name:        "connections",
+			Help:        "Connected peers by direction.",
+			ConstLabels: prometheus.Labels{"direction": direction},
+		}, func() float64 { return float64(count()) })
+	}
+	prometheus.MustRegister(gauge("inbound", counter.InboundsCount), gauge("outbound", counter.OutboundsCount))
+}
+
+// RegisterQueue exposes the depth of the queue name.
+func RegisterQueue(name string, depth func() int) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   NAMESPACE,
+		Name:        "queue_depth",
+		Help:        "Pending items of the background queues.",
+		ConstLabels: prometheus.Labels{"queue": name},
+	}, func() float64 { return float64(depth()) }))
+}
+
+// WriteBufferStats is the state of the write-behind buffer of the node db.
+type WriteBufferStats struct {
+	Pending     int
+	Stalls      uint64
+	FlushErrors uint64
+	Dropped     uint64
+}
+
+// RegisterWriteBuffer exposes the write-behind buffer whose state stats returns.
+func RegisterWriteBuffer(stats func() WriteBufferStats) {
+	counter := func(name, help string, count func(WriteBufferStats) uint64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: NAMESPACE,
+			Subsystem: "write_buffer",
+			Name:      name,
+			Help:      help,
+		}, func() float64 { return float64(count(stats())) })
+	}
+	prometheus.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: NAMESPACE,
+			Subsystem: "write_buffer",
+			Name:      "pending",
+			Help:      "Node writes buffered until the next flush.",
+		}, func() float64 { return float64(stats().Pending) }),
+		counter("stalls_total", "Writers blocked on a synchronous flush of the full buffer.",
+			func(s WriteBufferStats) uint64 { return s.Stalls }),
+		counter("flush_errors_total", "Failed flushes of the buffer.",
+			func(s WriteBufferStats) uint64 { return s.FlushErrors }),
+		counter("dropped_total", "Writes of failed flushes dropped as the buffer was full.",
+			func(s WriteBufferStats) uint64 { return s.Dropped }),
+	)
+}
@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// gather returns the values of the registered metrics of the family name by
+// their label values, the sample counts of the histograms.
+func gather(t *testing.T, name string) map[string]float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.Metric {
+			key := ""
+			for _, label := range metric.Label {
+				key += label.GetValue() + " "
+			}
+			switch {
+			case metric.Histogram != nil:
+				res[key] = float64(metric.Histogram.GetSampleCount())
+			case metric.Counter != nil:
+				res[key] = metric.Counter.GetValue()
+			default:
+				res[key] = metric.GetGauge().GetValue()
+			}
+		}
+	}
+	return res
+}
+
+type counter struct{ inbound, outbound uint }
+
+func (self counter) InboundsCount() uint  { return self.inbound }
+func (self counter) OutboundsCount() uint { return self.outbound }
+
+func TestObserveHandshake(t *testing.T) {
+	start := time.Now()
+	ObserveHandshake(true, start, nil)
+	ObserveHandshake(false, start, errors.New("timeout"))
+	ObserveHandshake(false, start, errors.New("refused"))
+	got := gather(t, "ontmap_handshake_duration_seconds")
+	for labels, want := range map[string]float64{"inbound ok ": 1, "outbound error ": 2} {
+		if got[labels] != want {
+			t.Errorf("%shandshakes %v, want %v", labels, got[labels], want)
+		}
+	}
+}
+
+func TestRegisterGauges(t *testing.T) {
+	RegisterConnections(counter{inbound: 2, outbound: 3})
+	RegisterQueue("geo", func() int { return 4 })
+	RegisterWriteBuffer(func() WriteBufferStats { return WriteBufferStats{Pending: 5, Stalls: 6} })
+	tests := []struct {
+		name   string
+		labels string
+		want   float64
+	}{
+		{"ontmap_connections", "inbound ", 2},
+		{"ontmap_connections", "outbound ", 3},
+		{"ontmap_queue_depth", "geo ", 4},
+		{"ontmap_write_buffer_pending", "", 5},
+		{"ontmap_write_buffer_stalls_total", "", 6},
+		{"ontmap_write_buffer_dropped_total", "", 0},
+	}
+	for _, test := range tests {
+		val, ok := gather(t, test.name)[test.labels]
+		if !ok {
+			t.Errorf("%s{%s} not registered", test.name, test.labels)
+			continue
+		}
+		if val != test.want {
+			t.Errorf("%s{%s} = %v, want %v", test.name, test.labels, val, test.want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright (C) 2018 The ontology Authors
+ * This file is part of The ontology library.
+ *
+ * The ontology is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The ontology is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The ontology.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package connect_controller
+
+import (
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"map/p2pserver/handshake"
+	"map/storage"
+)
+
+// attemptError is a connection attempt rejected locally, with the
+// storage.CONNECT_* reason of the rejection.
+type attemptError struct {
+	reason string
+	err    error
+}
+
+func (self *attemptError) Error() string {
+	return self.err.Error()
+}
+
+func attemptFailed(reason string, err error) error {
+	return &attemptError{reason: reason, err: err}
+}
+
+func failureReason(err error) string {
+	if e, ok := err.(*attemptError); ok {
+		return e.reason
+	}
+	return storage.CONNECT_DIAL_ERROR
+}
+
+func isTimeout(err error) bool {
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return true
+	}
+	// the handshake wraps the errors of its connection into plain ones
+	return strings.Contains(err.Error(), "i/o timeout")
+}
+
+func dialFailureReason(err error) string {
+	if isTimeout(err) {
+		return storage.CONNECT_DIAL_TIMEOUT
+	}
+	if e, ok := err.(*net.OpError); ok {
+		if se, ok := e.Err.(*os.SyscallError); ok && se.Err == syscall.ECONNREFUSED {
+			return storage.CONNECT_REFUSED
+		}
+	}
+	return storage.CONNECT_DIAL_ERROR
+}
+
+func handshakeFailureReason(err error) string {
+	if _, ok := err.(*handshake.UnexpectedMessageError); ok {
+		return storage.CONNECT_UNEXPECTED_MESSAGE
+	}
+	if isTimeout(err) {
+		return storage.CONNECT_HANDSHAKE_TIMEOUT
+	}
+	return storage.CONNECT_HANDSHAKE_ERROR
+}
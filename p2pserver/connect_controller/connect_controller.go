@@ -24,8 +24,11 @@ import (
 	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"map/metrics"
 	"map/p2pserver/handshake"
+	"map/storage"
 
 	"github.com/ontio/ontology/p2pserver/common"
 	"github.com/ontio/ontology/p2pserver/peer"
@@ -38,9 +41,11 @@ const OUTBOUND_INDEX = 1
 var ErrHandshakeSelf = errors.New("the node handshake with itself")
 
 type connectedPeer struct {
-	connectId uint64
-	addr      string
-	peer      *peer.PeerInfo
+	connectId   uint64
+	addr        string
+	peer        *peer.PeerInfo
+	boundIndex  int
+	connectedAt time.Time
 }
 
 type ConnectController struct {
@@ -183,7 +188,9 @@ func (self *ConnectController) AcceptConnect(conn net.Conn) (*peer.PeerInfo, net
 		return nil, nil, err
 	}
 
-	peerInfo, err := handshake.HandshakeServer(self.peerInfo, self.selfId, conn)
+	start := time.Now()
+	peerInfo, err := handshake.HandshakeServer(self.peerInfo, self.selfId, conn, self.nodeStore, self.nodeLookups)
+	metrics.ObserveHandshake(true, start, err)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -204,30 +211,45 @@ func (self *ConnectController) AcceptConnect(conn net.Conn) (*peer.PeerInfo, net
 func (self *ConnectController) Connect(addr string) (*peer.PeerInfo, net.Conn, error) {
 	err := self.beforeHandshakeCheck(addr, OUTBOUND_INDEX)
 	if err != nil {
+		storage.RecordConnectAttempt(self.nodeStore, addr, failureReason(err), err)
 		return nil, nil, err
 	}
 
 	if !self.tryAddConnecting(addr) {
-		return nil, nil, fmt.Errorf("node exist in connecting list: %s", addr)
+		err := fmt.Errorf("node exist in connecting list: %s", addr)
+		storage.RecordConnectAttempt(self.nodeStore, addr, storage.CONNECT_DUPLICATE, err)
+		return nil, nil, err
 	}
 	defer self.removeConnecting(addr)
 
 	conn, err := self.dialer.Dial(addr)
 	if err != nil {
+		storage.RecordConnectAttempt(self.nodeStore, addr, dialFailureReason(err), err)
 		return nil, nil, err
 	}
 
-	peerInfo, err := handshake.HandshakeClient(self.peerInfo, self.selfId, conn)
+	start := time.Now()
+	peerInfo, err := handshake.HandshakeClient(self.peerInfo, self.selfId, conn, self.nodeStore, self.nodeLookups)
+	metrics.ObserveHandshake(false, start, err)
 	if err != nil {
 		_ = conn.Close()
+		storage.RecordConnectAttempt(self.nodeStore, addr, handshakeFailureReason(err), err)
 		return nil, nil, err
 	}
 
 	err = self.afterHandshakeCheck(peerInfo, conn.RemoteAddr().String())
 	if err != nil {
 		_ = conn.Close()
+		if err == ErrHandshakeSelf {
+			storage.RecordConnectAttempt(self.nodeStore, addr, storage.CONNECT_SELF, err)
+		} else {
+			storage.RecordConnectAttempt(self.nodeStore, addr, storage.CONNECT_DUPLICATE, err)
+			// the handshake succeeded, so the node is reachable
+			storage.RecordProbe(self.nodeStore, addr, true)
+		}
 		return nil, nil, err
 	}
+	storage.RecordConnectAttempt(self.nodeStore, addr, storage.CONNECT_OK, nil)
 
 	wrapped := self.savePeer(conn, peerInfo, OUTBOUND_INDEX)
 
@@ -246,19 +268,19 @@ func (self *ConnectController) afterHandshakeCheck(remotePeer *peer.PeerInfo, re
 func (self *ConnectController) beforeHandshakeCheck(addr string, index int) error {
 	err := self.checkReservedPeers(addr)
 	if err != nil {
-		return err
+		return attemptFailed(storage.CONNECT_RESERVED_REJECT, err)
 	}
 
 	if self.hasBoundAddr(addr) {
-		return fmt.Errorf("peer %s already in connection records", addr)
+		return attemptFailed(storage.CONNECT_DUPLICATE, fmt.Errorf("peer %s already in connection records", addr))
 	}
 
 	if self.OwnAddress() == addr {
-		return fmt.Errorf("connecting with self address %s", addr)
+		return attemptFailed(storage.CONNECT_SELF, fmt.Errorf("connecting with self address %s", addr))
 	}
 
 	if self.isBoundFull(index) {
-		return fmt.Errorf("[p2p] bound %d connections reach max limit", index)
+		return attemptFailed(storage.CONNECT_BOUND_FULL, fmt.Errorf("[p2p] bound %d connections reach max limit", index))
 	}
 	if index == INBOUND_INDEX {
 		remoteIp, err := common.ParseIPAddr(addr)
@@ -310,9 +332,11 @@ func (self *ConnectController) savePeer(conn net.Conn, p *peer.PeerInfo, index i
 
 	cid := self.getConnectId()
 	self.peers[p.Id] = &connectedPeer{
-		connectId: cid,
-		addr:      addr,
-		peer:      p,
+		connectId:   cid,
+		addr:        addr,
+		peer:        p,
+		boundIndex:  index,
+		connectedAt: time.Now(),
 	}
 
 	return &Conn{
@@ -343,6 +367,16 @@ func (self *ConnectController) removePeer(conn *Conn) {
 	}
 }
 
+// PeerConnection returns whether the connection of the peer kid is inbound and
+// when it was established, ok is false if the peer is not connected.
+func (self *ConnectController) PeerConnection(kid common.PeerId) (inbound bool, since time.Time, ok bool) {
+	p := self.getPeer(kid)
+	if p == nil {
+		return false, time.Time{}, false
+	}
+	return p.boundIndex == INBOUND_INDEX, p.connectedAt, true
+}
+
 // if connection with peer.Kid exist, but has different IP, return error
 func (self *ConnectController) checkPeerIdAndIP(peer *peer.PeerInfo, addr string) error {
 	oldPeer := self.getPeer(peer.Id)
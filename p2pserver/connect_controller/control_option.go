@@ -18,6 +18,8 @@
 package connect_controller
 
 import (
+	"map/storage"
+
 	"github.com/ontio/ontology/common/config"
 	p2p "github.com/ontio/ontology/p2pserver/net/protocol"
 )
@@ -28,6 +30,8 @@ type ConnCtrlOption struct {
 	MaxConnInBoundPerIP uint
 	ReservedPeers       p2p.AddressFilter // enabled if not empty
 	dialer              Dialer
+	nodeStore           storage.NodeStore
+	nodeLookups         *storage.NodeLookups
 }
 
 func NewConnCtrlOption() ConnCtrlOption {
@@ -37,6 +41,7 @@ func NewConnCtrlOption() ConnCtrlOption {
 		MaxConnInBoundPerIP: config.DEFAULT_MAX_CONN_IN_BOUND_FOR_SINGLE_IP,
 		ReservedPeers:       p2p.AllAddrFilter(),
 		dialer:              &noTlsDialer{},
+		nodeStore:           storage.NewMemNodeStore(),
 	}
 }
 
@@ -65,7 +70,18 @@ func (self ConnCtrlOption) WithDialer(dialer Dialer) ConnCtrlOption {
 	return self
 }
 
-func ConnCtrlOptionFromConfig(config *config.P2PNodeConfig, reserveFilter p2p.AddressFilter) (option ConnCtrlOption, err error) {
+func (self ConnCtrlOption) WithNodeStore(store storage.NodeStore) ConnCtrlOption {
+	self.nodeStore = store
+	return self
+}
+
+func (self ConnCtrlOption) WithNodeLookups(lookups *storage.NodeLookups) ConnCtrlOption {
+	self.nodeLookups = lookups
+	return self
+}
+
+func ConnCtrlOptionFromConfig(config *config.P2PNodeConfig, reserveFilter p2p.AddressFilter,
+	store storage.NodeStore, lookups *storage.NodeLookups) (option ConnCtrlOption, err error) {
 	dialer, e := NewDialer(config)
 	if e != nil {
 		err = e
@@ -77,6 +93,8 @@ func ConnCtrlOptionFromConfig(config *config.P2PNodeConfig, reserveFilter p2p.Ad
 		MaxConnInBoundPerIP: config.MaxConnInBoundForSingleIP,
 		ReservedPeers:       reserveFilter,
 
-		dialer: dialer,
+		dialer:      dialer,
+		nodeStore:   store,
+		nodeLookups: lookups,
 	}, nil
 }
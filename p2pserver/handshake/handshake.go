@@ -32,7 +32,22 @@ import (
 
 var HANDSHAKE_DURATION = 10 * time.Second // handshake time can not exceed this duration, or will treat as attack.
 
-func HandshakeClient(info *peer.PeerInfo, selfId *common.PeerKeyId, conn net.Conn) (*peer.PeerInfo, error) {
+// UnexpectedMessageError is returned when the remote peer sends a message out of
+// the handshake sequence, usually because it runs an incompatible version.
+type UnexpectedMessageError struct {
+	msg string
+}
+
+func (self *UnexpectedMessageError) Error() string {
+	return self.msg
+}
+
+func unexpectedMessage(format string, args ...interface{}) error {
+	return &UnexpectedMessageError{msg: fmt.Sprintf(format, args...)}
+}
+
+func HandshakeClient(info *peer.PeerInfo, selfId *common.PeerKeyId, conn net.Conn, store storage.NodeStore,
+	lookups *storage.NodeLookups) (*peer.PeerInfo, error) {
 	version := newVersion(info)
 	if err := conn.SetDeadline(time.Now().Add(HANDSHAKE_DURATION)); err != nil {
 		return nil, err
@@ -54,7 +69,7 @@ func HandshakeClient(info *peer.PeerInfo, selfId *common.PeerKeyId, conn net.Con
 	}
 	receivedVersion, ok := msg.(*types.Version)
 	if !ok {
-		return nil, fmt.Errorf("expected version message, but got message type: %s", msg.CmdType())
+		return nil, unexpectedMessage("expected version message, but got message type: %s", msg.CmdType())
 	}
 
 	// 3. update kadId
@@ -71,7 +86,7 @@ func HandshakeClient(info *peer.PeerInfo, selfId *common.PeerKeyId, conn net.Con
 		}
 		kadKeyId, ok := msg.(*types.UpdatePeerKeyId)
 		if !ok {
-			return nil, fmt.Errorf("handshake failed, expect kad id message, got %s", msg.CmdType())
+			return nil, unexpectedMessage("handshake failed, expect kad id message, got %s", msg.CmdType())
 		}
 
 		kid = kadKeyId.KadKeyId.Id
@@ -90,18 +105,19 @@ func HandshakeClient(info *peer.PeerInfo, selfId *common.PeerKeyId, conn net.Con
 
 	// 6. receive verack
 	if _, ok := msg.(*types.VerACK); !ok {
-		return nil, fmt.Errorf("handshake failed, expect verack message, got %s", msg.CmdType())
+		return nil, unexpectedMessage("handshake failed, expect verack message, got %s", msg.CmdType())
 	}
 
 	peerInfo := createPeerInfo(receivedVersion, kid, conn.RemoteAddr().String())
 
-	saveVersion(receivedVersion, peerInfo, conn)
-	saveVerAck(peerInfo, conn)
+	saveVersion(store, lookups, receivedVersion, peerInfo, conn)
+	saveVerAck(store, lookups, peerInfo, conn, false)
 
 	return peerInfo, nil
 }
 
-func HandshakeServer(info *peer.PeerInfo, selfId *common.PeerKeyId, conn net.Conn) (*peer.PeerInfo, error) {
+func HandshakeServer(info *peer.PeerInfo, selfId *common.PeerKeyId, conn net.Conn, store storage.NodeStore,
+	lookups *storage.NodeLookups) (*peer.PeerInfo, error) {
 	ver := newVersion(info)
 	if err := conn.SetDeadline(time.Now().Add(HANDSHAKE_DURATION)); err != nil {
 		return nil, err
@@ -116,7 +132,7 @@ func HandshakeServer(info *peer.PeerInfo, selfId *common.PeerKeyId, conn net.Con
 		return nil, fmt.Errorf("[HandshakeServer] ReadMessage failed, error: %s", err)
 	}
 	if msg.CmdType() != common.VERSION_TYPE {
-		return nil, fmt.Errorf("[HandshakeServer] expected version message")
+		return nil, unexpectedMessage("[HandshakeServer] expected version message")
 	}
 	version := msg.(*types.Version)
 
@@ -135,7 +151,7 @@ func HandshakeServer(info *peer.PeerInfo, selfId *common.PeerKeyId, conn net.Con
 		}
 		kadkeyId, ok := msg.(*types.UpdatePeerKeyId)
 		if !ok {
-			return nil, fmt.Errorf("[HandshakeServer] expected update kadkeyid message")
+			return nil, unexpectedMessage("[HandshakeServer] expected update kadkeyid message")
 		}
 		kid = kadkeyId.KadKeyId.Id
 		// 4. sendMsg update kadkey id
@@ -151,7 +167,7 @@ func HandshakeServer(info *peer.PeerInfo, selfId *common.PeerKeyId, conn net.Con
 		return nil, fmt.Errorf("[HandshakeServer] ReadMessage failed, error: %s", err)
 	}
 	if msg.CmdType() != common.VERACK_TYPE {
-		return nil, fmt.Errorf("[HandshakeServer] expected version ack message")
+		return nil, unexpectedMessage("[HandshakeServer] expected version ack message")
 	}
 
 	// 6. sendMsg ack
@@ -162,8 +178,8 @@ func HandshakeServer(info *peer.PeerInfo, selfId *common.PeerKeyId, conn net.Con
 
 	peerInfo := createPeerInfo(version, kid, conn.RemoteAddr().String())
 
-	saveVersion(version, peerInfo, conn)
-	saveVerAck(peerInfo, conn)
+	saveVersion(store, lookups, version, peerInfo, conn)
+	saveVerAck(store, lookups, peerInfo, conn, true)
 
 	return peerInfo, nil
 }
@@ -235,12 +251,12 @@ func supportDHT(version string) bool {
 	return v1.GTE(min)
 }
 
-func saveVersion(version *types.Version, info *peer.PeerInfo, conn net.Conn) {
+func saveVersion(store storage.NodeStore, lookups *storage.NodeLookups, version *types.Version, info *peer.PeerInfo, conn net.Conn) {
 	remotePeer := peer.NewPeer(info, conn, nil)
-	storage.AddOrUpdateNodeAfterReceiveVersionMsg(remotePeer, version.P, true)
+	storage.AddOrUpdateNodeAfterReceiveVersionMsg(store, lookups, remotePeer, version.P, true)
 }
 
-func saveVerAck(info *peer.PeerInfo, conn net.Conn) {
+func saveVerAck(store storage.NodeStore, lookups *storage.NodeLookups, info *peer.PeerInfo, conn net.Conn, inbound bool) {
 	remotePeer := peer.NewPeer(info, conn, nil)
-	storage.AddOrUpdateNodeAfterReceiveVersionAckMsg(remotePeer)
+	storage.AddOrUpdateNodeAfterReceiveVersionAckMsg(store, lookups, remotePeer, inbound)
 }
@@ -23,6 +23,7 @@ import (
 	"net"
 
 	"map/p2pserver/connect_controller"
+	"map/storage"
 
 	"github.com/ontio/ontology/common/config"
 	"github.com/ontio/ontology/common/log"
@@ -34,7 +35,8 @@ import (
 )
 
 //NewNetServer return the net object in p2p
-func NewNetServer(protocol p2p.Protocol, conf *config.P2PNodeConfig, reserveAddrFilter p2p.AddressFilter) (*NetServer, error) {
+func NewNetServer(protocol p2p.Protocol, conf *config.P2PNodeConfig, reserveAddrFilter p2p.AddressFilter,
+	store storage.NodeStore, lookups *storage.NodeLookups) (*NetServer, error) {
 	nodePort := conf.NodePort
 	if nodePort == 0 {
 		nodePort = config.DEFAULT_NODE_PORT
@@ -44,7 +46,7 @@ func NewNetServer(protocol p2p.Protocol, conf *config.P2PNodeConfig, reserveAddr
 	info := peer.NewPeerInfo(keyId.Id, common.PROTOCOL_VERSION, common.SERVICE_NODE, true,
 		conf.HttpInfoPort, nodePort, 0, config.Version, "")
 
-	option, err := connect_controller.ConnCtrlOptionFromConfig(conf, reserveAddrFilter)
+	option, err := connect_controller.ConnCtrlOptionFromConfig(conf, reserveAddrFilter, store, lookups)
 	if err != nil {
 		return nil, err
 	}
@@ -286,6 +288,30 @@ func (this *NetServer) IsOwnAddress(addr string) bool {
 	return addr == this.connCtrl.OwnAddress()
 }
 
+// PeerState returns the live state of the connected node listening on addr,
+// nil if it is not connected.
+func (this *NetServer) PeerState(addr string) *storage.PeerState {
+	for _, p := range this.GetNeighbors() {
+		ip, _, err := storage.ParseIpPort(p.GetAddr())
+		if err != nil || storage.JoinIpPort(ip, int(p.GetPort())) != addr {
+			continue
+		}
+		inbound, since, ok := this.connCtrl.PeerConnection(p.GetID())
+		if !ok {
+			continue
+		}
+		return &storage.PeerState{
+			PeerId:          p.GetID().ToHexString(),
+			Inbound:         inbound,
+			ConnectedSince:  storage.TimeInMs(since),
+			LastContactTime: storage.TimeInMs(p.GetContactTime()),
+			Relay:           p.GetRelay(),
+			Height:          p.GetHeight(),
+		}
+	}
+	return nil
+}
+
 func (ns *NetServer) ConnectController() *connect_controller.ConnectController {
 	return ns.connCtrl
 }
@@ -25,6 +25,7 @@ import (
 	"map/p2pserver/connect_controller"
 	"map/p2pserver/net/netserver"
 	"map/p2pserver/protocols"
+	"map/storage"
 
 	"github.com/ontio/ontology/account"
 	"github.com/ontio/ontology/common/config"
@@ -38,8 +39,9 @@ type P2PServer struct {
 	network *netserver.NetServer
 }
 
-//NewServer return a new p2pserver according to the pubkey
-func NewServer(acct *account.Account) (*P2PServer, error) {
+// NewServer creates a p2p server saving the nodes it finds to store, looking
+// them up with lookups, and its recent peers to recentPeersFile.
+func NewServer(acct *account.Account, store storage.NodeStore, lookups *storage.NodeLookups, recentPeersFile string) (*P2PServer, error) {
 	var rsv []string
 	var recRsv []string
 	conf := config.DefConfig.P2PNode
@@ -51,10 +53,10 @@ func NewServer(acct *account.Account) (*P2PServer, error) {
 	}
 
 	staticFilter := connect_controller.NewStaticReserveFilter(rsv)
-	protocol := protocols.NewMsgHandler(acct, connect_controller.NewStaticReserveFilter(recRsv), log.Log)
+	protocol := protocols.NewMsgHandler(acct, connect_controller.NewStaticReserveFilter(recRsv), log.Log, store, lookups, recentPeersFile)
 	reserved := protocol.GetReservedAddrFilter(len(rsv) != 0)
 	reservedPeers := p2p.CombineAddrFilter(staticFilter, reserved)
-	n, err := netserver.NewNetServer(protocol, conf, reservedPeers)
+	n, err := netserver.NewNetServer(protocol, conf, reservedPeers, store, lookups)
 	if err != nil {
 		return nil, err
 	}
@@ -81,6 +83,17 @@ func (self *P2PServer) GetNetwork() p2p.P2P {
 	return self.network
 }
 
+// ConnectController returns the controller of the connections of the network.
+func (self *P2PServer) ConnectController() *connect_controller.ConnectController {
+	return self.network.ConnectController()
+}
+
+// PeerState returns the live state of the connected node listening on addr,
+// nil if it is not connected.
+func (self *P2PServer) PeerState(addr string) *storage.PeerState {
+	return self.network.PeerState(addr)
+}
+
 //WaitForPeersStart check whether enough peer linked in loop
 func (self *P2PServer) WaitForPeersStart() {
 	periodTime := config.DEFAULT_GEN_BLOCK_TIME / common.UPDATE_RATE_PER_BLOCK
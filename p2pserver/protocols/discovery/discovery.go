@@ -41,9 +41,12 @@ type Discovery struct {
 	quit       chan bool
 	maskSet    *strset.Set
 	maskFilter p2p.AddressFilter //todo : conbine with maskSet
+	nodeStore  storage.NodeStore
+	lookups    *storage.NodeLookups
 }
 
-func NewDiscovery(net p2p.P2P, maskLst []string, maskFilter p2p.AddressFilter, refleshInterval time.Duration) *Discovery {
+func NewDiscovery(net p2p.P2P, maskLst []string, maskFilter p2p.AddressFilter, refleshInterval time.Duration,
+	store storage.NodeStore, lookups *storage.NodeLookups) *Discovery {
 	dht := dht.NewDHT(net.GetID())
 	if refleshInterval != 0 {
 		dht.RtRefreshPeriod = refleshInterval
@@ -55,6 +58,8 @@ func NewDiscovery(net p2p.P2P, maskLst []string, maskFilter p2p.AddressFilter, r
 		quit:       make(chan bool),
 		maskSet:    strset.New(maskLst...),
 		maskFilter: maskFilter,
+		nodeStore:  store,
+		lookups:    lookups,
 	}
 }
 
@@ -284,15 +289,19 @@ func (self *Discovery) AddrHandle(ctx *p2p.Context, msg *types.Addr) {
 			continue
 		}
 		ip := net.IP(v.IpAddr[:])
-		address := ip.To16().String() + ":" + strconv.Itoa(int(v.Port))
+		address := net.JoinHostPort(ip.String(), strconv.Itoa(int(v.Port)))
 
 		if self.dht.Contains(v.ID) {
 			continue
 		}
+		// tombstoned nodes kept failing for days, wait for them to be purged
+		if storage.IsTombstoned(self.nodeStore, address) {
+			continue
+		}
 
 		log.Debug("[p2p]connect ip address:", address)
 
-		storage.TryAddNodeAfterReceiveAddrMessage(address, v.Services, uint64(v.Time))
+		storage.TryAddNodeAfterReceiveAddrMessage(self.nodeStore, self.lookups, address, v.Services, uint64(v.Time))
 
 		go p2p.Connect(address)
 	}
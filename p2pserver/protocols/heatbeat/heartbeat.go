@@ -18,6 +18,7 @@
 package heatbeat
 
 import (
+	"map/storage"
 	"sync/atomic"
 	"time"
 
@@ -30,20 +31,22 @@ import (
 )
 
 type HeartBeat struct {
-	net    p2p.P2P
-	id     common.PeerId
-	quit   chan bool
-	height uint64
+	net       p2p.P2P
+	id        common.PeerId
+	quit      chan bool
+	height    uint64
+	nodeStore storage.NodeStore
 }
 
 const DefaultInitBlockHeight = 4555000
 
-func NewHeartBeat(net p2p.P2P) *HeartBeat {
+func NewHeartBeat(net p2p.P2P, store storage.NodeStore) *HeartBeat {
 	return &HeartBeat{
-		id:     net.GetID(),
-		net:    net,
-		quit:   make(chan bool),
-		height: DefaultInitBlockHeight,
+		id:        net.GetID(),
+		net:       net,
+		quit:      make(chan bool),
+		height:    DefaultInitBlockHeight,
+		nodeStore: store,
 	}
 }
 
@@ -84,6 +87,7 @@ func (this *HeartBeat) timeout() {
 		if t.Before(time.Now().Add(-1 * time.Second *
 			time.Duration(periodTime) * common.KEEPALIVE_TIMEOUT)) {
 			log.Warnf("[p2p]keep alive timeout!!!lost remote peer %d - %s from %s", p.GetID(), p.Link.GetAddr(), t.String())
+			storage.RecordPeerTimeout(this.nodeStore, p)
 			p.Close()
 		}
 	}
@@ -109,4 +113,5 @@ func (this *HeartBeat) PongHandle(ctx *p2p.Context, pong *types.Pong) {
 	remotePeer := ctx.Network()
 	remotePeer.SetHeight(pong.Height)
 	atomic.AddUint64(&this.height, 1)
+	storage.UpdateNodeHeight(this.nodeStore, ctx.Sender(), pong.Height)
 }
@@ -21,9 +21,11 @@ package protocols
 import (
 	"fmt"
 
+	"map/metrics"
 	"map/p2pserver/protocols/discovery"
 	"map/p2pserver/protocols/heatbeat"
 	"map/p2pserver/protocols/recent_peers"
+	"map/storage"
 
 	"github.com/hashicorp/golang-lru"
 	"github.com/ontio/ontology/account"
@@ -55,9 +57,13 @@ type MsgHandler struct {
 	subnet                   *subnet.SubNet
 	acct                     *account.Account // nil if conenesus is not enabled
 	staticReserveFilter      p2p.AddressFilter
+	nodeStore                storage.NodeStore
+	nodeLookups              *storage.NodeLookups
+	recentPeersFile          string
 }
 
-func NewMsgHandler(acct *account.Account, staticReserveFilter p2p.AddressFilter, logger msgCommon.Logger) *MsgHandler {
+func NewMsgHandler(acct *account.Account, staticReserveFilter p2p.AddressFilter, logger msgCommon.Logger,
+	store storage.NodeStore, lookups *storage.NodeLookups, recentPeersFile string) *MsgHandler {
 	gov := utils.NewGovNodeMockResolver(nil) //utils.NewGovNodeResolver(ld)
 	seedsList := config.DefConfig.Genesis.SeedList
 	seeds, invalid := utils.NewHostsResolver(seedsList)
@@ -65,7 +71,8 @@ func NewMsgHandler(acct *account.Account, staticReserveFilter p2p.AddressFilter,
 		panic(fmt.Errorf("invalid seed list； %v", invalid))
 	}
 	subNet := subnet.NewSubNet(acct, seeds, gov, logger)
-	return &MsgHandler{seeds: seeds, subnet: subNet, acct: acct, staticReserveFilter: staticReserveFilter}
+	return &MsgHandler{seeds: seeds, subnet: subNet, acct: acct, staticReserveFilter: staticReserveFilter,
+		nodeStore: store, nodeLookups: lookups, recentPeersFile: recentPeersFile}
 }
 
 func (self *MsgHandler) GetReservedAddrFilter(staticFilterEnabled bool) p2p.AddressFilter {
@@ -83,10 +90,10 @@ func (self *MsgHandler) GetSubnetMembersInfo() []msgCommon.SubnetMemberInfo {
 func (self *MsgHandler) start(net p2p.P2P) {
 	self.reconnect = reconnect.NewReconectService(net, self.staticReserveFilter)
 	maskFilter := self.subnet.GetMaskAddrFilter()
-	self.discovery = discovery.NewDiscovery(net, config.DefConfig.P2PNode.ReservedCfg.MaskPeers, maskFilter, 0)
+	self.discovery = discovery.NewDiscovery(net, config.DefConfig.P2PNode.ReservedCfg.MaskPeers, maskFilter, 0, self.nodeStore, self.nodeLookups)
 	self.bootstrap = bootstrap.NewBootstrapService(net, self.seeds)
-	self.heatBeat = heatbeat.NewHeartBeat(net)
-	self.persistRecentPeerService = recent_peers.NewPersistRecentPeerService(net)
+	self.heatBeat = heatbeat.NewHeartBeat(net, self.nodeStore)
+	self.persistRecentPeerService = recent_peers.NewPersistRecentPeerService(net, self.nodeStore, self.recentPeersFile)
 	go self.persistRecentPeerService.Start()
 	go self.reconnect.Start()
 	go self.discovery.Start()
@@ -129,6 +136,7 @@ func (self *MsgHandler) HandleSystemMessage(net p2p.P2P, msg p2p.SystemMessage)
 
 func (self *MsgHandler) HandlePeerMessage(ctx *p2p.Context, msg msgTypes.Message) {
 	log.Trace("[p2p]receive message", ctx.Sender().GetAddr(), ctx.Sender().GetID())
+	metrics.MessagesReceived.WithLabelValues(msg.CmdType()).Inc()
 	switch m := msg.(type) {
 	case *msgTypes.AddrReq:
 		self.discovery.AddrReqHandle(ctx)
@@ -37,6 +37,8 @@ type PersistRecentPeerService struct {
 	quit        chan bool
 	recentPeers map[uint32][]*RecentPeer
 	lock        sync.RWMutex
+	nodeStore   storage.NodeStore
+	file        string
 }
 
 func (this *PersistRecentPeerService) contains(addr string) bool {
@@ -97,16 +99,18 @@ func (this *PersistRecentPeerService) saveToFile() {
 		log.Warn("[p2p]package recent peer fail: ", err)
 		return
 	}
-	err = ioutil.WriteFile(common.RECENT_FILE_NAME, buf, os.ModePerm)
+	err = ioutil.WriteFile(this.file, buf, os.ModePerm)
 	if err != nil {
 		log.Warn("[p2p]write recent peer fail: ", err)
 	}
 }
 
-func NewPersistRecentPeerService(net p2p.P2P) *PersistRecentPeerService {
+func NewPersistRecentPeerService(net p2p.P2P, store storage.NodeStore, file string) *PersistRecentPeerService {
 	return &PersistRecentPeerService{
-		net:  net,
-		quit: make(chan bool),
+		net:       net,
+		quit:      make(chan bool),
+		nodeStore: store,
+		file:      file,
 	}
 }
 
@@ -116,10 +120,10 @@ func (self *PersistRecentPeerService) Stop() {
 
 func (this *PersistRecentPeerService) loadRecentPeers() {
 	this.recentPeers = make(map[uint32][]*RecentPeer)
-	if common2.FileExisted(common.RECENT_FILE_NAME) {
-		buf, err := ioutil.ReadFile(common.RECENT_FILE_NAME)
+	if common2.FileExisted(this.file) {
+		buf, err := ioutil.ReadFile(this.file)
 		if err != nil {
-			log.Warn("[p2p]read %s fail:%s, connect recent peers cancel", common.RECENT_FILE_NAME, err.Error())
+			log.Warn("[p2p]read %s fail:%s, connect recent peers cancel", this.file, err.Error())
 			return
 		}
 
@@ -144,7 +148,14 @@ func (this *PersistRecentPeerService) loadRecentPeersFromStorage() {
 	networkID := config.DefConfig.P2PNode.NetworkMagic
 	this.recentPeers = make(map[uint32][]*RecentPeer)
 
-	for _, node := range storage.ListAllNodes() {
+	nodes, err := storage.ListAllNodes(this.nodeStore)
+	if err != nil {
+		log.Error("[p2p]load recent peers from the node store error", err)
+	}
+	for _, node := range nodes {
+		if node.IsTombstoned() {
+			continue
+		}
 		this.recentPeers[networkID] = append(this.recentPeers[networkID], &RecentPeer{
 			Addr:  node.RemoteListenAddress(),
 			Birth: time.Now().Unix(),
@@ -0,0 +1,68 @@
+package storage
+
+import "sort"
+
+// AsnStat counts the nodes of an autonomous system, 0 for the unknown ones.
+type AsnStat struct {
+	Asn       uint64 `json:"asn"`
+	Org       string `json:"as_org"`
+	IsHosting bool   `json:"is_hosting"`
+	Nodes     int    `json:"nodes"`
+	Consensus int    `json:"consensus"`
+	// the shares (in %) of all the nodes and of the consensus nodes
+	NodeShare      float32 `json:"node_share"`
+	ConsensusShare float32 `json:"consensus_share"`
+}
+
+// AsnStats is the concentration of the nodes per autonomous system.
+type AsnStats struct {
+	Nodes            int `json:"nodes"`
+	Consensus        int `json:"consensus"`
+	Hosting          int `json:"hosting"`
+	HostingConsensus int `json:"hosting_consensus"`
+	// Ases are ordered by decreasing number of nodes
+	Ases []*AsnStat `json:"ases"`
+}
+
+func percent(n, total int) float32 {
+	if total == 0 {
+		return 0
+	}
+	return float32(n) * 100 / float32(total)
+}
+
+func CountByAsn(nodes []*NodeInfo) *AsnStats {
+	stats := &AsnStats{Ases: []*AsnStat{}}
+	ases := make(map[uint64]*AsnStat)
+	for _, node := range nodes {
+		as := ases[node.Asn]
+		if as == nil {
+			as = &AsnStat{Asn: node.Asn, Org: node.AsOrg, IsHosting: node.IsHosting}
+			ases[node.Asn] = as
+			stats.Ases = append(stats.Ases, as)
+		}
+		as.Nodes++
+		stats.Nodes++
+		if node.IsHosting {
+			stats.Hosting++
+		}
+		if node.IsConsensus {
+			as.Consensus++
+			stats.Consensus++
+			if node.IsHosting {
+				stats.HostingConsensus++
+			}
+		}
+	}
+	for _, as := range stats.Ases {
+		as.NodeShare = percent(as.Nodes, stats.Nodes)
+		as.ConsensusShare = percent(as.Consensus, stats.Consensus)
+	}
+	sort.SliceStable(stats.Ases, func(i, j int) bool {
+		if stats.Ases[i].Nodes != stats.Ases[j].Nodes {
+			return stats.Ases[i].Nodes > stats.Ases[j].Nodes
+		}
+		return stats.Ases[i].Asn < stats.Ases[j].Asn
+	})
+	return stats
+}
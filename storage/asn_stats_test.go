@@ -0,0 +1,32 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCountByAsn(t *testing.T) {
+	nodes := []*NodeInfo{
+		{Ip: "1.1.1.1", Asn: 16276, AsOrg: "OVH SAS", IsHosting: true, IsConsensus: true},
+		{Ip: "2.2.2.2", Asn: 16276, AsOrg: "OVH SAS", IsHosting: true},
+		{Ip: "3.3.3.3", Asn: 3215, AsOrg: "Orange", IsConsensus: true},
+		{Ip: "4.4.4.4"},
+	}
+	want := &AsnStats{
+		Nodes:            4,
+		Consensus:        2,
+		Hosting:          2,
+		HostingConsensus: 1,
+		Ases: []*AsnStat{
+			{Asn: 16276, Org: "OVH SAS", IsHosting: true, Nodes: 2, Consensus: 1, NodeShare: 50, ConsensusShare: 50},
+			{Asn: 0, Nodes: 1, NodeShare: 25},
+			{Asn: 3215, Org: "Orange", Nodes: 1, Consensus: 1, NodeShare: 25, ConsensusShare: 50},
+		},
+	}
+	if got := CountByAsn(nodes); !reflect.DeepEqual(got, want) {
+		t.Errorf("stats = %+v, want %+v", got, want)
+	}
+	if got := CountByAsn(nil); !reflect.DeepEqual(got, &AsnStats{Ases: []*AsnStat{}}) {
+		t.Errorf("stats of no node = %+v", got)
+	}
+}
@@ -0,0 +1,480 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/ontio/ontology/common/log"
+	"github.com/ontio/ontology/p2pserver/peer"
+	bolt "go.etcd.io/bbolt"
+)
+
+const PROBE_BUCKET = "PROBE_BUCKET"
+
+const (
+	// PROBE_SLOT is the time span whose probes are counted together
+	PROBE_SLOT = time.Hour
+	// PROBE_RETENTION is the longest availability window
+	PROBE_RETENTION = 30 * 24 * time.Hour
+)
+
+// probeBucketName holds one nested bucket per node address, whose keys are the
+// big endian start times of its probe slots.
+var probeBucketName = []byte(PROBE_BUCKET)
+
+// ProbeSlot counts the connection attempts to a node, and heartbeat timeouts,
+// in the PROBE_SLOT starting at Time (in ms).
+type ProbeSlot struct {
+	Time      uint64 `json:"time"`
+	Successes uint32 `json:"successes"`
+	Failures  uint32 `json:"failures"`
+}
+
+func (self *ProbeSlot) add(success bool) {
+	if success {
+		self.Successes++
+	} else {
+		self.Failures++
+	}
+}
+
+// Probe is the outcome of a connection attempt to a node at Time (in ms).
+type Probe struct {
+	Time    uint64
+	Success bool
+}
+
+// addProbe counts probe in slots, sorted by Time, and returns the slots.
+func addProbe(slots []*ProbeSlot, probe *Probe) []*ProbeSlot {
+	t := probeSlotTime(probe.Time)
+	i := sort.Search(len(slots), func(i int) bool { return slots[i].Time >= t })
+	if i == len(slots) || slots[i].Time != t {
+		slots = append(slots, nil)
+		copy(slots[i+1:], slots[i:])
+		slots[i] = &ProbeSlot{Time: t}
+	}
+	slots[i].add(probe.Success)
+	return slots
+}
+
+func probeSlotTime(t uint64) uint64 {
+	slot := uint64(PROBE_SLOT / time.Millisecond)
+	return t - t%slot
+}
+
+// availability returns the percentage of successful probes of slots since
+// from, nil if there is none.
+func availability(slots []*ProbeSlot, from uint64) *float32 {
+	var successes, total uint64
+	for _, slot := range slots {
+		if slot.Time >= from {
+			successes += uint64(slot.Successes)
+			total += uint64(slot.Successes) + uint64(slot.Failures)
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+	res := float32(successes) * 100 / float32(total)
+	return &res
+}
+
+// applyProbe updates the availabilities of node from its probe slots, which
+// include the probe made at now (in ms), and its reachability from the
+// outcome of the probe. A failure also marks the node unreachable, and a
+// dialable node whose probes failed for UNDIALABLE_AFTER advertised only,
+// until it connects to us again.
+func applyProbe(node *NodeInfo, slots []*ProbeSlot, now uint64, success bool) {
+	node.Availability24h = availability(slots, msBefore(now, 24*time.Hour))
+	node.Availability7d = availability(slots, msBefore(now, 7*24*time.Hour))
+	node.Availability30d = availability(slots, msBefore(now, PROBE_RETENTION))
+	if success {
+		setReachability(node, REACHABILITY_DIALABLE, now)
+		return
+	}
+	node.CanConnect = false
+	switch node.Reachability {
+	case "":
+		node.Reachability = REACHABILITY_ADVERTISED
+	case REACHABILITY_DIALABLE:
+		recent := availability(slots, probeSlotTime(msBefore(now, UNDIALABLE_AFTER)))
+		if recent != nil && *recent == 0 && node.ReachabilityTime < msBefore(now, UNDIALABLE_AFTER) {
+			setReachability(node, REACHABILITY_ADVERTISED, now)
+		}
+	}
+}
+
+// RecordProbe records the outcome of a connection attempt to addr and updates
+// the availability of its node, unless addr is unknown.
+func RecordProbe(store NodeStore, addr string, success bool) {
+	addr, err := NormalizeAddr(addr)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if err := store.RecordProbe(addr, NowInMs(), success); err != nil {
+		log.Error("record probe error", addr, err)
+	}
+}
+
+// expireProbes deletes the probe slots past PROBE_RETENTION at now (in ms),
+// and those of the unknown addresses.
+func expireProbes(store NodeStore, now uint64) error {
+	addrs, err := store.ListProbedAddrs()
+	if err != nil {
+		return err
+	}
+	before := probeSlotTime(msBefore(now, PROBE_RETENTION))
+	for _, addr := range addrs {
+		_, err := store.GetNode(addr)
+		if err == ErrNodeNotFound {
+			if err := store.DeleteProbes(addr, math.MaxUint64); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		// most nodes have no expired slot, spare them a write
+		if before == 0 {
+			continue
+		}
+		expired, err := store.ListProbes(addr, 0, before-1)
+		if err != nil {
+			return err
+		}
+		if len(expired) == 0 {
+			continue
+		}
+		if err := store.DeleteProbes(addr, before); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecordPeerTimeout records a heartbeat timeout of a connected peer as a failed probe.
+func RecordPeerTimeout(store NodeStore, peer *peer.Peer) {
+	_, _, addr, err := getSyncAddrInfoFromPeer(peer)
+	if err != nil {
+		log.Error("get addr info from peer error " + err.Error())
+		return
+	}
+	RecordProbe(store, addr, false)
+}
+
+func (self *BoltNodeStore) RecordProbe(addr string, time uint64, success bool) error {
+	key := []byte(addr)
+	return self.update(func(root *bolt.Bucket) error {
+		b := root.Bucket(bucketName)
+		pb := root.Bucket(probeBucketName)
+		if b == nil || pb == nil {
+			return errors.New("bucket not exist")
+		}
+		val := b.Get(key)
+		if val == nil {
+			return nil
+		}
+		node, _, err := DecodeNodeInfo(val)
+		if err != nil {
+			return err
+		}
+		prev := *node
+		if err := putProbe(pb, addr, &Probe{Time: time, Success: success}); err != nil {
+			return err
+		}
+		slots, err := probeSlots(pb.Bucket(key), msBefore(time, PROBE_RETENTION), time)
+		if err != nil {
+			return err
+		}
+		applyProbe(node, slots, time, success)
+		if err := updateIndexes(root, addr, &prev, node); err != nil {
+			return err
+		}
+		if err := bumpGeneration(root); err != nil {
+			return err
+		}
+		return b.Put(key, EncodeNodeInfo(node))
+	})
+}
+
+// putProbe counts probe in its slot, in the bucket of addr in the probe bucket pb.
+func putProbe(pb *bolt.Bucket, addr string, probe *Probe) error {
+	b, err := pb.CreateBucketIfNotExists([]byte(addr))
+	if err != nil {
+		return err
+	}
+	key := timeKey(probeSlotTime(probe.Time))
+	slot := &ProbeSlot{Time: probeSlotTime(probe.Time)}
+	if val := b.Get(key); val != nil {
+		if err := json.Unmarshal(val, slot); err != nil {
+			return err
+		}
+	}
+	slot.add(probe.Success)
+	val, err := json.Marshal(slot)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, val)
+}
+
+func (self *BoltNodeStore) ListProbes(addr string, from, to uint64) ([]*ProbeSlot, error) {
+	var res []*ProbeSlot
+	err := self.view(func(root *bolt.Bucket) error {
+		pb := root.Bucket(probeBucketName)
+		if pb == nil {
+			return nil
+		}
+		var err error
+		res, err = probeSlots(pb.Bucket([]byte(addr)), from, to)
+		return err
+	})
+	return res, err
+}
+
+// probeSlots returns the slots of the probe bucket b of an address covering
+// from to to, none if b is nil.
+func probeSlots(b *bolt.Bucket, from, to uint64) ([]*ProbeSlot, error) {
+	if b == nil {
+		return nil, nil
+	}
+	var res []*ProbeSlot
+	c := b.Cursor()
+	for k, v := c.Seek(timeKey(probeSlotTime(from))); k != nil && binary.BigEndian.Uint64(k) <= to; k, v = c.Next() {
+		var slot ProbeSlot
+		if err := json.Unmarshal(v, &slot); err != nil {
+			return nil, err
+		}
+		res = append(res, &slot)
+	}
+	return res, nil
+}
+
+func (self *BoltNodeStore) ListProbedAddrs() ([]string, error) {
+	var res []string
+	err := self.view(func(root *bolt.Bucket) error {
+		pb := root.Bucket(probeBucketName)
+		if pb == nil {
+			return nil
+		}
+		return pb.ForEach(func(k, v []byte) error {
+			res = append(res, string(k))
+			return nil
+		})
+	})
+	return res, err
+}
+
+func (self *BoltNodeStore) DeleteProbes(addr string, before uint64) error {
+	return self.update(func(root *bolt.Bucket) error {
+		pb := root.Bucket(probeBucketName)
+		if pb == nil {
+			return errors.New("bucket not exist")
+		}
+		b := pb.Bucket([]byte(addr))
+		if b == nil {
+			return nil
+		}
+		var expired [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) < before; k, _ = c.Next() {
+			expired = append(expired, append([]byte(nil), k...))
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		if k, _ := b.Cursor().First(); k == nil {
+			return pb.DeleteBucket([]byte(addr))
+		}
+		return nil
+	})
+}
+
+func (self *MemNodeStore) RecordProbe(addr string, time uint64, success bool) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	node, ok := self.nodes[addr]
+	if !ok {
+		return nil
+	}
+	self.addProbeSlot(addr, &Probe{Time: time, Success: success})
+	var slots []*ProbeSlot
+	from := probeSlotTime(msBefore(time, PROBE_RETENTION))
+	for i := range self.probes[addr] {
+		if slot := &self.probes[addr][i]; slot.Time >= from && slot.Time <= time {
+			slots = append(slots, slot)
+		}
+	}
+	applyProbe(&node, slots, time, success)
+	self.nodes[addr] = node
+	self.generation++
+	return nil
+}
+
+// addProbeSlot counts probe in the slots of addr. Must hold lock.
+func (self *MemNodeStore) addProbeSlot(addr string, probe *Probe) {
+	slots := self.probes[addr]
+	t := probeSlotTime(probe.Time)
+	i := sort.Search(len(slots), func(i int) bool { return slots[i].Time >= t })
+	if i == len(slots) || slots[i].Time != t {
+		slots = append(slots, ProbeSlot{})
+		copy(slots[i+1:], slots[i:])
+		slots[i] = ProbeSlot{Time: t}
+	}
+	slots[i].add(probe.Success)
+	self.probes[addr] = slots
+}
+
+func (self *MemNodeStore) ListProbes(addr string, from, to uint64) ([]*ProbeSlot, error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	var res []*ProbeSlot
+	for _, slot := range self.probes[addr] {
+		if slot.Time >= probeSlotTime(from) && slot.Time <= to {
+			copied := slot
+			res = append(res, &copied)
+		}
+	}
+	return res, nil
+}
+
+func (self *MemNodeStore) ListProbedAddrs() ([]string, error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	res := make([]string, 0, len(self.probes))
+	for addr := range self.probes {
+		res = append(res, addr)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+func (self *MemNodeStore) DeleteProbes(addr string, before uint64) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	slots := self.probes[addr]
+	i := sort.Search(len(slots), func(i int) bool { return slots[i].Time >= before })
+	if i == len(slots) {
+		delete(self.probes, addr)
+	} else {
+		self.probes[addr] = append([]ProbeSlot(nil), slots[i:]...)
+	}
+	return nil
+}
+
+// RecordProbe applies the probe to the buffered node, and to its probes read
+// from the underlying store and the buffer.
+func (self *WriteBehindStore) RecordProbe(addr string, time uint64, success bool) error {
+	probe := &Probe{Time: time, Success: success}
+	from := msBefore(time, PROBE_RETENTION)
+	self.lock.Lock()
+	for {
+		var node *NodeInfo
+		var pending []*Probe
+		var slots []*ProbeSlot
+		err := self.readStore(func() {
+			node = self.pending[addr]
+			pending = append([]*Probe(nil), self.pendingProbes[addr]...)
+		}, func() error {
+			if node == nil {
+				stored, err := self.store.GetNode(addr)
+				if err == ErrNodeNotFound {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				node = stored
+			}
+			var err error
+			slots, err = self.store.ListProbes(addr, from, time)
+			return err
+		})
+		if err != nil || node == nil {
+			self.lock.Unlock()
+			return err
+		}
+		// start over if the node or its probes were buffered meanwhile
+		if buffered, ok := self.pending[addr]; (ok && buffered != node) ||
+			len(self.pendingProbes[addr]) != len(pending) {
+			continue
+		}
+		for _, buffered := range pending {
+			if buffered.Time >= probeSlotTime(from) && buffered.Time <= time {
+				slots = addProbe(slots, buffered)
+			}
+		}
+		slots = addProbe(slots, probe)
+		copied := *node
+		applyProbe(&copied, slots, time, success)
+		self.buffer(&copied)
+		self.pendingProbes[addr] = append(self.pendingProbes[addr], probe)
+		self.pendingCount++
+		break
+	}
+	self.lock.Unlock()
+	self.throttle()
+	return nil
+}
+
+// ListProbes adds the buffered probes to the slots of the underlying store.
+func (self *WriteBehindStore) ListProbes(addr string, from, to uint64) ([]*ProbeSlot, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	var pending []*Probe
+	var slots []*ProbeSlot
+	err := self.readStore(func() {
+		pending = append([]*Probe(nil), self.pendingProbes[addr]...)
+	}, func() error {
+		var err error
+		slots, err = self.store.ListProbes(addr, from, to)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, probe := range pending {
+		if probe.Time >= probeSlotTime(from) && probe.Time <= to {
+			slots = addProbe(slots, probe)
+		}
+	}
+	return slots, nil
+}
+
+func (self *WriteBehindStore) ListProbedAddrs() ([]string, error) {
+	if err := self.Flush(); err != nil {
+		return nil, err
+	}
+	return self.store.ListProbedAddrs()
+}
+
+// DeleteProbes also drops the buffered probes of addr before before.
+func (self *WriteBehindStore) DeleteProbes(addr string, before uint64) error {
+	self.flushLock.Lock()
+	defer self.flushLock.Unlock()
+	self.lock.Lock()
+	var kept []*Probe
+	for _, probe := range self.pendingProbes[addr] {
+		if probeSlotTime(probe.Time) >= before {
+			kept = append(kept, probe)
+		}
+	}
+	self.pendingCount -= len(self.pendingProbes[addr]) - len(kept)
+	if len(kept) == 0 {
+		delete(self.pendingProbes, addr)
+	} else {
+		self.pendingProbes[addr] = kept
+	}
+	self.beginWrite()
+	self.lock.Unlock()
+	err := self.store.DeleteProbes(addr, before)
+	self.endWrite()
+	return err
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAvailability(t *testing.T) {
+	hour := uint64(time.Hour / time.Millisecond)
+	now := 1000 * hour
+	slots := []*ProbeSlot{
+		{Time: now - 200*hour, Successes: 4},
+		{Time: now - 48*hour, Failures: 4},
+		{Time: now - hour, Successes: 3, Failures: 1},
+	}
+	tests := []struct {
+		name  string
+		slots []*ProbeSlot
+		from  uint64
+		want  *float32
+	}{
+		{"no probe", nil, 0, nil},
+		{"no probe in the window", slots, now, nil},
+		{"24h", slots, now - 24*hour, float32Ptr(75)},
+		{"7d", slots, now - 7*24*hour, float32Ptr(37.5)},
+		{"30d", slots, now - 30*24*hour, float32Ptr(float32(700) / 12)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := availability(test.slots, test.from); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("availability = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestApplyProbe(t *testing.T) {
+	hour := uint64(time.Hour / time.Millisecond)
+	now := 1000 * hour
+	slots := []*ProbeSlot{{Time: now - 48*hour, Successes: 1}, {Time: probeSlotTime(now), Failures: 1}}
+
+	node := &NodeInfo{CanConnect: true}
+	applyProbe(node, slots, now, false)
+	want := &NodeInfo{Availability24h: float32Ptr(0), Availability7d: float32Ptr(50), Availability30d: float32Ptr(50),
+		Reachability: REACHABILITY_ADVERTISED}
+	if !reflect.DeepEqual(node, want) {
+		t.Errorf("failed probe applied as %+v, want %+v", node, want)
+	}
+	node = &NodeInfo{}
+	applyProbe(node, slots, now, true)
+	if node.CanConnect || node.Availability24h == nil {
+		t.Errorf("successful probe applied as %+v", node)
+	}
+}
+
+func TestRecordProbe(t *testing.T) {
+	hour := uint64(time.Hour / time.Millisecond)
+	now := 1000 * hour
+	for _, impl := range testStores {
+		t.Run(impl.name, func(t *testing.T) {
+			store, closeStore := impl.open(t)
+			defer closeStore()
+			if err := store.PutNode(&NodeInfo{Ip: "1.1.1.1", Port: 1, CanConnect: true}); err != nil {
+				t.Fatal(err)
+			}
+
+			probes := []*Probe{{now - 48*hour, true}, {now - hour, true}, {now, false}}
+			for _, probe := range probes {
+				if err := store.RecordProbe("1.1.1.1:1", probe.Time, probe.Success); err != nil {
+					t.Fatal(err)
+				}
+			}
+			node, err := store.GetNode("1.1.1.1:1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := &NodeInfo{Ip: "1.1.1.1", Port: 1, Availability24h: float32Ptr(50),
+				Availability7d: float32Ptr(float32(200) / 3), Availability30d: float32Ptr(float32(200) / 3),
+				Reachability: REACHABILITY_DIALABLE, ReachabilityTime: now - hour}
+			if !reflect.DeepEqual(node, want) {
+				t.Errorf("probed node = %+v, want %+v", node, want)
+			}
+			slots, err := store.ListProbes("1.1.1.1:1", now-hour, now)
+			if err != nil || !reflect.DeepEqual(slots, []*ProbeSlot{{Time: now - hour, Successes: 1}, {Time: now, Failures: 1}}) {
+				t.Errorf("probe slots = %v (%v)", slots, err)
+			}
+
+			// the probes of unknown addresses are ignored
+			if err := store.RecordProbe("2.2.2.2:2", now, true); err != nil {
+				t.Fatal(err)
+			}
+			if slots, err := store.ListProbes("2.2.2.2:2", 0, now); err != nil || len(slots) != 0 {
+				t.Errorf("probe slots of an unknown address = %v (%v)", slots, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+
+	"github.com/ontio/ontology/common/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+const INDEX_BUCKET = "INDEX_BUCKET"
+
+// indexBucketName holds one nested bucket per nodeIndex, whose keys are
+// "<value>\x00<addr>" so that the addrs of a value are a contiguous range.
+var indexBucketName = []byte(INDEX_BUCKET)
+
+type nodeIndex struct {
+	name []byte
+	// value returns the indexed value of node
+	value func(node *NodeInfo) string
+	// lookup returns the value selected by filter, if the filter uses the index
+	lookup func(filter *NodeFilter) (string, bool)
+}
+
+var nodeIndexes = []nodeIndex{
+	{
+		name:  []byte("country"),
+		value: func(node *NodeInfo) string { return node.Country },
+		lookup: func(filter *NodeFilter) (string, bool) {
+			return filter.Country, filter.Country != ""
+		},
+	},
+	{
+		name:  []byte("soft_version"),
+		value: func(node *NodeInfo) string { return node.SoftVersion },
+		lookup: func(filter *NodeFilter) (string, bool) {
+			return filter.SoftVersion, filter.SoftVersion != ""
+		},
+	},
+	{
+		name:  []byte("can_connect"),
+		value: func(node *NodeInfo) string { return strconv.FormatBool(node.CanConnect) },
+		lookup: func(filter *NodeFilter) (string, bool) {
+			return boolLookup(filter.CanConnect)
+		},
+	},
+	{
+		name:  []byte("consensus"),
+		value: func(node *NodeInfo) string { return strconv.FormatBool(node.IsConsensus) },
+		lookup: func(filter *NodeFilter) (string, bool) {
+			return boolLookup(filter.IsConsensus)
+		},
+	},
+	{
+		name:  []byte("located"),
+		value: func(node *NodeInfo) string { return strconv.FormatBool(node.IsLocated()) },
+		lookup: func(filter *NodeFilter) (string, bool) {
+			return boolLookup(filter.IsLocated)
+		},
+	},
+	{
+		name:  []byte("reachability"),
+		value: func(node *NodeInfo) string { return node.Reachability },
+		lookup: func(filter *NodeFilter) (string, bool) {
+			return filter.Reachability, filter.Reachability != ""
+		},
+	},
+}
+
+func boolLookup(v *bool) (string, bool) {
+	if v == nil {
+		return "", false
+	}
+	return strconv.FormatBool(*v), true
+}
+
+func indexPrefix(value string) []byte {
+	return append([]byte(value), 0)
+}
+
+func indexKey(value, addr string) []byte {
+	return append(indexPrefix(value), addr...)
+}
+
+// updateIndexes moves the index entries of addr from old to node, either may be nil.
+func updateIndexes(root bucketContainer, addr string, old, node *NodeInfo) error {
+	ib := root.Bucket(indexBucketName)
+	if ib == nil {
+		return errors.New("bucket not exist")
+	}
+	for _, index := range nodeIndexes {
+		b, err := ib.CreateBucketIfNotExists(index.name)
+		if err != nil {
+			return err
+		}
+		if old != nil && (node == nil || index.value(old) != index.value(node)) {
+			if err := b.Delete(indexKey(index.value(old), addr)); err != nil {
+				return err
+			}
+		}
+		if node != nil {
+			if err := b.Put(indexKey(index.value(node), addr), []byte{}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// indexedNode returns the record of addr in the node bucket b, nil if there is
+// none. The index entries of an undecodable record are found by scanning the
+// indexes and removed, for the record to be replaced.
+func indexedNode(root bucketContainer, b *bolt.Bucket, addr string) (*NodeInfo, error) {
+	val := b.Get([]byte(addr))
+	if val == nil {
+		return nil, nil
+	}
+	node, _, err := DecodeNodeInfo(val)
+	if err == nil {
+		return node, nil
+	}
+	log.Warnf("replace undecodable node record %s: %s", addr, err)
+	ib := root.Bucket(indexBucketName)
+	if ib == nil {
+		return nil, errors.New("bucket not exist")
+	}
+	suffix := append([]byte{0}, addr...)
+	for _, index := range nodeIndexes {
+		bi := ib.Bucket(index.name)
+		if bi == nil {
+			continue
+		}
+		var stale [][]byte
+		err := bi.ForEach(func(k, _ []byte) error {
+			if bytes.HasSuffix(k, suffix) {
+				stale = append(stale, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range stale {
+			if err := bi.Delete(k); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return nil, nil
+}
+
+// rebuildIndexes recreates every index from the node records of root, skipping
+// the undecodable ones.
+func rebuildIndexes(root bucketContainer) error {
+	b := root.Bucket(bucketName)
+	if b == nil {
+		return nil
+	}
+	if root.Bucket(indexBucketName) != nil {
+		if err := root.DeleteBucket(indexBucketName); err != nil {
+			return err
+		}
+	}
+	if _, err := root.CreateBucket(indexBucketName); err != nil {
+		return err
+	}
+	return b.ForEach(func(k, v []byte) error {
+		node, _, err := DecodeNodeInfo(v)
+		if err != nil {
+			return nil
+		}
+		return updateIndexes(root, string(k), nil, node)
+	})
+}
+
+func (self *BoltNodeStore) QueryNodes(filter *NodeFilter) ([]*NodeInfo, error) {
+	var res []*NodeInfo
+	err := self.view(func(root *bolt.Bucket) error {
+		b := root.Bucket(bucketName)
+		ib := root.Bucket(indexBucketName)
+		if b == nil || ib == nil {
+			return errors.New("bucket not exist")
+		}
+		if index, prefix := narrowestIndex(ib, filter); index != nil {
+			bi := ib.Bucket(index.name)
+			if bi == nil {
+				return nil
+			}
+			c := bi.Cursor()
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				val := b.Get(k[len(prefix):])
+				if val == nil {
+					continue
+				}
+				node, _, err := DecodeNodeInfo(val)
+				if err != nil {
+					continue
+				}
+				if filter.Match(node) {
+					res = append(res, node)
+				}
+			}
+			return nil
+		}
+		// no indexed field set, fall back to a full scan
+		return b.ForEach(func(k, v []byte) error {
+			node, _, err := DecodeNodeInfo(v)
+			if err == nil && filter.Match(node) {
+				res = append(res, node)
+			}
+			return nil
+		})
+	})
+	return res, err
+}
+
+// narrowestIndex returns the index used by filter with the fewest entries for
+// the selected value, along with the prefix of these entries. The index is nil
+// if filter uses none.
+func narrowestIndex(ib *bolt.Bucket, filter *NodeFilter) (*nodeIndex, []byte) {
+	var best *nodeIndex
+	var bestPrefix []byte
+	bestCount := -1
+	for i, index := range nodeIndexes {
+		value, ok := index.lookup(filter)
+		if !ok {
+			continue
+		}
+		prefix := indexPrefix(value)
+		// stop counting once the range is wider than the best one
+		count := 0
+		if bi := ib.Bucket(index.name); bi != nil {
+			c := bi.Cursor()
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				if bestCount >= 0 && count >= bestCount {
+					break
+				}
+				count++
+			}
+		}
+		if bestCount < 0 || count < bestCount {
+			best, bestPrefix, bestCount = &nodeIndexes[i], prefix, count
+		}
+	}
+	return best, bestPrefix
+}
@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func boolPtr(v bool) *bool {
+	return &v
+}
+
+// dumpIndexes returns the index entries of store by index name.
+func dumpIndexes(t *testing.T, store *BoltNodeStore) map[string][]string {
+	res := make(map[string][]string)
+	err := store.view(func(root *bolt.Bucket) error {
+		return root.Bucket(indexBucketName).ForEach(func(name, _ []byte) error {
+			return root.Bucket(indexBucketName).Bucket(name).ForEach(func(k, _ []byte) error {
+				res[string(name)] = append(res[string(name)], string(k))
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// corruptNode replaces the record of addr with an undecodable one, leaving its
+// index entries.
+func corruptNode(store *BoltNodeStore, addr string) error {
+	return store.update(func(root *bolt.Bucket) error {
+		return root.Bucket(bucketName).Put([]byte(addr), []byte{0xff})
+	})
+}
+
+func TestIndexMaintenance(t *testing.T) {
+	store, closeStore := newTestBoltStore(t)
+	defer closeStore()
+
+	setCountry := func(country string) func(*NodeInfo) (*NodeInfo, error) {
+		return func(old *NodeInfo) (*NodeInfo, error) {
+			old.Country = country
+			return old, nil
+		}
+	}
+	steps := []struct {
+		name  string
+		write func() error
+		// the addresses each filter selects after the write
+		queries map[string][]string
+	}{
+		{
+			name: "put",
+			write: func() error {
+				return store.PutNode(&NodeInfo{Ip: "1.1.1.1", Port: 1, Country: "FR", SoftVersion: "v1",
+					LocationState: LOCATION_RESOLVED})
+			},
+			queries: map[string][]string{"FR": {"1.1.1.1:1"}, "v1": {"1.1.1.1:1"}, "located": {"1.1.1.1:1"},
+				"connectable": {}},
+		},
+		{
+			name: "put more",
+			write: func() error {
+				if err := store.PutNode(&NodeInfo{Ip: "2.2.2.2", Port: 2, Country: "FR", SoftVersion: "v2",
+					CanConnect: true, LocationState: LOCATION_RESOLVED}); err != nil {
+					return err
+				}
+				return store.PutNode(&NodeInfo{Ip: "3.3.3.3", Port: 3, Country: "DE", SoftVersion: "v1",
+					IsConsensus: true, Lat: DEFAULT_LAT_LON, Lon: DEFAULT_LAT_LON, LocationState: LOCATION_PENDING})
+			},
+			queries: map[string][]string{"FR": {"1.1.1.1:1", "2.2.2.2:2"}, "v1": {"1.1.1.1:1", "3.3.3.3:3"},
+				"connectable": {"2.2.2.2:2"}, "consensus": {"3.3.3.3:3"}, "located": {"1.1.1.1:1", "2.2.2.2:2"},
+				"FR v1": {"1.1.1.1:1"}},
+		},
+		{
+			name:    "update moves the entry",
+			write:   func() error { return store.UpdateNode("1.1.1.1:1", setCountry("DE")) },
+			queries: map[string][]string{"FR": {"2.2.2.2:2"}, "DE": {"1.1.1.1:1", "3.3.3.3:3"}},
+		},
+		{
+			name: "update of an unknown node",
+			write: func() error {
+				return store.UpdateNode("4.4.4.4:4", func(*NodeInfo) (*NodeInfo, error) { return nil, nil })
+			},
+			queries: map[string][]string{"DE": {"1.1.1.1:1", "3.3.3.3:3"}},
+		},
+		{
+			name: "put replaces the entry",
+			write: func() error {
+				return store.PutNode(&NodeInfo{Ip: "2.2.2.2", Port: 2, Country: "US", SoftVersion: "v2",
+					LocationState: LOCATION_RESOLVED})
+			},
+			queries: map[string][]string{"FR": {}, "connectable": {}},
+		},
+		{
+			name:  "delete",
+			write: func() error { return store.DeleteNode("3.3.3.3:3") },
+			queries: map[string][]string{"DE": {"1.1.1.1:1"}, "v1": {"1.1.1.1:1"}, "consensus": {},
+				"located": {"1.1.1.1:1", "2.2.2.2:2"}},
+		},
+		{
+			name: "put over an undecodable record",
+			write: func() error {
+				if err := corruptNode(store, "1.1.1.1:1"); err != nil {
+					return err
+				}
+				return store.PutNode(&NodeInfo{Ip: "1.1.1.1", Port: 1, Country: "NL", SoftVersion: "v3"})
+			},
+			queries: map[string][]string{"DE": {}, "v1": {}, "located": {"2.2.2.2:2"}},
+		},
+		{
+			name: "delete an undecodable record",
+			write: func() error {
+				if err := corruptNode(store, "2.2.2.2:2"); err != nil {
+					return err
+				}
+				return store.DeleteNode("2.2.2.2:2")
+			},
+			queries: map[string][]string{"located": {}},
+		},
+	}
+	filters := map[string]*NodeFilter{
+		"FR":          {Country: "FR"},
+		"DE":          {Country: "DE"},
+		"v1":          {SoftVersion: "v1"},
+		"FR v1":       {Country: "FR", SoftVersion: "v1"},
+		"located":     {IsLocated: boolPtr(true)},
+		"connectable": {CanConnect: boolPtr(true)},
+		"consensus":   {IsConsensus: boolPtr(true)},
+	}
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			if err := step.write(); err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range step.queries {
+				nodes, err := store.QueryNodes(filters[name])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := nodeAddrs(nodes); !reflect.DeepEqual(got, want) {
+					t.Errorf("%s = %v, want %v", name, got, want)
+				}
+			}
+			// the indexes maintained by the writes are those rebuilt from the records
+			maintained := dumpIndexes(t, store)
+			if err := store.update(func(root *bolt.Bucket) error { return rebuildIndexes(root) }); err != nil {
+				t.Fatal(err)
+			}
+			if rebuilt := dumpIndexes(t, store); !reflect.DeepEqual(maintained, rebuilt) {
+				t.Errorf("indexes = %v, rebuilt %v", maintained, rebuilt)
+			}
+		})
+	}
+}
+
+func TestQueryNodes(t *testing.T) {
+	nodes := []*NodeInfo{
+		{Ip: "1.1.1.1", Port: 1, Country: "FR", SoftVersion: "v1", CanConnect: true, LocationState: LOCATION_RESOLVED},
+		{Ip: "2.2.2.2", Port: 2, Country: "FR", SoftVersion: "v2", IsConsensus: true, LocationState: LOCATION_RESOLVED},
+		{Ip: "3.3.3.3", Port: 3, Country: "DE", SoftVersion: "v1", Lat: DEFAULT_LAT_LON, Lon: DEFAULT_LAT_LON,
+			LocationState: LOCATION_PENDING},
+	}
+	tests := []struct {
+		name   string
+		filter *NodeFilter
+		want   []string
+	}{
+		{"all", &NodeFilter{}, []string{"1.1.1.1:1", "2.2.2.2:2", "3.3.3.3:3"}},
+		{"country", &NodeFilter{Country: "FR"}, []string{"1.1.1.1:1", "2.2.2.2:2"}},
+		{"country and version", &NodeFilter{Country: "FR", SoftVersion: "v1"}, []string{"1.1.1.1:1"}},
+		{"not consensus", &NodeFilter{IsConsensus: boolPtr(false)}, []string{"1.1.1.1:1", "3.3.3.3:3"}},
+		{"unlocated", &NodeFilter{IsLocated: boolPtr(false)}, []string{"3.3.3.3:3"}},
+		{"no match", &NodeFilter{Country: "US"}, []string{}},
+	}
+	for _, impl := range testStores {
+		t.Run(impl.name, func(t *testing.T) {
+			store, closeStore := impl.open(t)
+			defer closeStore()
+			for _, node := range nodes {
+				if err := store.PutNode(node); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, test := range tests {
+				got, err := store.QueryNodes(test.filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(nodeAddrs(got), test.want) {
+					t.Errorf("%s = %v, want %v", test.name, nodeAddrs(got), test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestNarrowestIndex(t *testing.T) {
+	store, closeStore := newTestBoltStore(t)
+	defer closeStore()
+	for _, node := range []*NodeInfo{
+		{Ip: "1.1.1.1", Port: 1, Country: "FR", SoftVersion: "v1"},
+		{Ip: "2.2.2.2", Port: 2, Country: "FR", SoftVersion: "v2"},
+		{Ip: "3.3.3.3", Port: 3, Country: "FR", SoftVersion: "v1"},
+	} {
+		if err := store.PutNode(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name   string
+		filter *NodeFilter
+		want   string
+	}{
+		{"the only one", &NodeFilter{Country: "FR"}, "country"},
+		{"fewer entries", &NodeFilter{Country: "FR", SoftVersion: "v2"}, "soft_version"},
+		{"no entry", &NodeFilter{Country: "US", SoftVersion: "v1"}, "country"},
+		{"none", &NodeFilter{}, ""},
+	}
+	err := store.view(func(root *bolt.Bucket) error {
+		ib := root.Bucket(indexBucketName)
+		for _, test := range tests {
+			got := ""
+			if index, _ := narrowestIndex(ib, test.filter); index != nil {
+				got = string(index.name)
+			}
+			if got != test.want {
+				t.Errorf("%s = %q, want %q", test.name, got, test.want)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
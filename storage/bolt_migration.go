@@ -0,0 +1,405 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/ontio/ontology/common/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	META_BUCKET    = "META_BUCKET"
+	CORRUPT_BUCKET = "CORRUPT_BUCKET"
+)
+
+var metaBucketName = []byte(META_BUCKET)
+
+// corruptBucketName keeps the undecodable node records moved aside by a repair.
+var corruptBucketName = []byte(CORRUPT_BUCKET)
+
+var schemaVersionKey = []byte("schema_version")
+
+// ErrNetworkRequired is returned when records written before networks were
+// namespaced are opened with NETWORK_UNSPECIFIED.
+var ErrNetworkRequired = errors.New("legacy node records need the network they belong to")
+
+type migration struct {
+	version uint64
+	name    string
+	// run upgrades tx, network is the bucket name of the default network, nil
+	// if unspecified
+	run func(tx *bolt.Tx, network []byte) error
+}
+
+// migrations upgrade the database schema, in increasing version order. Append
+// a new one whenever the layout of a bucket or of its records changes.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "encode node records with the binary codec",
+		run:     func(tx *bolt.Tx, _ []byte) error { return reencodeNodeRecords(tx) },
+	},
+	{
+		version: 2,
+		name:    "build the node indexes",
+		run:     func(tx *bolt.Tx, _ []byte) error { return rebuildIndexes(tx) },
+	},
+	{
+		version: 3,
+		name:    "move the buckets into the bucket of the default network",
+		run:     moveToNetworkBucket,
+	},
+	{
+		version: 4,
+		name:    "normalize the node addresses, bracketing ipv6 ones",
+		run:     func(tx *bolt.Tx, _ []byte) error { return forEachNetwork(tx, normalizeAddrKeys) },
+	},
+	{
+		version: 5,
+		name:    "encode the node records as v2",
+		run: func(tx *bolt.Tx, _ []byte) error {
+			return forEachNetwork(tx, func(root *bolt.Bucket) error { return reencodeNodeRecords(root) })
+		},
+	},
+	{
+		version: 6,
+		name:    "classify the reachability of the stored nodes and index it",
+		run:     func(tx *bolt.Tx, _ []byte) error { return forEachNetwork(tx, initReachabilities) },
+	},
+	{
+		version: 7,
+		name:    "record the location state of the stored nodes and reindex them",
+		run:     func(tx *bolt.Tx, _ []byte) error { return forEachNetwork(tx, initLocationStates) },
+	},
+}
+
+func schemaVersion(tx *bolt.Tx) uint64 {
+	b := tx.Bucket(metaBucketName)
+	if b == nil {
+		return 0
+	}
+	val := b.Get(schemaVersionKey)
+	if len(val) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(val)
+}
+
+// migrate runs every pending migration, each in its own transaction.
+func migrate(db *bolt.DB, network uint32) error {
+	for _, m := range migrations {
+		err := db.Update(func(tx *bolt.Tx) error {
+			if schemaVersion(tx) >= m.version {
+				return nil
+			}
+			log.Infof("migrate node db to version %d: %s", m.version, m.name)
+			var root []byte
+			if network != NETWORK_UNSPECIFIED {
+				root = networkBucketName(network)
+			}
+			if err := m.run(tx, root); err != nil {
+				return err
+			}
+			b, err := tx.CreateBucketIfNotExists(metaBucketName)
+			if err != nil {
+				return err
+			}
+			val := make([]byte, 8)
+			binary.BigEndian.PutUint64(val, m.version)
+			return b.Put(schemaVersionKey, val)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reencodeNodeRecords rewrites the legacy node records with the latest codec.
+// Undecodable records are left as is for CheckNodeRecords to report.
+func reencodeNodeRecords(root bucketContainer) error {
+	b := root.Bucket(bucketName)
+	if b == nil {
+		return nil
+	}
+	updated := make(map[string][]byte)
+	err := b.ForEach(func(k, v []byte) error {
+		node, version, err := DecodeNodeInfo(v)
+		if err == nil && version != NODE_RECORD_LATEST {
+			updated[string(k)] = EncodeNodeInfo(node)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for k, v := range updated {
+		if err := b.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveToNetworkBucket moves the top level buckets written before networks were
+// namespaced into the bucket of network, which must be given if there are any.
+func moveToNetworkBucket(tx *bolt.Tx, network []byte) error {
+	names := [][]byte{bucketName, historyBucketName, censusBucketName, indexBucketName, corruptBucketName}
+	for _, name := range names {
+		src := tx.Bucket(name)
+		if src == nil {
+			continue
+		}
+		if network == nil {
+			return ErrNetworkRequired
+		}
+		root, err := tx.CreateBucketIfNotExists(network)
+		if err != nil {
+			return err
+		}
+		dst, err := root.CreateBucketIfNotExists(name)
+		if err != nil {
+			return err
+		}
+		if err := copyBucket(dst, src); err != nil {
+			return err
+		}
+		if err := tx.DeleteBucket(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyBucket copies src into dst recursively. Keys and values are copied, as
+// the memory of src is released once it is deleted.
+func copyBucket(dst, src *bolt.Bucket) error {
+	return src.ForEach(func(k, v []byte) error {
+		key := append([]byte(nil), k...)
+		if v != nil {
+			return dst.Put(key, append([]byte(nil), v...))
+		}
+		sub, err := dst.CreateBucketIfNotExists(key)
+		if err != nil {
+			return err
+		}
+		return copyBucket(sub, src.Bucket(k))
+	})
+}
+
+// forEachNetwork runs fn on the bucket of every network.
+func forEachNetwork(tx *bolt.Tx, fn func(root *bolt.Bucket) error) error {
+	var roots []*bolt.Bucket
+	err := tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		if bytes.HasPrefix(name, []byte(NETWORK_BUCKET)) {
+			roots = append(roots, b)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, root := range roots {
+		if err := fn(root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// normalizeAddrKeys re-keys the node records and histories of root by their
+// NormalizeAddr address. Records colliding on a same address keep the most
+// recently active one. Unparsable keys are left as is.
+func normalizeAddrKeys(root *bolt.Bucket) error {
+	if b := root.Bucket(bucketName); b != nil {
+		renamed := make(map[string]*NodeInfo)
+		var stale [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			node, _, err := DecodeNodeInfo(v)
+			if err != nil {
+				return nil
+			}
+			node.Ip = NormalizeIp(node.Ip)
+			addr := node.RemoteListenAddress()
+			if addr == string(k) {
+				return nil
+			}
+			stale = append(stale, append([]byte(nil), k...))
+			if other, ok := renamed[addr]; ok && other.LastActiveTime >= node.LastActiveTime {
+				return nil
+			}
+			renamed[addr] = node
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		for addr, node := range renamed {
+			if val := b.Get([]byte(addr)); val != nil {
+				if other, _, err := DecodeNodeInfo(val); err == nil && other.LastActiveTime >= node.LastActiveTime {
+					continue
+				}
+			}
+			if err := b.Put([]byte(addr), EncodeNodeInfo(node)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if hb := root.Bucket(historyBucketName); hb != nil {
+		var stale [][]byte
+		err := hb.ForEach(func(k, _ []byte) error {
+			if addr, err := NormalizeAddr(string(k)); err == nil && addr != string(k) {
+				stale = append(stale, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range stale {
+			addr, _ := NormalizeAddr(string(k))
+			dst, err := hb.CreateBucketIfNotExists([]byte(addr))
+			if err != nil {
+				return err
+			}
+			if err := copyBucket(dst, hb.Bucket(k)); err != nil {
+				return err
+			}
+			if err := hb.DeleteBucket(k); err != nil {
+				return err
+			}
+		}
+	}
+	return rebuildIndexes(root)
+}
+
+// SchemaVersion returns the version of the latest migration applied.
+func (self *BoltNodeDb) SchemaVersion() (uint64, error) {
+	var version uint64
+	err := self.db.View(func(tx *bolt.Tx) error {
+		version = schemaVersion(tx)
+		return nil
+	})
+	return version, err
+}
+
+// CheckReport describes the node records found by CheckNodeRecords.
+type CheckReport struct {
+	Total    int
+	Outdated []string // decodable but not in the latest encoding
+	Corrupt  []string // undecodable
+	Repaired bool
+}
+
+// CheckNodeRecords decodes every node record. With repair, outdated records are
+// re-encoded and corrupt ones are moved to the corrupt bucket.
+func (self *BoltNodeStore) CheckNodeRecords(repair bool) (*CheckReport, error) {
+	report := &CheckReport{}
+	check := func(root *bolt.Bucket) error {
+		b := root.Bucket(bucketName)
+		if b == nil {
+			return errors.New("bucket not exist")
+		}
+		return b.ForEach(func(k, v []byte) error {
+			report.Total++
+			_, version, err := DecodeNodeInfo(v)
+			if err != nil {
+				report.Corrupt = append(report.Corrupt, string(k))
+			} else if version != NODE_RECORD_LATEST {
+				report.Outdated = append(report.Outdated, string(k))
+			}
+			return nil
+		})
+	}
+	if !repair {
+		return report, self.view(check)
+	}
+
+	err := self.update(func(root *bolt.Bucket) error {
+		if err := check(root); err != nil {
+			return err
+		}
+		if err := reencodeNodeRecords(root); err != nil {
+			return err
+		}
+		if len(report.Corrupt) == 0 {
+			return nil
+		}
+		corrupt, err := root.CreateBucketIfNotExists(corruptBucketName)
+		if err != nil {
+			return err
+		}
+		b := root.Bucket(bucketName)
+		for _, addr := range report.Corrupt {
+			val := append([]byte(nil), b.Get([]byte(addr))...)
+			if err := corrupt.Put([]byte(addr), val); err != nil {
+				return err
+			}
+			if err := b.Delete([]byte(addr)); err != nil {
+				return err
+			}
+		}
+		if err := bumpGeneration(root); err != nil {
+			return err
+		}
+		// drop the index entries of the corrupt records
+		return rebuildIndexes(root)
+	})
+	if err != nil {
+		return nil, err
+	}
+	report.Repaired = true
+	return report, nil
+}
+
+// initReachabilities sets the reachability of the node records of root
+// stored before it, and indexes it.
+func initReachabilities(root *bolt.Bucket) error {
+	if err := updateNodeRecords(root, initReachability); err != nil {
+		return err
+	}
+	return rebuildIndexes(root)
+}
+
+// initLocationStates sets the location state of the node records of root
+// stored before it, and reindexes the private nodes it unlocates.
+func initLocationStates(root *bolt.Bucket) error {
+	if err := updateNodeRecords(root, initLocationState); err != nil {
+		return err
+	}
+	return rebuildIndexes(root)
+}
+
+// updateNodeRecords saves the node records of root that update changes,
+// leaving the undecodable ones to the repair.
+func updateNodeRecords(root *bolt.Bucket, update func(node *NodeInfo) bool) error {
+	b := root.Bucket(bucketName)
+	if b == nil {
+		return nil
+	}
+	updated := make(map[string][]byte)
+	err := b.ForEach(func(k, v []byte) error {
+		node, _, err := DecodeNodeInfo(v)
+		if err == nil && update(node) {
+			updated[string(k)] = EncodeNodeInfo(node)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for k, v := range updated {
+		if err := b.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,332 @@
+package storage
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// writeLegacyDb writes a database of schema version 0: top level buckets
+// holding node records keyed by their unnormalized address.
+func writeLegacyDb(t *testing.T, path string, records map[string][]byte, histories []string) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket(bucketName)
+		if err != nil {
+			return err
+		}
+		for addr, record := range records {
+			if err := b.Put([]byte(addr), record); err != nil {
+				return err
+			}
+		}
+		hb, err := tx.CreateBucket(historyBucketName)
+		if err != nil {
+			return err
+		}
+		for _, addr := range histories {
+			nb, err := hb.CreateBucket([]byte(addr))
+			if err != nil {
+				return err
+			}
+			key := make([]byte, 8)
+			binary.BigEndian.PutUint64(key, 1500000000000)
+			if err := nb.Put(key, []byte("{}")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	located := &NodeInfo{Ip: "1.2.3.4", Port: 20338, CanConnect: true, Lat: 48.85, Lon: 2.35, Country: "FR",
+		LastActiveTime: 2}
+	unlocated := &NodeInfo{Ip: "5.6.7.8", Port: 20338, Lat: DEFAULT_LAT_LON, Lon: DEFAULT_LAT_LON,
+		LastActiveTime: 1}
+	mapped := &NodeInfo{Ip: "::ffff:6.6.6.6", Port: 20338, LastActiveTime: 3}
+	ipv6 := &NodeInfo{Ip: "2001:0db8::1", Port: 20338}
+	records := map[string][]byte{
+		"1.2.3.4:20338": encodeNodeRecord(located, NODE_RECORD_JSON),
+		"5.6.7.8:20338": encodeNodeRecord(unlocated, NODE_RECORD_JSON),
+		"9.9.9.9:20338": {NODE_RECORD_LATEST + 1, 1, 2, 3},
+		// an ipv4-mapped address colliding with an older record of its ipv4 one
+		"::ffff:6.6.6.6:20338": encodeNodeRecord(mapped, NODE_RECORD_JSON),
+		"6.6.6.6:20338":        encodeNodeRecord(&NodeInfo{Ip: "6.6.6.6", Port: 20338, LastActiveTime: 1}, NODE_RECORD_JSON),
+		"2001:0db8::1:20338":   encodeNodeRecord(ipv6, NODE_RECORD_JSON),
+	}
+	dir, remove := tempDir(t)
+	defer remove()
+	path := filepath.Join(dir, NODE_DB_FILE_NAME)
+	writeLegacyDb(t, path, records, []string{"5.6.7.8:20338", "::ffff:6.6.6.6:20338"})
+
+	// the legacy records are not moved to a network assumed by default
+	if db, err := NewBoltNodeDb(path, NETWORK_UNSPECIFIED); err != ErrNetworkRequired {
+		if err == nil {
+			db.Close()
+		}
+		t.Fatalf("migrate without a network: %v, want %v", err, ErrNetworkRequired)
+	}
+	db, err := NewBoltNodeDb(path, TEST_NETWORK)
+	if err != nil {
+		t.Fatalf("migrate: %s", err)
+	}
+	defer func() { db.Close() }()
+	version, err := db.SchemaVersion()
+	if err != nil || version != migrations[len(migrations)-1].version {
+		t.Fatalf("schema version = %d (%v), want %d", version, err, migrations[len(migrations)-1].version)
+	}
+	store := db.Network(TEST_NETWORK)
+
+	mapped.Ip = "6.6.6.6"
+	ipv6.Ip = "2001:db8::1"
+	nodes := []*NodeInfo{located, unlocated, mapped, ipv6}
+	for _, node := range nodes {
+		initReachability(node)
+		initLocationState(node)
+	}
+	for _, want := range nodes {
+		t.Run(want.RemoteListenAddress(), func(t *testing.T) {
+			node, err := store.GetNode(want.RemoteListenAddress())
+			if err != nil {
+				t.Fatalf("get node: %s", err)
+			}
+			if !reflect.DeepEqual(node, want) {
+				t.Errorf("migrated to %+v, want %+v", node, want)
+			}
+		})
+	}
+	queries := []struct {
+		name   string
+		filter *NodeFilter
+		want   []string
+	}{
+		{"country", &NodeFilter{Country: "FR"}, []string{"1.2.3.4:20338"}},
+		// the failed lookups saved as 0, 0 are no longer located
+		{"unlocated", &NodeFilter{IsLocated: boolPtr(false)},
+			[]string{"5.6.7.8:20338", "6.6.6.6:20338", "[2001:db8::1]:20338"}},
+		{"connectable", &NodeFilter{CanConnect: boolPtr(true)}, []string{"1.2.3.4:20338"}},
+		{"reachability", &NodeFilter{Reachability: REACHABILITY_DIALABLE}, []string{"1.2.3.4:20338"}},
+	}
+	for _, query := range queries {
+		t.Run(query.name, func(t *testing.T) {
+			nodes, err := store.QueryNodes(query.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := nodeAddrs(nodes); !reflect.DeepEqual(got, query.want) {
+				t.Errorf("query = %v, want %v", got, query.want)
+			}
+		})
+	}
+	listed, err := store.ListNodes()
+	wantAddrs := []string{"1.2.3.4:20338", "5.6.7.8:20338", "6.6.6.6:20338", "[2001:db8::1]:20338"}
+	if err != nil || !reflect.DeepEqual(nodeAddrs(listed), wantAddrs) {
+		t.Errorf("listed %v (%v), want the decodable records", nodeAddrs(listed), err)
+	}
+
+	report, err := store.CheckNodeRecords(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Total != 5 || len(report.Outdated) != 0 || !reflect.DeepEqual(report.Corrupt, []string{"9.9.9.9:20338"}) {
+		t.Errorf("check report = %+v, want 5 records and the corrupt one", report)
+	}
+
+	for _, addr := range []string{"5.6.7.8:20338", "6.6.6.6:20338"} {
+		if history, err := store.ListObservations(addr, 0, NowInMs()); err != nil || len(history) != 1 {
+			t.Errorf("history of %s = %v (%v), want the legacy observation", addr, history, err)
+		}
+	}
+
+	// the migrations run once, the legacy records going to the network given
+	// at the first opening
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = NewBoltNodeDb(path, TEST_NETWORK+1); err != nil {
+		t.Fatalf("reopen: %s", err)
+	}
+	if networks, err := db.Networks(); err != nil || !reflect.DeepEqual(networks, []uint32{TEST_NETWORK}) {
+		t.Errorf("networks = %v (%v), want the default network only", networks, err)
+	}
+	if report, err := db.Network(TEST_NETWORK).CheckNodeRecords(false); err != nil || report.Total != 5 {
+		t.Errorf("check report after reopening = %+v (%v)", report, err)
+	}
+}
+
+func TestCheckNodeRecordsRepair(t *testing.T) {
+	store, closeStore := newTestBoltStore(t)
+	defer closeStore()
+	if err := store.PutNode(&NodeInfo{Ip: "1.1.1.1", Port: 1}); err != nil {
+		t.Fatal(err)
+	}
+	legacy := &NodeInfo{Ip: "2.2.2.2", Port: 2, Height: 7}
+	err := store.update(func(root *bolt.Bucket) error {
+		b := root.Bucket(bucketName)
+		if err := b.Put([]byte("2.2.2.2:2"), encodeNodeRecord(legacy, NODE_RECORD_JSON)); err != nil {
+			return err
+		}
+		return b.Put([]byte("3.3.3.3:3"), []byte{NODE_RECORD_V1})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := store.CheckNodeRecords(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Total != 3 || !report.Repaired || !reflect.DeepEqual(report.Outdated, []string{"2.2.2.2:2"}) ||
+		!reflect.DeepEqual(report.Corrupt, []string{"3.3.3.3:3"}) {
+		t.Errorf("repair report = %+v", report)
+	}
+	// the outdated record is re-encoded and the corrupt one moved aside
+	report, err = store.CheckNodeRecords(false)
+	if err != nil || report.Total != 2 || len(report.Outdated) != 0 || len(report.Corrupt) != 0 {
+		t.Errorf("report after the repair = %+v (%v)", report, err)
+	}
+	if node, err := store.GetNode("2.2.2.2:2"); err != nil || !reflect.DeepEqual(node, legacy) {
+		t.Errorf("repaired node = %+v (%v), want %+v", node, err, legacy)
+	}
+}
+
+// reopenAtVersion reopens db after writing the records of network and setting
+// its schema version back to version, so that the later migrations run again.
+func reopenAtVersion(t *testing.T, db *BoltNodeDb, path string, version uint64,
+	records map[string][]byte) *BoltNodeDb {
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucketIfNotExists(networkBucketName(TEST_NETWORK))
+		if err != nil {
+			return err
+		}
+		b, err := root.CreateBucketIfNotExists(bucketName)
+		if err != nil {
+			return err
+		}
+		for addr, record := range records {
+			if err := b.Put([]byte(addr), record); err != nil {
+				return err
+			}
+		}
+		val := make([]byte, 8)
+		binary.BigEndian.PutUint64(val, version)
+		return tx.Bucket(metaBucketName).Put(schemaVersionKey, val)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewBoltNodeDb(path, TEST_NETWORK)
+	if err != nil {
+		t.Fatalf("migrate: %s", err)
+	}
+	return db
+}
+
+func TestMigrateToV2(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	path := filepath.Join(dir, NODE_DB_FILE_NAME)
+	db, err := NewBoltNodeDb(path, TEST_NETWORK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := v1Fields(fullNode())
+	db = reopenAtVersion(t, db, path, 4, map[string][]byte{
+		node.RemoteListenAddress(): encodeNodeRecord(node, NODE_RECORD_V1),
+	})
+	defer db.Close()
+
+	report, err := db.Network(TEST_NETWORK).CheckNodeRecords(false)
+	if err != nil || report.Total != 1 || len(report.Outdated) != 0 {
+		t.Errorf("check report = %+v (%v), want the record re-encoded", report, err)
+	}
+	got, err := db.Network(TEST_NETWORK).GetNode(node.RemoteListenAddress())
+	if err != nil || !reflect.DeepEqual(v1Fields(got), node) {
+		t.Errorf("migrated to %+v (%v), want %+v", got, err, node)
+	}
+}
+
+func TestMigrateReachability(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	path := filepath.Join(dir, NODE_DB_FILE_NAME)
+	db, err := NewBoltNodeDb(path, TEST_NETWORK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	classified := &NodeInfo{Ip: "3.3.3.3", Port: 3, Reachability: REACHABILITY_INBOUND, ReachabilityTime: 10}
+	db = reopenAtVersion(t, db, path, 5, map[string][]byte{
+		"1.1.1.1:1": v2NoGroups(&NodeInfo{Ip: "1.1.1.1", Port: 1, CanConnect: true}),
+		"2.2.2.2:2": v2NoGroups(&NodeInfo{Ip: "2.2.2.2", Port: 2}),
+		"3.3.3.3:3": EncodeNodeInfo(classified),
+	})
+	defer db.Close()
+	store := db.Network(TEST_NETWORK)
+
+	for reachability, want := range map[string][]string{
+		REACHABILITY_DIALABLE:   {"1.1.1.1:1"},
+		REACHABILITY_ADVERTISED: {"2.2.2.2:2"},
+		REACHABILITY_INBOUND:    {"3.3.3.3:3"},
+	} {
+		nodes, err := store.QueryNodes(&NodeFilter{Reachability: reachability})
+		if err != nil || !reflect.DeepEqual(nodeAddrs(nodes), want) {
+			t.Errorf("%s nodes = %v (%v), want %v", reachability, nodeAddrs(nodes), err, want)
+		}
+	}
+	got, err := store.GetNode("3.3.3.3:3")
+	if err != nil || got.Reachability != classified.Reachability || got.ReachabilityTime != classified.ReachabilityTime {
+		t.Errorf("classified node migrated to %+v (%v), want its reachability unchanged", got, err)
+	}
+}
+
+func TestMigrateLocationStates(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	path := filepath.Join(dir, NODE_DB_FILE_NAME)
+	db, err := NewBoltNodeDb(path, TEST_NETWORK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := &NodeInfo{Ip: "4.4.4.4", Port: 4, LocationState: LOCATION_FAILED, LocationRetryTime: 10}
+	db = reopenAtVersion(t, db, path, 6, map[string][]byte{
+		"1.1.1.1:1":  v2NoGroups(&NodeInfo{Ip: "1.1.1.1", Port: 1, Lat: 1, Lon: 2, Country: "France"}),
+		"2.2.2.2:2":  v2NoGroups(&NodeInfo{Ip: "2.2.2.2", Port: 2}),
+		"10.0.0.1:3": v2NoGroups(&NodeInfo{Ip: "10.0.0.1", Port: 3, Lat: 1, Lon: 2, Country: "France"}),
+		"4.4.4.4:4":  EncodeNodeInfo(failed),
+	})
+	defer db.Close()
+	store := db.Network(TEST_NETWORK)
+
+	want := map[string]string{
+		"1.1.1.1:1":  LOCATION_RESOLVED,
+		"2.2.2.2:2":  LOCATION_PENDING,
+		"10.0.0.1:3": LOCATION_PRIVATE,
+		"4.4.4.4:4":  LOCATION_FAILED,
+	}
+	for addr, state := range want {
+		if node, err := store.GetNode(addr); err != nil || node.LocationState != state {
+			t.Errorf("%s migrated to %+v (%v), want %s", addr, node, err, state)
+		}
+	}
+	located, err := store.QueryNodes(&NodeFilter{IsLocated: boolPtr(true)})
+	if err != nil || !reflect.DeepEqual(nodeAddrs(located), []string{"1.1.1.1:1"}) {
+		t.Errorf("located nodes = %v (%v), want the resolved one", nodeAddrs(located), err)
+	}
+	if node, _ := store.GetNode("4.4.4.4:4"); node.LocationRetryTime != 10 {
+		t.Errorf("failed node retried at %d, want 10", node.LocationRetryTime)
+	}
+}
@@ -1,319 +1,466 @@
 package storage
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
-	"github.com/ontio/ontology/common/log"
-	"github.com/ontio/ontology/p2pserver/message/types"
-	"github.com/ontio/ontology/p2pserver/peer"
-	bolt "go.etcd.io/bbolt"
-	"map/utils"
-	"sort"
+	"fmt"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/ontio/ontology/common/log"
+	bolt "go.etcd.io/bbolt"
+	"map/metrics"
 )
 
 const (
 	ADDR_BUCKET       = "ADDR_BUCKET"
+	HISTORY_BUCKET    = "HISTORY_BUCKET"
+	CENSUS_BUCKET     = "CENSUS_BUCKET"
+	NETWORK_BUCKET    = "NETWORK_"
 	DEFAULT_LAT_LON   = 1000
 	NODE_DB_FILE_NAME = "addr.db"
 )
 
 var bucketName = []byte(ADDR_BUCKET)
 
-var db *bolt.DB
+// historyBucketName holds one nested bucket per node address, whose keys are
+// the big endian observation times so that cursors iterate in time order.
+var historyBucketName = []byte(HISTORY_BUCKET)
 
-func InitNodeDb() {
-	var err error
-	db, err = bolt.Open(NODE_DB_FILE_NAME, 0600, &bolt.Options{Timeout: 1 * time.Second})
-	if err != nil {
-		log.Fatal("open node db failed")
-		return
-	}
+// censusBucketName is keyed by the big endian census times.
+var censusBucketName = []byte(CENSUS_BUCKET)
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		_, err = tx.CreateBucketIfNotExists(bucketName)
-		return err
-	})
-	if err != nil {
-		log.Error("create address bucket fail")
-	}
+// networkBucketName is the top level bucket holding all the buckets of the
+// network identified by magic.
+func networkBucketName(magic uint32) []byte {
+	return []byte(fmt.Sprintf("%s%08x", NETWORK_BUCKET, magic))
 }
 
-func CloseNodeDb() {
-	err := db.Close()
-	if err != nil {
-		log.Error("Close node db error")
-	}
+// networkBuckets are the buckets created in the bucket of every network.
+var networkBuckets = [][]byte{
+	bucketName,
+	historyBucketName,
+	censusBucketName,
+	indexBucketName,
+	peerBucketName,
+	probeBucketName,
+	attemptBucketName,
 }
 
-func getSyncAddrInfoFromPeer(peer *peer.Peer) (string, int, string, error) {
-	addr := peer.GetAddr()
-	ip, _, err := ParseIpPort(addr)
-	if err != nil {
-		return "", 0, "", err
-	}
-	port := int(peer.GetPort())
-	syncAddr := ip + ":" + strconv.Itoa(port)
-	return ip, port, syncAddr, nil
+// bucketContainer is satisfied by both *bolt.Tx and *bolt.Bucket.
+type bucketContainer interface {
+	Bucket(name []byte) *bolt.Bucket
+	CreateBucket(name []byte) (*bolt.Bucket, error)
+	CreateBucketIfNotExists(name []byte) (*bolt.Bucket, error)
+	DeleteBucket(name []byte) error
+}
+
+// BoltNodeDb is a bolt database file holding the nodes of several networks.
+type BoltNodeDb struct {
+	db *bolt.DB
 }
 
-func TryAddNodeAfterReceiveAddrMessage(addr string, services uint64, activeTime uint64) {
-	ip, port, err := ParseIpPort(addr)
+// NETWORK_UNSPECIFIED opens a BoltNodeDb without assuming the network of the
+// records written before networks were namespaced.
+const NETWORK_UNSPECIFIED uint32 = 0
+
+// NewBoltNodeDb opens the database at path and migrates it, records written
+// before networks were namespaced are assumed to belong to network. It returns
+// ErrNetworkRequired if there are such records and network is
+// NETWORK_UNSPECIFIED.
+func NewBoltNodeDb(path string, network uint32) (*BoltNodeDb, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
 	if err != nil {
-		log.Error(err)
-		return
+		return nil, err
+	}
+	if err := migrate(db, network); err != nil {
+		_ = db.Close()
+		return nil, err
 	}
+	return &BoltNodeDb{db: db}, nil
+}
 
-	key := []byte(addr)
-	val, _ := json.Marshal(NodeInfo{
-		Ip:             ip,
-		Port:           port,
-		Services:       services,
-		CanConnect:     false,
-		LastActiveTime: activeTime,
-		Lat:            DEFAULT_LAT_LON,
-		Lon:            DEFAULT_LAT_LON,
+func (self *BoltNodeDb) Close() error {
+	return self.db.Close()
+}
+
+// Network returns the store of the network identified by magic. Its buckets
+// are created on the first write.
+func (self *BoltNodeDb) Network(magic uint32) *BoltNodeStore {
+	return &BoltNodeStore{db: self.db, network: networkBucketName(magic)}
+}
+
+// Networks returns the magic of every network having a store.
+func (self *BoltNodeDb) Networks() ([]uint32, error) {
+	var res []uint32
+	err := self.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if !strings.HasPrefix(string(name), NETWORK_BUCKET) {
+				return nil
+			}
+			magic, err := strconv.ParseUint(string(name[len(NETWORK_BUCKET):]), 16, 32)
+			if err == nil {
+				res = append(res, uint32(magic))
+			}
+			return nil
+		})
 	})
+	return res, err
+}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketName)
-		if b == nil {
-			return errors.New("bucket not exist")
+// BoltNodeStore is the NodeStore of one network of a BoltNodeDb.
+type BoltNodeStore struct {
+	db      *bolt.DB
+	network []byte
+}
+
+// Close does nothing, the database is closed by its BoltNodeDb.
+func (self *BoltNodeStore) Close() error {
+	return nil
+}
+
+// view runs fn on the network bucket, unless the network has no bucket yet.
+func (self *BoltNodeStore) view(fn func(root *bolt.Bucket) error) error {
+	return self.db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket(self.network)
+		if root == nil {
+			return nil
 		}
-		if b.Get(key) == nil {
-			err := b.Put(key, val)
-			if err != nil {
+		return fn(root)
+	})
+}
+
+// update runs fn on the network bucket, creating the buckets of the network.
+func (self *BoltNodeStore) update(fn func(root *bolt.Bucket) error) error {
+	defer func(start time.Time) {
+		metrics.StoreWriteDuration.Observe(time.Since(start).Seconds())
+	}(time.Now())
+	return self.db.Update(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucketIfNotExists(self.network)
+		if err != nil {
+			return err
+		}
+		for _, name := range networkBuckets {
+			if _, err := root.CreateBucketIfNotExists(name); err != nil {
 				return err
 			}
-			go RefreshNodeLatLon(addr)
 		}
-		return nil
+		return fn(root)
 	})
-	if err != nil {
-		log.Error(err)
-	}
 }
 
-func AddOrUpdateNodeAfterReceiveVersionMsg(peer *peer.Peer, payload types.VersionPayload, isHttp bool) {
-	ip, port, addr, err := getSyncAddrInfoFromPeer(peer)
-	if err != nil {
-		log.Error("get addr info from peer error " + err.Error())
-		return
-	}
-
-	now := NowInMs()
-	key := []byte(addr)
-	val, _ := json.Marshal(NodeInfo{
-		Ip:             ip,
-		Port:           port,
-		Services:       payload.Services,
-		Height:         payload.StartHeight,
-		IsConsensus:    payload.IsConsensus,
-		IsHttp:         isHttp,
-		SoftVersion:    payload.SoftVersion,
-		HttpInfoPort:   payload.HttpInfoPort,
-		ConsensusPort:  payload.ConsPort,
-		LastActiveTime: now,
-		Lat:            DEFAULT_LAT_LON,
-		Lon:            DEFAULT_LAT_LON,
+func (self *BoltNodeStore) PutNode(node *NodeInfo) error {
+	val := EncodeNodeInfo(node)
+	key := []byte(node.RemoteListenAddress())
+	return self.update(func(root *bolt.Bucket) error {
+		b := root.Bucket(bucketName)
+		if b == nil {
+			return errors.New("bucket not exist")
+		}
+		old, err := indexedNode(root, b, string(key))
+		if err != nil {
+			return err
+		}
+		if err := updateIndexes(root, string(key), old, node); err != nil {
+			return err
+		}
+		if err := bumpGeneration(root); err != nil {
+			return err
+		}
+		return b.Put(key, val)
 	})
+}
 
-	_ = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketName)
+func (self *BoltNodeStore) UpdateNode(addr string, update func(old *NodeInfo) (*NodeInfo, error)) error {
+	key := []byte(addr)
+	return self.update(func(root *bolt.Bucket) error {
+		b := root.Bucket(bucketName)
 		if b == nil {
 			return errors.New("bucket not exist")
 		}
-		oldVal := b.Get(key)
-		if oldVal == nil {
-			err := b.Put(key, val)
-			if err != nil {
-				return err
-			}
-			go RefreshNodeLatLon(addr)
-		} else {
-			var oldAddrInfo NodeInfo
-			err := json.Unmarshal(oldVal, &oldAddrInfo)
-			if err != nil {
+		var old *NodeInfo
+		if oldVal := b.Get(key); oldVal != nil {
+			var err error
+			if old, _, err = DecodeNodeInfo(oldVal); err != nil {
 				return err
 			}
-			oldAddrInfo.Services = payload.Services
-			oldAddrInfo.Height = payload.StartHeight
-			oldAddrInfo.IsConsensus = payload.IsConsensus
-			oldAddrInfo.SoftVersion = payload.SoftVersion
-			oldAddrInfo.IsHttp = isHttp
-			oldAddrInfo.HttpInfoPort = payload.HttpInfoPort
-			oldAddrInfo.ConsensusPort = payload.ConsPort
-			oldAddrInfo.LastActiveTime = now
-			oldVal, _ = json.Marshal(oldAddrInfo)
-			err = b.Put(key, oldVal)
-			if err != nil {
-				return err
-			}
-			go RefreshNodeLatLon(addr)
 		}
-		return nil
+		var prev *NodeInfo
+		if old != nil {
+			copied := *old
+			prev = &copied
+		}
+		node, err := update(old)
+		if err != nil || node == nil {
+			return err
+		}
+		if err := updateIndexes(root, addr, prev, node); err != nil {
+			return err
+		}
+		if err := bumpGeneration(root); err != nil {
+			return err
+		}
+		return b.Put(key, EncodeNodeInfo(node))
 	})
 }
 
-func AddOrUpdateNodeAfterReceiveVersionAckMsg(remotePeer *peer.Peer) {
-	ip, port, addr, err := getSyncAddrInfoFromPeer(remotePeer)
+func (self *BoltNodeStore) GetNode(addr string) (*NodeInfo, error) {
+	var node *NodeInfo
+	err := self.view(func(root *bolt.Bucket) error {
+		b := root.Bucket(bucketName)
+		if b == nil {
+			return errors.New("bucket not exist")
+		}
+		val := b.Get([]byte(addr))
+		if val == nil {
+			return ErrNodeNotFound
+		}
+		var err error
+		node, _, err = DecodeNodeInfo(val)
+		return err
+	})
 	if err != nil {
-		log.Error("get addr info from peer error " + err.Error())
-		return
+		return nil, err
+	}
+	if node == nil {
+		return nil, ErrNodeNotFound
 	}
+	return node, nil
+}
 
-	now := NowInMs()
-	key := []byte(addr)
-	val, _ := json.Marshal(NodeInfo{
-		Ip:             ip,
-		Port:           port,
-		Services:       remotePeer.GetServices(),
-		Height:         remotePeer.GetHeight(),
-		LastActiveTime: now,
-		CanConnect:     true,
-		Lat:            DEFAULT_LAT_LON,
-		Lon:            DEFAULT_LAT_LON,
+func (self *BoltNodeStore) ListNodes() ([]*NodeInfo, error) {
+	var res []*NodeInfo
+	err := self.view(func(root *bolt.Bucket) error {
+		b := root.Bucket(bucketName)
+		if b == nil {
+			return errors.New("bucket not exist")
+		}
+		return b.ForEach(func(k, v []byte) error {
+			node, _, err := DecodeNodeInfo(v)
+			if err != nil {
+				log.Warnf("skip undecodable node record %s: %s", k, err)
+				return nil
+			}
+			res = append(res, node)
+			return nil
+		})
 	})
+	return res, err
+}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketName)
+func (self *BoltNodeStore) DeleteNode(addr string) error {
+	return self.update(func(root *bolt.Bucket) error {
+		b := root.Bucket(bucketName)
 		if b == nil {
 			return errors.New("bucket not exist")
 		}
-		oldVal := b.Get(key)
-		if oldVal == nil {
-			err := b.Put(key, val)
-			if err != nil {
+		if b.Get([]byte(addr)) == nil {
+			return nil
+		}
+		old, err := indexedNode(root, b, addr)
+		if err != nil {
+			return err
+		}
+		if err := updateIndexes(root, addr, old, nil); err != nil {
+			return err
+		}
+		if err := bumpGeneration(root); err != nil {
+			return err
+		}
+		return b.Delete([]byte(addr))
+	})
+}
+
+func (self *BoltNodeStore) WriteBatch(batch *NodeBatch) error {
+	return self.update(func(root *bolt.Bucket) error {
+		b := root.Bucket(bucketName)
+		hb := root.Bucket(historyBucketName)
+		ab := root.Bucket(attemptBucketName)
+		pb := root.Bucket(probeBucketName)
+		if b == nil || hb == nil || ab == nil || pb == nil {
+			return errors.New("bucket not exist")
+		}
+		if len(batch.Nodes) != 0 {
+			if err := bumpGeneration(root); err != nil {
 				return err
 			}
-			go RefreshNodeLatLon(addr)
-		} else {
-			var oldAddrInfo NodeInfo
-			err := json.Unmarshal(oldVal, &oldAddrInfo)
+		}
+		for _, node := range batch.Nodes {
+			key := []byte(node.RemoteListenAddress())
+			old, err := indexedNode(root, b, string(key))
 			if err != nil {
 				return err
 			}
-			oldAddrInfo.Services = remotePeer.GetServices()
-			oldAddrInfo.Height = remotePeer.GetHeight()
-			oldAddrInfo.CanConnect = true
-			oldAddrInfo.LastActiveTime = now
-			oldVal, _ = json.Marshal(oldAddrInfo)
-			err = b.Put(key, oldVal)
-			if err != nil {
+			if err := updateIndexes(root, string(key), old, node); err != nil {
 				return err
 			}
-			go RefreshNodeLatLon(addr)
+			if err := b.Put(key, EncodeNodeInfo(node)); err != nil {
+				return err
+			}
+		}
+		for addr, history := range batch.Observations {
+			for _, obs := range history {
+				if err := putObservation(hb, addr, obs); err != nil {
+					return err
+				}
+			}
+		}
+		for addr, attempts := range batch.Attempts {
+			for _, attempt := range attempts {
+				if err := putConnectAttempt(ab, addr, attempt); err != nil {
+					return err
+				}
+			}
+		}
+		for addr, probes := range batch.Probes {
+			if b.Get([]byte(addr)) == nil {
+				continue
+			}
+			for _, probe := range probes {
+				if err := putProbe(pb, addr, probe); err != nil {
+					return err
+				}
+			}
 		}
 		return nil
 	})
-	if err != nil {
-		log.Error(err)
-	}
 }
 
-// Receive pong message
-func UpdateNodeHeight(peer *peer.Peer, height uint64) {
-	_, _, addr, err := getSyncAddrInfoFromPeer(peer)
-	if err != nil {
-		log.Error("get addr info from peer error " + err.Error())
-		return
-	}
-	log.Info("update height ", addr, height)
-
-	key := []byte(addr)
+func timeKey(t uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, t)
+	return key
+}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketName)
-		oldVal := b.Get(key)
-		if oldVal != nil {
-			var oldAddrInfo NodeInfo
-			err := json.Unmarshal(oldVal, &oldAddrInfo)
-			if err != nil {
-				return err
-			}
-			oldAddrInfo.Height = height
-			oldAddrInfo.LastActiveTime = NowInMs()
-			oldAddrInfo.CanConnect = true
-			oldVal, _ = json.Marshal(oldAddrInfo)
-			err = b.Put(key, oldVal)
-			if err != nil {
-				return err
-			}
+func (self *BoltNodeStore) AppendObservation(addr string, obs *Observation) error {
+	return self.update(func(root *bolt.Bucket) error {
+		hb := root.Bucket(historyBucketName)
+		if hb == nil {
+			return errors.New("bucket not exist")
 		}
-		return nil
+		return putObservation(hb, addr, obs)
 	})
+}
+
+// putObservation adds obs to the bucket of addr in the history bucket hb. An
+// observation made in the same ms as another is moved to the next free ms,
+// unless it is the same one, which is kept once.
+func putObservation(hb *bolt.Bucket, addr string, obs *Observation) error {
+	b, err := hb.CreateBucketIfNotExists([]byte(addr))
 	if err != nil {
-		log.Error("Update height error", err)
+		return err
+	}
+	copied := *obs
+	for {
+		val, err := json.Marshal(&copied)
+		if err != nil {
+			return err
+		}
+		old := b.Get(timeKey(copied.Time))
+		if old == nil {
+			return b.Put(timeKey(copied.Time), val)
+		}
+		if bytes.Equal(old, val) {
+			return nil
+		}
+		copied.Time++
 	}
 }
 
-func ListAllNodes() []*NodeInfo {
-	var res []*NodeInfo
-	db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketName)
+func (self *BoltNodeStore) ListObservations(addr string, from, to uint64) ([]*Observation, error) {
+	var res []*Observation
+	err := self.view(func(root *bolt.Bucket) error {
+		hb := root.Bucket(historyBucketName)
+		if hb == nil {
+			return errors.New("bucket not exist")
+		}
+		b := hb.Bucket([]byte(addr))
+		if b == nil {
+			return nil
+		}
 		c := b.Cursor()
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			var value NodeInfo
-			json.Unmarshal(v, &value)
-			if value.Lon > DEFAULT_LAT_LON-1 {
-				go RefreshNodeLatLon(string(k))
+		for k, v := c.Seek(timeKey(from)); k != nil && binary.BigEndian.Uint64(k) <= to; k, v = c.Next() {
+			var obs Observation
+			if err := json.Unmarshal(v, &obs); err != nil {
+				return err
 			}
-			res = append(res, &value)
+			res = append(res, &obs)
 		}
 		return nil
 	})
-	sort.SliceStable(res, func(i, j int) bool {
-		if res[i].CanConnect && !res[j].CanConnect {
-			return true
-		} else if !res[i].CanConnect && res[j].CanConnect {
-			return false
-		}
-		if res[i].LastActiveTime > res[j].LastActiveTime {
-			return true
-		} else if res[i].LastActiveTime < res[j].LastActiveTime {
-			return false
-		} else {
-			return res[i].Height >= res[j].Height
+	return res, err
+}
+
+func (self *BoltNodeStore) ListObservedAddrs() ([]string, error) {
+	var res []string
+	err := self.view(func(root *bolt.Bucket) error {
+		hb := root.Bucket(historyBucketName)
+		if hb == nil {
+			return errors.New("bucket not exist")
 		}
+		return hb.ForEach(func(k, v []byte) error {
+			res = append(res, string(k))
+			return nil
+		})
 	})
-	return res
+	return res, err
 }
 
-func RefreshNodeLatLon(addr string) {
-	ip, _, err := ParseIpPort(addr)
+func (self *BoltNodeStore) DeleteObservations(addr string, times []uint64) error {
+	return self.update(func(root *bolt.Bucket) error {
+		hb := root.Bucket(historyBucketName)
+		if hb == nil {
+			return errors.New("bucket not exist")
+		}
+		b := hb.Bucket([]byte(addr))
+		if b == nil {
+			return nil
+		}
+		for _, t := range times {
+			if err := b.Delete(timeKey(t)); err != nil {
+				return err
+			}
+		}
+		if k, _ := b.Cursor().First(); k == nil {
+			return hb.DeleteBucket([]byte(addr))
+		}
+		return nil
+	})
+}
+
+func (self *BoltNodeStore) PutCensus(census *Census) error {
+	val, err := json.Marshal(census)
 	if err != nil {
-		log.Error(err)
-		return
+		return err
 	}
-	key := []byte(addr)
+	return self.update(func(root *bolt.Bucket) error {
+		b := root.Bucket(censusBucketName)
+		if b == nil {
+			return errors.New("bucket not exist")
+		}
+		return b.Put(timeKey(census.Time), val)
+	})
+}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketName)
-		oldVal := b.Get(key)
-		if oldVal != nil {
-			var oldNodeInfo NodeInfo
-			err := json.Unmarshal(oldVal, &oldNodeInfo)
-			if err != nil {
+func (self *BoltNodeStore) ListCensus(from, to uint64) ([]*Census, error) {
+	var res []*Census
+	err := self.view(func(root *bolt.Bucket) error {
+		b := root.Bucket(censusBucketName)
+		if b == nil {
+			return errors.New("bucket not exist")
+		}
+		c := b.Cursor()
+		for k, v := c.Seek(timeKey(from)); k != nil && binary.BigEndian.Uint64(k) <= to; k, v = c.Next() {
+			var census Census
+			if err := json.Unmarshal(v, &census); err != nil {
 				return err
 			}
-			if oldNodeInfo.Lat > DEFAULT_LAT_LON-1 {
-				latLon := utils.GetIpLocation(ip)
-				if latLon != nil {
-					oldNodeInfo.Lat = latLon.Lat
-					oldNodeInfo.Lon = latLon.Lon
-					oldNodeInfo.Country = latLon.Country
-					oldVal, _ = json.Marshal(oldNodeInfo)
-					err = b.Put(key, oldVal)
-					if err != nil {
-						return err
-					}
-				}
-			}
+			res = append(res, &census)
 		}
 		return nil
 	})
-	if err != nil {
-		log.Error("Refresh node location failed", err)
-	}
+	return res, err
 }
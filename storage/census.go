@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/ontio/ontology/common/log"
+)
+
+const DEFAULT_CENSUS_INTERVAL = 10 * time.Minute
+
+// Census is a snapshot of the whole known network taken at Time (in ms).
+type Census struct {
+	Time      uint64         `json:"time"`
+	Total     int            `json:"total"`
+	Reachable int            `json:"reachable"`
+	Consensus int            `json:"consensus"`
+	MaxHeight uint64         `json:"max_height"`
+	Countries map[string]int `json:"countries"`
+	Versions  map[string]int `json:"versions"`
+}
+
+// TakeCensus counts the nodes of the network, the tombstoned ones excluded.
+func TakeCensus(nodes []*NodeInfo, now uint64) *Census {
+	census := &Census{
+		Time:      now,
+		Countries: make(map[string]int),
+		Versions:  make(map[string]int),
+	}
+	for _, node := range nodes {
+		if node.IsTombstoned() {
+			continue
+		}
+		census.Total++
+		if node.CanConnect {
+			census.Reachable++
+		}
+		if node.IsConsensus {
+			census.Consensus++
+		}
+		if node.Height > census.MaxHeight {
+			census.MaxHeight = node.Height
+		}
+		census.Countries[node.Country]++
+		census.Versions[node.SoftVersion]++
+	}
+	return census
+}
+
+// SampleCensus keeps the first census of every step (in ms), step 0 keeps all.
+func SampleCensus(census []*Census, step uint64) []*Census {
+	if step == 0 {
+		return census
+	}
+	var res []*Census
+	for i, c := range census {
+		if i == 0 || c.Time/step != census[i-1].Time/step {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// CensusRecorder periodically stores a census of the node store.
+type CensusRecorder struct {
+	store    NodeStore
+	interval time.Duration
+	quit     chan bool
+	done     chan bool
+}
+
+func NewCensusRecorder(store NodeStore, interval time.Duration) *CensusRecorder {
+	if interval == 0 {
+		interval = DEFAULT_CENSUS_INTERVAL
+	}
+	return &CensusRecorder{
+		store:    store,
+		interval: interval,
+		quit:     make(chan bool),
+		done:     make(chan bool),
+	}
+}
+
+func (self *CensusRecorder) Start() {
+	go self.censusService()
+}
+
+// Stop returns once the running census is over.
+func (self *CensusRecorder) Stop() {
+	close(self.quit)
+	<-self.done
+}
+
+func (self *CensusRecorder) censusService() {
+	defer close(self.done)
+	t := time.NewTicker(self.interval)
+	for {
+		select {
+		case <-t.C:
+			self.record()
+		case <-self.quit:
+			t.Stop()
+			return
+		}
+	}
+}
+
+func (self *CensusRecorder) record() {
+	nodes, err := self.store.ListNodes()
+	if err != nil {
+		log.Error("list nodes for census error", err)
+		return
+	}
+	if err := self.store.PutCensus(TakeCensus(nodes, NowInMs())); err != nil {
+		log.Error("save census error", err)
+	}
+}
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTakeCensus(t *testing.T) {
+	nodes := []*NodeInfo{
+		{Ip: "1.1.1.1", Port: 1, Height: 10, CanConnect: true, Country: "FR", SoftVersion: "v1"},
+		{Ip: "2.2.2.2", Port: 2, Height: 30, IsConsensus: true, Country: "FR", SoftVersion: "v2"},
+		{Ip: "3.3.3.3", Port: 3, Height: 20, CanConnect: true, IsConsensus: true, Country: "DE", SoftVersion: "v1"},
+		// tombstoned nodes are left out
+		{Ip: "4.4.4.4", Port: 4, Height: 40, Country: "US", SoftVersion: "v0", Status: NODE_STATUS_TOMBSTONE},
+	}
+	want := &Census{
+		Time:      5,
+		Total:     3,
+		Reachable: 2,
+		Consensus: 2,
+		MaxHeight: 30,
+		Countries: map[string]int{"FR": 2, "DE": 1},
+		Versions:  map[string]int{"v1": 2, "v2": 1},
+	}
+	if got := TakeCensus(nodes, 5); !reflect.DeepEqual(got, want) {
+		t.Errorf("census = %+v, want %+v", got, want)
+	}
+}
+
+func TestSampleCensus(t *testing.T) {
+	var census []*Census
+	for _, tm := range []uint64{0, 5, 10, 12, 25} {
+		census = append(census, &Census{Time: tm})
+	}
+	tests := []struct {
+		step uint64
+		want []uint64
+	}{
+		{0, []uint64{0, 5, 10, 12, 25}},
+		{10, []uint64{0, 10, 25}},
+		{100, []uint64{0}},
+	}
+	for _, test := range tests {
+		var got []uint64
+		for _, c := range SampleCensus(census, test.step) {
+			got = append(got, c.Time)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("step %d sampled %v, want %v", test.step, got, test.want)
+		}
+	}
+}
+
+func TestCensusStore(t *testing.T) {
+	for _, impl := range testStores {
+		t.Run(impl.name, func(t *testing.T) {
+			store, closeStore := impl.open(t)
+			defer closeStore()
+			for _, tm := range []uint64{30, 10, 20} {
+				if err := store.PutCensus(&Census{Time: tm, Total: int(tm)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// a census of a same time replaces the former one
+			if err := store.PutCensus(&Census{Time: 20, Total: 21}); err != nil {
+				t.Fatal(err)
+			}
+			census, err := store.ListCensus(15, 30)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []int
+			for _, c := range census {
+				got = append(got, c.Total)
+			}
+			if !reflect.DeepEqual(got, []int{21, 30}) {
+				t.Errorf("census totals = %v, want [21 30]", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,338 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/ontio/ontology/common/log"
+	bolt "go.etcd.io/bbolt"
+	"map/metrics"
+)
+
+const ATTEMPT_BUCKET = "ATTEMPT_BUCKET"
+
+// ATTEMPT_RETENTION is how long the connection attempts are kept
+const ATTEMPT_RETENTION = 7 * 24 * time.Hour
+
+// attemptBucketName holds one nested bucket per node address, whose keys are
+// the big endian attempt times.
+var attemptBucketName = []byte(ATTEMPT_BUCKET)
+
+// The outcomes of a connection attempt.
+const (
+	CONNECT_OK                 = "ok"
+	CONNECT_DIAL_TIMEOUT       = "dial_timeout"
+	CONNECT_REFUSED            = "refused"
+	CONNECT_DIAL_ERROR         = "dial_error"
+	CONNECT_HANDSHAKE_TIMEOUT  = "handshake_timeout"
+	CONNECT_UNEXPECTED_MESSAGE = "unexpected_message"
+	CONNECT_HANDSHAKE_ERROR    = "handshake_error"
+	CONNECT_SELF               = "self_connect"
+	CONNECT_BOUND_FULL         = "bound_full"
+	CONNECT_RESERVED_REJECT    = "reserved_reject"
+	CONNECT_DUPLICATE          = "duplicate"
+)
+
+// ConnectAttempt is an outgoing connection attempt made at Time (in ms). The
+// attempts of an address made in a same ms are recorded a ms apart.
+type ConnectAttempt struct {
+	Time   uint64 `json:"time"`
+	Reason string `json:"reason"`
+	Error  string `json:"error,omitempty"`
+}
+
+// probed reports whether reason tells about the reachability of the node, as
+// opposed to the attempts rejected locally.
+func probed(reason string) (success bool, ok bool) {
+	switch reason {
+	case CONNECT_OK:
+		return true, true
+	case CONNECT_DIAL_TIMEOUT, CONNECT_REFUSED, CONNECT_DIAL_ERROR, CONNECT_HANDSHAKE_TIMEOUT,
+		CONNECT_UNEXPECTED_MESSAGE, CONNECT_HANDSHAKE_ERROR:
+		return false, true
+	}
+	return false, false
+}
+
+// RecordConnectAttempt logs an attempt to connect to addr ending with reason
+// and err, which is nil on success, and counts it as a probe if relevant.
+func RecordConnectAttempt(store NodeStore, addr string, reason string, err error) {
+	addr, perr := NormalizeAddr(addr)
+	if perr != nil {
+		log.Error(perr)
+		return
+	}
+	metrics.DialAttempts.WithLabelValues(reason).Inc()
+	now := NowInMs()
+	attempt := &ConnectAttempt{Time: now, Reason: reason}
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	if err := store.AppendConnectAttempt(addr, attempt); err != nil {
+		log.Error("append connect attempt error", addr, err)
+	}
+	if success, ok := probed(reason); ok {
+		RecordProbe(store, addr, success)
+	}
+}
+
+// expireConnectAttempts deletes the attempts past ATTEMPT_RETENTION at now (in ms).
+func expireConnectAttempts(store NodeStore, now uint64) error {
+	addrs, err := store.ListAttemptedAddrs()
+	if err != nil {
+		return err
+	}
+	before := msBefore(now, ATTEMPT_RETENTION)
+	if before == 0 {
+		return nil
+	}
+	for _, addr := range addrs {
+		// most addresses have no expired attempt, spare them a write
+		expired, err := store.ListConnectAttempts(addr, 0, before-1)
+		if err != nil {
+			return err
+		}
+		if len(expired) == 0 {
+			continue
+		}
+		if err := store.DeleteConnectAttempts(addr, before); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CountConnectAttempts returns the number of attempts per reason with from <= Time <= to.
+func CountConnectAttempts(store NodeStore, from, to uint64) (map[string]uint64, error) {
+	addrs, err := store.ListAttemptedAddrs()
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]uint64)
+	for _, addr := range addrs {
+		attempts, err := store.ListConnectAttempts(addr, from, to)
+		if err != nil {
+			return nil, err
+		}
+		for _, attempt := range attempts {
+			res[attempt.Reason]++
+		}
+	}
+	return res, nil
+}
+
+func (self *BoltNodeStore) AppendConnectAttempt(addr string, attempt *ConnectAttempt) error {
+	return self.update(func(root *bolt.Bucket) error {
+		ab := root.Bucket(attemptBucketName)
+		if ab == nil {
+			return errors.New("bucket not exist")
+		}
+		return putConnectAttempt(ab, addr, attempt)
+	})
+}
+
+// putConnectAttempt adds attempt to the bucket of addr in the attempt bucket ab.
+func putConnectAttempt(ab *bolt.Bucket, addr string, attempt *ConnectAttempt) error {
+	b, err := ab.CreateBucketIfNotExists([]byte(addr))
+	if err != nil {
+		return err
+	}
+	copied := *attempt
+	for b.Get(timeKey(copied.Time)) != nil {
+		copied.Time++
+	}
+	val, err := json.Marshal(&copied)
+	if err != nil {
+		return err
+	}
+	return b.Put(timeKey(copied.Time), val)
+}
+
+func (self *BoltNodeStore) ListConnectAttempts(addr string, from, to uint64) ([]*ConnectAttempt, error) {
+	var res []*ConnectAttempt
+	err := self.view(func(root *bolt.Bucket) error {
+		ab := root.Bucket(attemptBucketName)
+		if ab == nil {
+			return nil
+		}
+		b := ab.Bucket([]byte(addr))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Seek(timeKey(from)); k != nil && binary.BigEndian.Uint64(k) <= to; k, v = c.Next() {
+			var attempt ConnectAttempt
+			if err := json.Unmarshal(v, &attempt); err != nil {
+				return err
+			}
+			res = append(res, &attempt)
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (self *BoltNodeStore) ListAttemptedAddrs() ([]string, error) {
+	var res []string
+	err := self.view(func(root *bolt.Bucket) error {
+		ab := root.Bucket(attemptBucketName)
+		if ab == nil {
+			return nil
+		}
+		return ab.ForEach(func(k, v []byte) error {
+			res = append(res, string(k))
+			return nil
+		})
+	})
+	return res, err
+}
+
+func (self *BoltNodeStore) DeleteConnectAttempts(addr string, before uint64) error {
+	return self.update(func(root *bolt.Bucket) error {
+		ab := root.Bucket(attemptBucketName)
+		if ab == nil {
+			return errors.New("bucket not exist")
+		}
+		b := ab.Bucket([]byte(addr))
+		if b == nil {
+			return nil
+		}
+		var expired [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) < before; k, _ = c.Next() {
+			expired = append(expired, append([]byte(nil), k...))
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		if k, _ := b.Cursor().First(); k == nil {
+			return ab.DeleteBucket([]byte(addr))
+		}
+		return nil
+	})
+}
+
+func (self *MemNodeStore) AppendConnectAttempt(addr string, attempt *ConnectAttempt) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	attempts := self.attempts[addr]
+	copied := *attempt
+	i := sort.Search(len(attempts), func(i int) bool { return attempts[i].Time >= copied.Time })
+	for ; i < len(attempts) && attempts[i].Time == copied.Time; i++ {
+		copied.Time++
+	}
+	attempts = append(attempts, ConnectAttempt{})
+	copy(attempts[i+1:], attempts[i:])
+	attempts[i] = copied
+	self.attempts[addr] = attempts
+	return nil
+}
+
+func (self *MemNodeStore) ListConnectAttempts(addr string, from, to uint64) ([]*ConnectAttempt, error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	var res []*ConnectAttempt
+	for _, attempt := range self.attempts[addr] {
+		if attempt.Time >= from && attempt.Time <= to {
+			copied := attempt
+			res = append(res, &copied)
+		}
+	}
+	return res, nil
+}
+
+func (self *MemNodeStore) ListAttemptedAddrs() ([]string, error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	res := make([]string, 0, len(self.attempts))
+	for addr := range self.attempts {
+		res = append(res, addr)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+func (self *MemNodeStore) DeleteConnectAttempts(addr string, before uint64) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	attempts := self.attempts[addr]
+	i := sort.Search(len(attempts), func(i int) bool { return attempts[i].Time >= before })
+	if i == len(attempts) {
+		delete(self.attempts, addr)
+	} else {
+		self.attempts[addr] = append([]ConnectAttempt(nil), attempts[i:]...)
+	}
+	return nil
+}
+
+func (self *WriteBehindStore) AppendConnectAttempt(addr string, attempt *ConnectAttempt) error {
+	copied := *attempt
+	self.lock.Lock()
+	self.pendingAttempts[addr] = append(self.pendingAttempts[addr], &copied)
+	self.pendingCount++
+	self.lock.Unlock()
+	self.throttle()
+	return nil
+}
+
+// ListConnectAttempts adds the buffered attempts to those of the underlying
+// store.
+func (self *WriteBehindStore) ListConnectAttempts(addr string, from, to uint64) ([]*ConnectAttempt, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	var pending, attempts []*ConnectAttempt
+	err := self.readStore(func() {
+		pending = append([]*ConnectAttempt(nil), self.pendingAttempts[addr]...)
+	}, func() error {
+		var err error
+		attempts, err = self.store.ListConnectAttempts(addr, from, to)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, attempt := range pending {
+		if attempt.Time >= from && attempt.Time <= to {
+			copied := *attempt
+			attempts = append(attempts, &copied)
+		}
+	}
+	sort.SliceStable(attempts, func(i, j int) bool { return attempts[i].Time < attempts[j].Time })
+	return attempts, nil
+}
+
+func (self *WriteBehindStore) ListAttemptedAddrs() ([]string, error) {
+	if err := self.Flush(); err != nil {
+		return nil, err
+	}
+	return self.store.ListAttemptedAddrs()
+}
+
+// DeleteConnectAttempts also drops the buffered attempts of addr made before before.
+func (self *WriteBehindStore) DeleteConnectAttempts(addr string, before uint64) error {
+	self.flushLock.Lock()
+	defer self.flushLock.Unlock()
+	self.lock.Lock()
+	var kept []*ConnectAttempt
+	for _, attempt := range self.pendingAttempts[addr] {
+		if attempt.Time >= before {
+			kept = append(kept, attempt)
+		}
+	}
+	self.pendingCount -= len(self.pendingAttempts[addr]) - len(kept)
+	if len(kept) == 0 {
+		delete(self.pendingAttempts, addr)
+	} else {
+		self.pendingAttempts[addr] = kept
+	}
+	self.beginWrite()
+	self.lock.Unlock()
+	err := self.store.DeleteConnectAttempts(addr, before)
+	self.endWrite()
+	return err
+}
@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func attemptTimes(attempts []*ConnectAttempt) []uint64 {
+	times := make([]uint64, len(attempts))
+	for i, attempt := range attempts {
+		times[i] = attempt.Time
+	}
+	return times
+}
+
+func TestConnectAttempts(t *testing.T) {
+	day := uint64(24 * time.Hour / time.Millisecond)
+	now := 100 * day
+	for _, impl := range testStores {
+		t.Run(impl.name, func(t *testing.T) {
+			store, closeStore := impl.open(t)
+			defer closeStore()
+
+			attempts := []struct {
+				addr    string
+				attempt *ConnectAttempt
+			}{
+				{"1.1.1.1:1", &ConnectAttempt{Time: now - 8*day, Reason: CONNECT_REFUSED}},
+				{"1.1.1.1:1", &ConnectAttempt{Time: now, Reason: CONNECT_OK}},
+				// recorded a ms after the previous one
+				{"1.1.1.1:1", &ConnectAttempt{Time: now, Reason: CONNECT_DIAL_TIMEOUT, Error: "i/o timeout"}},
+				{"2.2.2.2:2", &ConnectAttempt{Time: now, Reason: CONNECT_DIAL_TIMEOUT}},
+			}
+			for _, a := range attempts {
+				if err := store.AppendConnectAttempt(a.addr, a.attempt); err != nil {
+					t.Fatal(err)
+				}
+			}
+			listed, err := store.ListConnectAttempts("1.1.1.1:1", now-day, now+1)
+			if err != nil || !reflect.DeepEqual(attemptTimes(listed), []uint64{now, now + 1}) {
+				t.Errorf("attempts = %v (%v), want the recent ones a ms apart", attemptTimes(listed), err)
+			}
+			counts, err := CountConnectAttempts(store, 0, now+1)
+			want := map[string]uint64{CONNECT_REFUSED: 1, CONNECT_OK: 1, CONNECT_DIAL_TIMEOUT: 2}
+			if err != nil || !reflect.DeepEqual(counts, want) {
+				t.Errorf("counts = %v (%v), want %v", counts, err, want)
+			}
+
+			if err := expireConnectAttempts(store, now); err != nil {
+				t.Fatal(err)
+			}
+			listed, err = store.ListConnectAttempts("1.1.1.1:1", 0, now+1)
+			if err != nil || !reflect.DeepEqual(attemptTimes(listed), []uint64{now, now + 1}) {
+				t.Errorf("attempts after the expiry = %v (%v)", attemptTimes(listed), err)
+			}
+		})
+	}
+}
+
+func TestRecordConnectAttempt(t *testing.T) {
+	tests := []struct {
+		reason     string
+		err        error
+		wantProbed bool
+	}{
+		{CONNECT_OK, nil, true},
+		{CONNECT_REFUSED, errors.New("connection refused"), true},
+		{CONNECT_HANDSHAKE_TIMEOUT, errors.New("timeout"), true},
+		{CONNECT_BOUND_FULL, errors.New("full"), false},
+		{CONNECT_DUPLICATE, errors.New("duplicate"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.reason, func(t *testing.T) {
+			store := NewMemNodeStore()
+			if err := store.PutNode(&NodeInfo{Ip: "1.1.1.1", Port: 1}); err != nil {
+				t.Fatal(err)
+			}
+			RecordConnectAttempt(store, "1.1.1.1:1", test.reason, test.err)
+
+			attempts, err := store.ListConnectAttempts("1.1.1.1:1", 0, NowInMs())
+			if err != nil || len(attempts) != 1 || attempts[0].Reason != test.reason {
+				t.Fatalf("attempts = %v (%v)", attempts, err)
+			}
+			if test.err != nil && attempts[0].Error != test.err.Error() {
+				t.Errorf("attempt error = %q, want %q", attempts[0].Error, test.err)
+			}
+			slots, err := store.ListProbes("1.1.1.1:1", 0, NowInMs())
+			if err != nil || (len(slots) != 0) != test.wantProbed {
+				t.Errorf("probe slots = %v (%v), want probed %v", slots, err, test.wantProbed)
+			}
+		})
+	}
+}
+
+func TestExpireProbes(t *testing.T) {
+	day := uint64(24 * time.Hour / time.Millisecond)
+	now := 100 * day
+	store := NewMemNodeStore()
+	if err := store.PutNode(&NodeInfo{Ip: "1.1.1.1", Port: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tm := range []uint64{now - 31*day, now - day} {
+		if err := store.RecordProbe("1.1.1.1:1", tm, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the probes of an address purged since
+	if err := store.PutNode(&NodeInfo{Ip: "2.2.2.2", Port: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RecordProbe("2.2.2.2:2", now, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteNode("2.2.2.2:2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := expireProbes(store, now); err != nil {
+		t.Fatal(err)
+	}
+	if addrs, err := store.ListProbedAddrs(); err != nil || !reflect.DeepEqual(addrs, []string{"1.1.1.1:1"}) {
+		t.Errorf("probed addrs = %v (%v), want the known address only", addrs, err)
+	}
+	slots, err := store.ListProbes("1.1.1.1:1", 0, now)
+	if err != nil || len(slots) != 1 || slots[0].Time != probeSlotTime(now-day) {
+		t.Errorf("probe slots = %v (%v), want the retained one", slots, err)
+	}
+}
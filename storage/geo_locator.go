@@ -0,0 +1,443 @@
+package storage
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru"
+	"github.com/ontio/ontology/common/log"
+	"map/utils"
+)
+
+// The states of the geo lookup of a node, "" for the records saved before
+// they were recorded.
+const (
+	LOCATION_PENDING  = "pending"
+	LOCATION_RESOLVED = "resolved"
+	// LOCATION_PRIVATE nodes have a private or reserved ip, without location
+	LOCATION_PRIVATE = "private"
+	// LOCATION_FAILED nodes are retried from their LocationRetryTime
+	LOCATION_FAILED = "failed"
+)
+
+// initLocationState derives the location state of a node saved before the
+// states were recorded, and reports whether it changed. Its failed lookups
+// were saved as 0, 0 without country.
+func initLocationState(node *NodeInfo) bool {
+	if node.LocationState != "" {
+		return false
+	}
+	resolved := node.Lat <= DEFAULT_LAT_LON-1 && !(node.Lat == 0 && node.Lon == 0 && node.Country == "")
+	switch {
+	case utils.IsReservedIp(node.Ip):
+		setLocation(node, nil, LOCATION_PRIVATE)
+	case resolved:
+		node.LocationState = LOCATION_RESOLVED
+	default:
+		setLocation(node, nil, LOCATION_PENDING)
+	}
+	return true
+}
+
+// setLocation sets the location state of node, and its location if any.
+func setLocation(node *NodeInfo, location *utils.GeoLocation, state string) {
+	if location != nil {
+		node.Lat = location.Lat
+		node.Lon = location.Lon
+		node.Country = location.Country
+	} else {
+		node.Lat = DEFAULT_LAT_LON
+		node.Lon = DEFAULT_LAT_LON
+		node.Country = ""
+	}
+	node.LocationState = state
+	node.LocationRetryTime = 0
+}
+
+// setAsn sets the autonomous system of node, none if asn is nil.
+func setAsn(node *NodeInfo, asn *utils.AsnInfo) {
+	if asn == nil {
+		asn = &utils.AsnInfo{}
+	}
+	node.Asn = asn.Number
+	node.AsOrg = asn.Org
+	node.IsHosting = asn.Hosting
+}
+
+// BackfillAsns records the autonomous system of the nodes stored without one,
+// from db, and returns how many were found in it.
+func BackfillAsns(store NodeStore, db *utils.AsnDb) (int, error) {
+	nodes, err := store.ListNodes()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, node := range nodes {
+		if node.Asn != 0 || utils.IsReservedIp(node.Ip) {
+			continue
+		}
+		asn, err := db.Lookup(node.Ip)
+		if err != nil {
+			continue
+		}
+		err = store.UpdateNode(node.RemoteListenAddress(), func(old *NodeInfo) (*NodeInfo, error) {
+			if old == nil || old.Asn != 0 {
+				return nil, nil
+			}
+			setAsn(old, asn)
+			return old, nil
+		})
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// ResetLocations marks the location of every node pending, for the
+// LocationRefresher to look them up again. The nodes keep their current
+// location until then.
+func ResetLocations(store NodeStore) (int, error) {
+	nodes, err := store.ListNodes()
+	if err != nil {
+		return 0, err
+	}
+	for _, node := range nodes {
+		err := store.UpdateNode(node.RemoteListenAddress(), func(old *NodeInfo) (*NodeInfo, error) {
+			if old == nil {
+				return nil, nil
+			}
+			old.LocationState = LOCATION_PENDING
+			old.LocationRetryTime = 0
+			return old, nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(nodes), nil
+}
+
+// GeoLocatorConfig tunes a GeoLocator, the rate of the remote lookups is
+// limited by their GeoProvider.
+type GeoLocatorConfig struct {
+	Workers int
+	// QueueSize bounds the queued nodes, the nodes beyond it are left to the
+	// LocationRefresher
+	QueueSize int
+	CacheSize int
+	CacheTTL  time.Duration
+	// a failed lookup is retried after MinBackoff, doubled on each failure up
+	// to MaxBackoff, at most MaxRetries times
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	MaxRetries int
+}
+
+func DefaultGeoLocatorConfig() GeoLocatorConfig {
+	return GeoLocatorConfig{
+		Workers:    2,
+		QueueSize:  10000,
+		CacheSize:  10000,
+		CacheTTL:   24 * time.Hour,
+		MinBackoff: time.Minute,
+		MaxBackoff: time.Hour,
+		MaxRetries: 5,
+	}
+}
+
+type GeoLocatorStats struct {
+	Queued    int    `json:"queued"`
+	Lookups   uint64 `json:"lookups"`
+	CacheHits uint64 `json:"cache_hits"`
+	// Private counts the nodes found with a private or reserved ip
+	Private  uint64 `json:"private"`
+	Failures uint64 `json:"failures"`
+	Retries  uint64 `json:"retries"`
+	// Deduplicated counts the nodes already queued or backing off
+	Deduplicated uint64 `json:"deduplicated"`
+	// Dropped counts the nodes not queued because the queue was full
+	Dropped uint64 `json:"dropped"`
+}
+
+type nodeRequest struct {
+	store NodeStore
+	addr  string
+}
+
+type cachedLocation struct {
+	location *utils.GeoLocation
+	expire   time.Time
+}
+
+type geoBackoff struct {
+	failures int
+	retryAt  time.Time
+}
+
+// GeoLocator resolves the location of the queued nodes with a few workers,
+// caching the locations by ip. Each address is queued at most once at a time
+// and the failed ips are retried with an exponential backoff.
+type GeoLocator struct {
+	config   GeoLocatorConfig
+	provider utils.GeoProvider
+	asnDb    *utils.AsnDb
+	queue    chan nodeRequest
+	cache    *lru.Cache
+
+	lock    sync.Mutex
+	queued  map[string]bool
+	backoff map[string]*geoBackoff
+	stats   GeoLocatorStats
+
+	quit chan bool
+	done sync.WaitGroup
+}
+
+// NewGeoLocator looks the nodes up with provider, and their autonomous system
+// in asnDb unless it is nil.
+func NewGeoLocator(config GeoLocatorConfig, provider utils.GeoProvider, asnDb *utils.AsnDb) *GeoLocator {
+	cache, err := lru.New(config.CacheSize)
+	if err != nil {
+		panic(err)
+	}
+	self := &GeoLocator{
+		config:   config,
+		provider: provider,
+		asnDb:    asnDb,
+		queue:    make(chan nodeRequest, config.QueueSize),
+		cache:    cache,
+		queued:   make(map[string]bool),
+		backoff:  make(map[string]*geoBackoff),
+		quit:     make(chan bool),
+	}
+	for i := 0; i < config.Workers; i++ {
+		self.done.Add(1)
+		go self.worker()
+	}
+	return self
+}
+
+// Locate queues the lookup of the node of addr, unless it is already queued,
+// backing off or the queue is full.
+func (self *GeoLocator) Locate(store NodeStore, addr string) {
+	ip, _, err := ParseIpPort(addr)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.queued[addr] {
+		self.stats.Deduplicated++
+		return
+	}
+	if b := self.backoff[ip]; b != nil && time.Now().Before(b.retryAt) {
+		self.stats.Deduplicated++
+		return
+	}
+	select {
+	case self.queue <- nodeRequest{store: store, addr: addr}:
+		self.queued[addr] = true
+	default:
+		self.stats.Dropped++
+	}
+}
+
+func (self *GeoLocator) Stats() GeoLocatorStats {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	stats := self.stats
+	stats.Queued = len(self.queue)
+	return stats
+}
+
+// Stop waits for the lookups in progress, the queued nodes are dropped.
+func (self *GeoLocator) Stop() {
+	close(self.quit)
+	self.done.Wait()
+}
+
+func (self *GeoLocator) worker() {
+	defer self.done.Done()
+	for {
+		select {
+		case req := <-self.queue:
+			self.locate(req)
+			self.lock.Lock()
+			delete(self.queued, req.addr)
+			self.lock.Unlock()
+		case <-self.quit:
+			return
+		}
+	}
+}
+
+// locate looks up the location of the node of req, unless it has a current
+// one, and its autonomous system, unless it has one, out of any store
+// transaction and saves them.
+func (self *GeoLocator) locate(req nodeRequest) {
+	node, err := req.store.GetNode(req.addr)
+	if err == ErrNodeNotFound {
+		if ip, _, err := ParseIpPort(req.addr); err == nil {
+			self.forget(ip)
+		}
+		return
+	}
+	if err != nil {
+		return
+	}
+	relocate := node.NeedsLocation(NowInMs())
+	state := LOCATION_RESOLVED
+	var location *utils.GeoLocation
+	var retryAt time.Time
+	if utils.IsReservedIp(node.Ip) {
+		state = LOCATION_PRIVATE
+	} else if relocate {
+		location, err = self.lookup(node.Ip)
+		switch err {
+		case nil:
+		case utils.ErrRateLimitStopped:
+			return
+		case utils.ErrReservedIp:
+			state = LOCATION_PRIVATE
+		default:
+			state = LOCATION_FAILED
+			var retry bool
+			retryAt, retry = self.backoffOf(node.Ip)
+			if retry {
+				self.retry(req, time.Until(retryAt))
+			}
+		}
+	}
+	if state == LOCATION_PRIVATE && relocate {
+		self.lock.Lock()
+		self.stats.Private++
+		self.lock.Unlock()
+	}
+
+	// the asn database is local, a node out of it keeps its former asn
+	var asn *utils.AsnInfo
+	if self.asnDb != nil && state != LOCATION_PRIVATE && (relocate || node.Asn == 0) {
+		if asn, err = self.asnDb.Lookup(node.Ip); err != nil {
+			log.Debugf("lookup asn of %s error: %s", node.Ip, err)
+		}
+	}
+	if !relocate && asn == nil {
+		return
+	}
+
+	err = req.store.UpdateNode(req.addr, func(old *NodeInfo) (*NodeInfo, error) {
+		if old == nil {
+			return nil, nil
+		}
+		if asn != nil || state == LOCATION_PRIVATE {
+			setAsn(old, asn)
+		}
+		if !relocate {
+			return old, nil
+		}
+		if state == LOCATION_FAILED {
+			// a node looked up again keeps its location
+			old.LocationState = LOCATION_FAILED
+			old.LocationRetryTime = TimeInMs(retryAt)
+		} else {
+			setLocation(old, location, state)
+		}
+		return old, nil
+	})
+	if err != nil {
+		log.Error("Refresh node location failed", err)
+	}
+}
+
+// retry queues req again after delay.
+func (self *GeoLocator) retry(req nodeRequest, delay time.Duration) {
+	time.AfterFunc(delay, func() {
+		select {
+		case <-self.quit:
+		default:
+			self.lock.Lock()
+			self.stats.Retries++
+			self.lock.Unlock()
+			self.Locate(req.store, req.addr)
+		}
+	})
+}
+
+// lookup returns the location of ip, from the cache if possible. The failed
+// ips are backed off.
+func (self *GeoLocator) lookup(ip string) (*utils.GeoLocation, error) {
+	if val, ok := self.cache.Get(ip); ok {
+		cached := val.(*cachedLocation)
+		if time.Now().Before(cached.expire) {
+			self.lock.Lock()
+			self.stats.CacheHits++
+			self.lock.Unlock()
+			return cached.location, nil
+		}
+		self.cache.Remove(ip)
+	}
+
+	location, err := self.provider.Lookup(ip)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.stats.Lookups++
+	if err == utils.ErrReservedIp || err == utils.ErrRateLimitStopped {
+		return nil, err
+	}
+	if err != nil {
+		self.stats.Failures++
+		self.failed(ip, err)
+		return nil, err
+	}
+	delete(self.backoff, ip)
+	self.cache.Add(ip, &cachedLocation{location: location, expire: time.Now().Add(self.config.CacheTTL)})
+	return location, nil
+}
+
+// failed backs ip off, doubling its delay. The caller holds the lock.
+func (self *GeoLocator) failed(ip string, err error) {
+	b := self.backoff[ip]
+	if b == nil {
+		b = &geoBackoff{}
+		self.backoff[ip] = b
+	}
+	b.failures++
+	delay := self.config.MinBackoff << uint(b.failures-1)
+	if delay > self.config.MaxBackoff || delay <= 0 {
+		delay = self.config.MaxBackoff
+	}
+	b.retryAt = time.Now().Add(delay)
+	if b.failures > self.config.MaxRetries {
+		log.Errorf("lookup location of %s failed %d times: %s", ip, b.failures, err)
+		return
+	}
+	log.Debugf("lookup location of %s failed, retry in %s: %s", ip, delay, err)
+}
+
+// backoffOf returns when ip can be looked up again, and whether the locator
+// retries it by itself. Past MaxRetries, ip is forgotten and left to the
+// LocationRefresher, which waits for the LocationRetryTime of its nodes.
+func (self *GeoLocator) backoffOf(ip string) (time.Time, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	b := self.backoff[ip]
+	if b == nil {
+		return time.Now(), false
+	}
+	if b.failures > self.config.MaxRetries {
+		delete(self.backoff, ip)
+		return b.retryAt, false
+	}
+	return b.retryAt, true
+}
+
+// forget drops the backoff of ip, whose node is gone.
+func (self *GeoLocator) forget(ip string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.backoff, ip)
+}
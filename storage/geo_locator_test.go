@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"map/utils"
+)
+
+type fakeGeoProvider struct {
+	lock      sync.Mutex
+	locations map[string]*utils.GeoLocation
+	lookups   []string
+}
+
+func (self *fakeGeoProvider) Lookup(ip string) (*utils.GeoLocation, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.lookups = append(self.lookups, ip)
+	if location, ok := self.locations[ip]; ok {
+		return location, nil
+	}
+	return nil, errors.New("not found")
+}
+
+func (self *fakeGeoProvider) Close() error {
+	return nil
+}
+
+func (self *fakeGeoProvider) lookedUp() []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return append([]string(nil), self.lookups...)
+}
+
+// waitFor polls cond until it holds or a second elapsed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func testGeoLocatorConfig() GeoLocatorConfig {
+	config := DefaultGeoLocatorConfig()
+	config.Workers = 1
+	config.MinBackoff = 10 * time.Millisecond
+	config.MaxBackoff = 10 * time.Millisecond
+	config.MaxRetries = 1
+	return config
+}
+
+func TestGeoLocator(t *testing.T) {
+	store := NewMemNodeStore()
+	located := &NodeInfo{Ip: "1.1.1.1", Port: 1, Lat: 1, Lon: 1, Country: "France", LocationState: LOCATION_RESOLVED}
+	unlocated := &NodeInfo{Ip: "2.2.2.2", Port: 2, Lat: DEFAULT_LAT_LON, Lon: DEFAULT_LAT_LON, LocationState: LOCATION_PENDING}
+	sameIp := &NodeInfo{Ip: "2.2.2.2", Port: 3, Lat: DEFAULT_LAT_LON, Lon: DEFAULT_LAT_LON, LocationState: LOCATION_PENDING}
+	private := &NodeInfo{Ip: "192.168.1.1", Port: 4, Lat: DEFAULT_LAT_LON, Lon: DEFAULT_LAT_LON, LocationState: LOCATION_PENDING}
+	for _, node := range []*NodeInfo{located, unlocated, sameIp, private} {
+		if err := store.PutNode(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	provider := &fakeGeoProvider{locations: map[string]*utils.GeoLocation{
+		"1.1.1.1": {Lat: 5, Lon: 5, Country: "Spain"},
+		"2.2.2.2": {Lat: 2, Lon: 3, Country: "Germany"},
+	}}
+	locator := NewGeoLocator(testGeoLocatorConfig(), provider, nil)
+	defer locator.Stop()
+
+	for _, node := range []*NodeInfo{located, unlocated, sameIp, private} {
+		locator.Locate(store, node.RemoteListenAddress())
+	}
+	waitFor(t, "the lookups", func() bool {
+		node, _ := store.GetNode("192.168.1.1:4")
+		return node.LocationState == LOCATION_PRIVATE
+	})
+	if got := provider.lookedUp(); !reflect.DeepEqual(got, []string{"2.2.2.2"}) {
+		t.Errorf("looked up %v, want the unlocated ip once", got)
+	}
+	for _, addr := range []string{"2.2.2.2:2", "2.2.2.2:3"} {
+		node, err := store.GetNode(addr)
+		if err != nil || node.Lat != 2 || node.Lon != 3 || node.Country != "Germany" || node.LocationState != LOCATION_RESOLVED {
+			t.Errorf("%s located as %+v (%v)", addr, node, err)
+		}
+	}
+	if node, _ := store.GetNode("1.1.1.1:1"); !reflect.DeepEqual(node, located) {
+		t.Errorf("located node changed to %+v", node)
+	}
+	if stats := locator.Stats(); stats.Lookups != 1 || stats.CacheHits != 1 || stats.Private != 1 {
+		t.Errorf("stats = %+v, want 1 lookup, 1 cache hit and 1 private node", stats)
+	}
+}
+
+func TestGeoLocatorBackoff(t *testing.T) {
+	store := NewMemNodeStore()
+	node := &NodeInfo{Ip: "3.3.3.3", Port: 3, Lat: DEFAULT_LAT_LON, Lon: DEFAULT_LAT_LON, LocationState: LOCATION_PENDING}
+	if err := store.PutNode(node); err != nil {
+		t.Fatal(err)
+	}
+	provider := &fakeGeoProvider{}
+	locator := NewGeoLocator(testGeoLocatorConfig(), provider, nil)
+	defer locator.Stop()
+
+	// retried once, then left to the LocationRefresher
+	locator.Locate(store, "3.3.3.3:3")
+	waitFor(t, "the retry", func() bool { return locator.Stats().Failures == 2 })
+	time.Sleep(30 * time.Millisecond)
+	if stats := locator.Stats(); stats.Failures != 2 || stats.Retries != 1 {
+		t.Errorf("stats = %+v, want 2 failures and 1 retry", stats)
+	}
+	failed, err := store.GetNode("3.3.3.3:3")
+	if err != nil || failed.LocationState != LOCATION_FAILED || failed.NeedsLocation(failed.LocationRetryTime-1) ||
+		!failed.NeedsLocation(failed.LocationRetryTime) {
+		t.Errorf("failed node = %+v (%v)", failed, err)
+	}
+
+	// the backoff of a node deleted before its retry is forgotten
+	if err := store.PutNode(node); err != nil {
+		t.Fatal(err)
+	}
+	config := testGeoLocatorConfig()
+	config.MaxRetries = 5
+	locator = NewGeoLocator(config, provider, nil)
+	defer locator.Stop()
+	locator.Locate(store, "3.3.3.3:3")
+	waitFor(t, "the lookup", func() bool { return locator.Stats().Failures == 1 })
+	if err := store.DeleteNode("3.3.3.3:3"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the backoff to be forgotten", func() bool {
+		locator.lock.Lock()
+		defer locator.lock.Unlock()
+		return len(locator.backoff) == 0
+	})
+	if stats := locator.Stats(); stats.Failures != 1 || stats.Retries != 1 {
+		t.Errorf("stats = %+v, want 1 failure and 1 retry", stats)
+	}
+}
+
+func TestGeoLocatorQueue(t *testing.T) {
+	config := testGeoLocatorConfig()
+	config.Workers = 0
+	config.QueueSize = 1
+	locator := NewGeoLocator(config, &fakeGeoProvider{}, nil)
+	defer locator.Stop()
+
+	store := NewMemNodeStore()
+	locator.Locate(store, "1.1.1.1:1")
+	locator.Locate(store, "1.1.1.1:1")
+	locator.Locate(store, "2.2.2.2:2")
+	want := GeoLocatorStats{Queued: 1, Deduplicated: 1, Dropped: 1}
+	if stats := locator.Stats(); stats != want {
+		t.Errorf("stats = %+v, want %+v", stats, want)
+	}
+}
+
+func TestLocationRefresher(t *testing.T) {
+	store := NewMemNodeStore()
+	for _, node := range []*NodeInfo{
+		{Ip: "1.1.1.1", Port: 1, Lat: 1, Lon: 1, LocationState: LOCATION_RESOLVED},
+		{Ip: "2.2.2.2", Port: 2, Lat: DEFAULT_LAT_LON, Lon: DEFAULT_LAT_LON, LocationState: LOCATION_PENDING},
+		{Ip: "3.3.3.3", Port: 3, Lat: DEFAULT_LAT_LON, Lon: DEFAULT_LAT_LON, LocationState: LOCATION_FAILED,
+			LocationRetryTime: NowInMs() + 3600000},
+	} {
+		if err := store.PutNode(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	provider := &fakeGeoProvider{}
+	locator := NewGeoLocator(testGeoLocatorConfig(), provider, nil)
+	defer locator.Stop()
+
+	NewLocationRefresher(store, locator, time.Hour).refresh()
+	waitFor(t, "the lookup", func() bool { return len(provider.lookedUp()) == 1 })
+	if got := provider.lookedUp(); !reflect.DeepEqual(got, []string{"2.2.2.2"}) {
+		t.Errorf("refreshed %v, want the unlocated node", got)
+	}
+}
+
+func TestInitLocationState(t *testing.T) {
+	tests := []struct {
+		name string
+		node NodeInfo
+		want NodeInfo
+	}{
+		{"located", NodeInfo{Ip: "1.1.1.1", Lat: 1, Lon: 2, Country: "France"},
+			NodeInfo{Ip: "1.1.1.1", Lat: 1, Lon: 2, Country: "France", LocationState: LOCATION_RESOLVED}},
+		{"unlocated", NodeInfo{Ip: "1.1.1.1", Lat: DEFAULT_LAT_LON, Lon: DEFAULT_LAT_LON},
+			NodeInfo{Ip: "1.1.1.1", Lat: DEFAULT_LAT_LON, Lon: DEFAULT_LAT_LON, LocationState: LOCATION_PENDING}},
+		{"failed lookup", NodeInfo{Ip: "1.1.1.1"},
+			NodeInfo{Ip: "1.1.1.1", Lat: DEFAULT_LAT_LON, Lon: DEFAULT_LAT_LON, LocationState: LOCATION_PENDING}},
+		{"private", NodeInfo{Ip: "10.0.0.1"},
+			NodeInfo{Ip: "10.0.0.1", Lat: DEFAULT_LAT_LON, Lon: DEFAULT_LAT_LON, LocationState: LOCATION_PRIVATE}},
+		{"recorded", NodeInfo{Ip: "1.1.1.1", LocationState: LOCATION_FAILED},
+			NodeInfo{Ip: "1.1.1.1", LocationState: LOCATION_FAILED}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := test.node
+			if changed := initLocationState(&node); changed != (test.node.LocationState == "") {
+				t.Errorf("changed = %v", changed)
+			}
+			if !reflect.DeepEqual(node, test.want) {
+				t.Errorf("state initialized as %+v, want %+v", node, test.want)
+			}
+		})
+	}
+}
+
+func TestResetLocations(t *testing.T) {
+	store := NewMemNodeStore()
+	located := &NodeInfo{Ip: "1.1.1.1", Port: 1, Lat: 1, Lon: 2, LocationState: LOCATION_RESOLVED}
+	if err := store.PutNode(located); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := ResetLocations(store); err != nil || count != 1 {
+		t.Fatalf("reset %d locations (%v)", count, err)
+	}
+	node, err := store.GetNode("1.1.1.1:1")
+	if err != nil || node.LocationState != LOCATION_PENDING || node.Lat != 1 || !node.NeedsLocation(0) {
+		t.Errorf("reset node = %+v (%v), want it pending at its former location", node, err)
+	}
+}
@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru"
+	"github.com/ontio/ontology/common/log"
+)
+
+type HostnameResolverConfig struct {
+	Workers   int
+	QueueSize int
+	// Timeout bounds each reverse lookup
+	Timeout time.Duration
+	// Server is the host:port of the DNS server, the system resolver if empty
+	Server string
+	// a node is resolved again CacheTTL after its last resolution
+	CacheSize int
+	CacheTTL  time.Duration
+}
+
+func DefaultHostnameResolverConfig() HostnameResolverConfig {
+	return HostnameResolverConfig{
+		Workers:   4,
+		QueueSize: 10000,
+		Timeout:   5 * time.Second,
+		CacheSize: 10000,
+		CacheTTL:  24 * time.Hour,
+	}
+}
+
+type HostnameResolverStats struct {
+	Queued    int    `json:"queued"`
+	Lookups   uint64 `json:"lookups"`
+	CacheHits uint64 `json:"cache_hits"`
+	Failures  uint64 `json:"failures"`
+	Dropped   uint64 `json:"dropped"`
+}
+
+type cachedHostname struct {
+	hostname string
+	expire   time.Time
+}
+
+// HostnameResolver records the PTR names of the queued nodes, "" if they have
+// none, with a few workers. The names are cached by ip.
+type HostnameResolver struct {
+	config   HostnameResolverConfig
+	resolver *net.Resolver
+	queue    chan nodeRequest
+	cache    *lru.Cache
+
+	lock   sync.Mutex
+	queued map[string]bool
+	stats  HostnameResolverStats
+
+	quit chan bool
+	done sync.WaitGroup
+}
+
+func NewHostnameResolver(config HostnameResolverConfig) *HostnameResolver {
+	cache, err := lru.New(config.CacheSize)
+	if err != nil {
+		panic(err)
+	}
+	resolver := net.DefaultResolver
+	if config.Server != "" {
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, config.Server)
+			},
+		}
+	}
+	self := &HostnameResolver{
+		config:   config,
+		resolver: resolver,
+		queue:    make(chan nodeRequest, config.QueueSize),
+		cache:    cache,
+		queued:   make(map[string]bool),
+		quit:     make(chan bool),
+	}
+	for i := 0; i < config.Workers; i++ {
+		self.done.Add(1)
+		go self.worker()
+	}
+	return self
+}
+
+// Resolve queues the reverse lookup of the node of addr, unless it is already
+// queued or the queue is full.
+func (self *HostnameResolver) Resolve(store NodeStore, addr string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.queued[addr] {
+		return
+	}
+	select {
+	case self.queue <- nodeRequest{store: store, addr: addr}:
+		self.queued[addr] = true
+	default:
+		self.stats.Dropped++
+	}
+}
+
+func (self *HostnameResolver) Stats() HostnameResolverStats {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	stats := self.stats
+	stats.Queued = len(self.queue)
+	return stats
+}
+
+// Stop waits for the lookups in progress, the queued nodes are dropped.
+func (self *HostnameResolver) Stop() {
+	close(self.quit)
+	self.done.Wait()
+}
+
+func (self *HostnameResolver) worker() {
+	defer self.done.Done()
+	for {
+		select {
+		case req := <-self.queue:
+			self.resolve(req)
+			self.lock.Lock()
+			delete(self.queued, req.addr)
+			self.lock.Unlock()
+		case <-self.quit:
+			return
+		}
+	}
+}
+
+// resolve looks up the node of req out of any store transaction and saves its
+// hostname, unless it was resolved less than CacheTTL ago.
+func (self *HostnameResolver) resolve(req nodeRequest) {
+	node, err := req.store.GetNode(req.addr)
+	now := NowInMs()
+	if err != nil || (node.HostnameTime != 0 && node.HostnameTime >= msBefore(now, self.config.CacheTTL)) {
+		return
+	}
+	hostname, err := self.lookup(node.Ip)
+	if err != nil {
+		log.Debugf("reverse lookup of %s error: %s", node.Ip, err)
+		return
+	}
+	err = req.store.UpdateNode(req.addr, func(old *NodeInfo) (*NodeInfo, error) {
+		if old == nil {
+			return nil, nil
+		}
+		old.Hostname = hostname
+		old.HostnameTime = now
+		return old, nil
+	})
+	if err != nil {
+		log.Error("update node hostname error", req.addr, err)
+	}
+}
+
+// lookup returns the first PTR name of ip without the trailing dot, "" if it
+// has none.
+func (self *HostnameResolver) lookup(ip string) (string, error) {
+	if val, ok := self.cache.Get(ip); ok {
+		cached := val.(*cachedHostname)
+		if time.Now().Before(cached.expire) {
+			self.lock.Lock()
+			self.stats.CacheHits++
+			self.lock.Unlock()
+			return cached.hostname, nil
+		}
+		self.cache.Remove(ip)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), self.config.Timeout)
+	defer cancel()
+	names, err := self.resolver.LookupAddr(ctx, ip)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.stats.Lookups++
+	if dnsErr, ok := err.(*net.DNSError); ok && !dnsErr.IsTimeout && !dnsErr.Temporary() {
+		// no such host, the ip has no PTR record
+		err, names = nil, nil
+	}
+	if err != nil {
+		self.stats.Failures++
+		return "", err
+	}
+	hostname := ""
+	if len(names) != 0 {
+		hostname = strings.TrimSuffix(names[0], ".")
+	}
+	self.cache.Add(ip, &cachedHostname{hostname: hostname, expire: time.Now().Add(self.config.CacheTTL)})
+	return hostname, nil
+}
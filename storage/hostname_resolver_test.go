@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHostnameResolver(t *testing.T) {
+	config := DefaultHostnameResolverConfig()
+	config.Workers = 1
+	resolver := NewHostnameResolver(config)
+	defer resolver.Stop()
+	// spare the test a DNS server, the lookups are answered by the cache
+	resolver.cache.Add("1.2.3.4", &cachedHostname{hostname: "node.example.org", expire: time.Now().Add(time.Hour)})
+	resolver.cache.Add("5.6.7.8", &cachedHostname{expire: time.Now().Add(time.Hour)})
+
+	store := NewMemNodeStore()
+	for _, node := range []*NodeInfo{
+		{Ip: "1.2.3.4", Port: 20338},
+		{Ip: "5.6.7.8", Port: 20338, Hostname: "stale.example.org", HostnameTime: 1},
+		{Ip: "9.9.9.9", Port: 20338, Hostname: "fresh.example.org", HostnameTime: NowInMs()},
+	} {
+		if err := store.PutNode(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, addr := range []string{"1.2.3.4:20338", "5.6.7.8:20338", "9.9.9.9:20338"} {
+		resolver.Resolve(store, addr)
+	}
+	waitFor(t, "the resolutions", func() bool { return resolver.Stats().CacheHits == 2 })
+	waitFor(t, "the hostnames", func() bool {
+		node, _ := store.GetNode("5.6.7.8:20338")
+		return node.Hostname == ""
+	})
+
+	for addr, want := range map[string]string{
+		"1.2.3.4:20338": "node.example.org",
+		"5.6.7.8:20338": "",
+		// resolved less than CacheTTL ago
+		"9.9.9.9:20338": "fresh.example.org",
+	} {
+		node, err := store.GetNode(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node.Hostname != want || node.HostnameTime == 0 {
+			t.Errorf("%s resolved as %q at %d, want %q", addr, node.Hostname, node.HostnameTime, want)
+		}
+	}
+	if stats := resolver.Stats(); stats.Lookups != 0 {
+		t.Errorf("%d lookups, want 0", stats.Lookups)
+	}
+}
+
+func TestSearchNodes(t *testing.T) {
+	nodes := []*NodeInfo{
+		{Ip: "1.2.3.4", Port: 20338, Hostname: "node.example.org"},
+		{Ip: "5.6.7.8", Port: 20338, PeerId: "ABCDEF", Country: "FR"},
+		{Ip: "9.9.9.9", Port: 20338, AsOrg: "OVH SAS"},
+	}
+	tests := []struct {
+		term string
+		want []string
+	}{
+		{"EXAMPLE", []string{"1.2.3.4:20338"}},
+		{"5.6.7", []string{"5.6.7.8:20338"}},
+		{"cdE", []string{"5.6.7.8:20338"}},
+		{"ovh", []string{"9.9.9.9:20338"}},
+		{":20338", []string{"1.2.3.4:20338", "5.6.7.8:20338", "9.9.9.9:20338"}},
+		{"nowhere", []string{}},
+	}
+	for _, test := range tests {
+		got := []string{}
+		for _, node := range SearchNodes(nodes, test.term) {
+			got = append(got, node.RemoteListenAddress())
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("search %q = %v, want %v", test.term, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/ontio/ontology/common/log"
+)
+
+const DEFAULT_LOCATION_REFRESH_INTERVAL = 10 * time.Minute
+
+// LocationRefresher periodically queues the geo lookup of the nodes whose
+// location is pending, or failed and due for a retry.
+type LocationRefresher struct {
+	store    NodeStore
+	locator  *GeoLocator
+	interval time.Duration
+	quit     chan bool
+	done     chan bool
+}
+
+func NewLocationRefresher(store NodeStore, locator *GeoLocator, interval time.Duration) *LocationRefresher {
+	if interval == 0 {
+		interval = DEFAULT_LOCATION_REFRESH_INTERVAL
+	}
+	return &LocationRefresher{
+		store:    store,
+		locator:  locator,
+		interval: interval,
+		quit:     make(chan bool),
+		done:     make(chan bool),
+	}
+}
+
+func (self *LocationRefresher) Start() {
+	go self.refreshService()
+}
+
+// Stop returns once the running refresh is over.
+func (self *LocationRefresher) Stop() {
+	close(self.quit)
+	<-self.done
+}
+
+func (self *LocationRefresher) refreshService() {
+	defer close(self.done)
+	t := time.NewTicker(self.interval)
+	for {
+		select {
+		case <-t.C:
+			self.refresh()
+		case <-self.quit:
+			t.Stop()
+			return
+		}
+	}
+}
+
+func (self *LocationRefresher) refresh() {
+	located := false
+	nodes, err := self.store.QueryNodes(&NodeFilter{IsLocated: &located})
+	if err != nil {
+		log.Error("query unlocated nodes error", err)
+		return
+	}
+	now := NowInMs()
+	for _, node := range nodes {
+		if !node.NeedsLocation(now) {
+			continue
+		}
+		select {
+		case <-self.quit:
+			return
+		default:
+		}
+		self.locator.Locate(self.store, node.RemoteListenAddress())
+	}
+}
@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+)
+
+// MemNodeStore is a NodeStore kept entirely in memory, for isolated crawlers
+// and tests.
+type MemNodeStore struct {
+	lock       sync.RWMutex
+	generation uint64
+	nodes      map[string]NodeInfo
+	history    map[string][]Observation // sorted by Time
+	census     []Census                 // sorted by Time
+	peers      map[string]map[string]PeerAddress
+	probes     map[string][]ProbeSlot      // sorted by Time
+	attempts   map[string][]ConnectAttempt // sorted by Time
+}
+
+func NewMemNodeStore() *MemNodeStore {
+	return &MemNodeStore{
+		nodes:    make(map[string]NodeInfo),
+		history:  make(map[string][]Observation),
+		peers:    make(map[string]map[string]PeerAddress),
+		probes:   make(map[string][]ProbeSlot),
+		attempts: make(map[string][]ConnectAttempt),
+	}
+}
+
+func (self *MemNodeStore) Close() error {
+	return nil
+}
+
+func (self *MemNodeStore) PutNode(node *NodeInfo) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.nodes[node.RemoteListenAddress()] = *node
+	self.generation++
+	return nil
+}
+
+func (self *MemNodeStore) UpdateNode(addr string, update func(old *NodeInfo) (*NodeInfo, error)) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	var old *NodeInfo
+	if val, ok := self.nodes[addr]; ok {
+		old = &val
+	}
+	node, err := update(old)
+	if err != nil || node == nil {
+		return err
+	}
+	self.nodes[addr] = *node
+	self.generation++
+	return nil
+}
+
+func (self *MemNodeStore) GetNode(addr string) (*NodeInfo, error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	val, ok := self.nodes[addr]
+	if !ok {
+		return nil, ErrNodeNotFound
+	}
+	return &val, nil
+}
+
+// ListNodes returns the records ordered by address, like a bolt cursor scan.
+func (self *MemNodeStore) ListNodes() ([]*NodeInfo, error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	addrs := make([]string, 0, len(self.nodes))
+	for addr := range self.nodes {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	res := make([]*NodeInfo, 0, len(addrs))
+	for _, addr := range addrs {
+		val := self.nodes[addr]
+		res = append(res, &val)
+	}
+	return res, nil
+}
+
+func (self *MemNodeStore) QueryNodes(filter *NodeFilter) ([]*NodeInfo, error) {
+	nodes, err := self.ListNodes()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*NodeInfo, 0, len(nodes))
+	for _, node := range nodes {
+		if filter.Match(node) {
+			res = append(res, node)
+		}
+	}
+	return res, nil
+}
+
+func (self *MemNodeStore) DeleteNode(addr string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.nodes, addr)
+	self.generation++
+	return nil
+}
+
+func (self *MemNodeStore) WriteBatch(batch *NodeBatch) error {
+	for _, node := range batch.Nodes {
+		if err := self.PutNode(node); err != nil {
+			return err
+		}
+	}
+	for addr, history := range batch.Observations {
+		for _, obs := range history {
+			if err := self.AppendObservation(addr, obs); err != nil {
+				return err
+			}
+		}
+	}
+	for addr, attempts := range batch.Attempts {
+		for _, attempt := range attempts {
+			if err := self.AppendConnectAttempt(addr, attempt); err != nil {
+				return err
+			}
+		}
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for addr, probes := range batch.Probes {
+		if _, ok := self.nodes[addr]; !ok {
+			continue
+		}
+		for _, probe := range probes {
+			self.addProbeSlot(addr, probe)
+		}
+	}
+	return nil
+}
+
+func (self *MemNodeStore) AppendObservation(addr string, obs *Observation) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	hist := self.history[addr]
+	copied := *obs
+	i := sort.Search(len(hist), func(i int) bool { return hist[i].Time >= copied.Time })
+	for ; i < len(hist) && hist[i].Time == copied.Time; i++ {
+		if hist[i] == copied {
+			return nil
+		}
+		copied.Time++
+	}
+	hist = append(hist, Observation{})
+	copy(hist[i+1:], hist[i:])
+	hist[i] = copied
+	self.history[addr] = hist
+	return nil
+}
+
+func (self *MemNodeStore) ListObservations(addr string, from, to uint64) ([]*Observation, error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	var res []*Observation
+	for _, obs := range self.history[addr] {
+		if obs.Time >= from && obs.Time <= to {
+			val := obs
+			res = append(res, &val)
+		}
+	}
+	return res, nil
+}
+
+func (self *MemNodeStore) ListObservedAddrs() ([]string, error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	addrs := make([]string, 0, len(self.history))
+	for addr := range self.history {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs, nil
+}
+
+func (self *MemNodeStore) DeleteObservations(addr string, times []uint64) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	drop := make(map[uint64]bool, len(times))
+	for _, t := range times {
+		drop[t] = true
+	}
+	var kept []Observation
+	for _, obs := range self.history[addr] {
+		if !drop[obs.Time] {
+			kept = append(kept, obs)
+		}
+	}
+	if len(kept) == 0 {
+		delete(self.history, addr)
+	} else {
+		self.history[addr] = kept
+	}
+	return nil
+}
+
+func (self *MemNodeStore) PutCensus(census *Census) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	i := sort.Search(len(self.census), func(i int) bool { return self.census[i].Time >= census.Time })
+	if i < len(self.census) && self.census[i].Time == census.Time {
+		self.census[i] = *census
+		return nil
+	}
+	self.census = append(self.census, Census{})
+	copy(self.census[i+1:], self.census[i:])
+	self.census[i] = *census
+	return nil
+}
+
+func (self *MemNodeStore) ListCensus(from, to uint64) ([]*Census, error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	var res []*Census
+	for _, census := range self.census {
+		if census.Time >= from && census.Time <= to {
+			val := census
+			res = append(res, &val)
+		}
+	}
+	return res, nil
+}
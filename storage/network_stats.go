@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// HEIGHT_PERCENTILES are the percentiles of the node heights in NetworkStats.
+var HEIGHT_PERCENTILES = []int{10, 25, 50, 75, 90, 99}
+
+// NetworkStats aggregates the known nodes of a network.
+type NetworkStats struct {
+	*Census
+	// Sync counts the nodes out of the consensus
+	Sync     int            `json:"sync"`
+	Services map[string]int `json:"services"`
+	// Heights maps the percentiles to the heights of the nodes knowing theirs
+	Heights map[string]uint64 `json:"heights"`
+	Tip     uint64            `json:"tip"`
+}
+
+func TakeNetworkStats(nodes []*NodeInfo, now uint64) *NetworkStats {
+	stats := &NetworkStats{
+		Census:   TakeCensus(nodes, now),
+		Services: make(map[string]int),
+		Heights:  make(map[string]uint64),
+	}
+	stats.Sync = stats.Total - stats.Consensus
+	stats.Tip = stats.MaxHeight
+	var heights []uint64
+	for _, node := range nodes {
+		stats.Services[strconv.FormatUint(node.Services, 10)]++
+		if node.Height != 0 {
+			heights = append(heights, node.Height)
+		}
+	}
+	if len(heights) == 0 {
+		return stats
+	}
+	sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+	for _, p := range HEIGHT_PERCENTILES {
+		// nearest rank
+		rank := (p*len(heights) + 99) / 100
+		if rank < 1 {
+			rank = 1
+		}
+		stats.Heights["p"+strconv.Itoa(p)] = heights[rank-1]
+	}
+	return stats
+}
+
+// StatsCache keeps the NetworkStats of a store until its nodes change.
+type StatsCache struct {
+	store NodeStore
+
+	lock       sync.Mutex
+	generation uint64
+	stats      *NetworkStats
+}
+
+func NewStatsCache(store NodeStore) *StatsCache {
+	return &StatsCache{store: store}
+}
+
+// Get returns the stats of the nodes not tombstoned, computed again only if
+// the store changed since the last call.
+func (self *StatsCache) Get() (*NetworkStats, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	generation := self.store.Generation()
+	if self.stats != nil && generation == self.generation {
+		return self.stats, nil
+	}
+	nodes, err := self.store.ListNodes()
+	if err != nil {
+		return nil, err
+	}
+	self.stats = TakeNetworkStats(ExcludeTombstoned(nodes), NowInMs())
+	self.generation = generation
+	return self.stats, nil
+}
+
+// generationKey holds, in the bucket of a network, its count of node writes.
+var generationKey = []byte("generation")
+
+// bumpGeneration counts a write of the nodes of the network bucket root.
+func bumpGeneration(root *bolt.Bucket) error {
+	val := make([]byte, 8)
+	binary.BigEndian.PutUint64(val, readGeneration(root)+1)
+	return root.Put(generationKey, val)
+}
+
+func readGeneration(root *bolt.Bucket) uint64 {
+	val := root.Get(generationKey)
+	if len(val) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(val)
+}
+
+// Generation counts the node writes and deletes of the network, the other
+// buckets and networks left aside.
+func (self *BoltNodeStore) Generation() uint64 {
+	var generation uint64
+	_ = self.view(func(root *bolt.Bucket) error {
+		generation = readGeneration(root)
+		return nil
+	})
+	return generation
+}
+
+func (self *MemNodeStore) Generation() uint64 {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.generation
+}
+
+// Generation changes with the buffered updates, before they are flushed.
+func (self *WriteBehindStore) Generation() uint64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.generation
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTakeNetworkStats(t *testing.T) {
+	nodes := []*NodeInfo{
+		{Ip: "1.1.1.1", Port: 1, Height: 10, Services: 1, CanConnect: true},
+		{Ip: "2.2.2.2", Port: 2, Height: 30, Services: 1, IsConsensus: true},
+		{Ip: "3.3.3.3", Port: 3, Height: 20, Services: 0},
+		// the nodes not knowing their height are left out of the percentiles
+		{Ip: "4.4.4.4", Port: 4, Services: 0},
+	}
+	stats := TakeNetworkStats(nodes, 5)
+	if stats.Total != 4 || stats.Sync != 3 || stats.Tip != 30 {
+		t.Errorf("total %d, sync %d, tip %d, want 4, 3, 30", stats.Total, stats.Sync, stats.Tip)
+	}
+	if want := map[string]int{"0": 2, "1": 2}; !reflect.DeepEqual(stats.Services, want) {
+		t.Errorf("services %v, want %v", stats.Services, want)
+	}
+	want := map[string]uint64{"p10": 10, "p25": 10, "p50": 20, "p75": 30, "p90": 30, "p99": 30}
+	if !reflect.DeepEqual(stats.Heights, want) {
+		t.Errorf("heights %v, want %v", stats.Heights, want)
+	}
+	if stats := TakeNetworkStats(nil, 5); len(stats.Heights) != 0 || stats.Tip != 0 {
+		t.Errorf("stats of no node %+v", stats)
+	}
+}
+
+func TestStatsCache(t *testing.T) {
+	impls := append(testStores, struct {
+		name string
+		open func(t *testing.T) (NodeStore, func())
+	}{"write behind", func(t *testing.T) (NodeStore, func()) {
+		store := NewWriteBehindStore(NewMemNodeStore(), DefaultWriteBehindConfig())
+		return store, func() { store.Close() }
+	}})
+	for _, impl := range impls {
+		t.Run(impl.name, func(t *testing.T) {
+			store, closeStore := impl.open(t)
+			defer closeStore()
+			cache := NewStatsCache(store)
+			total := func() int {
+				stats, err := cache.Get()
+				if err != nil {
+					t.Fatal(err)
+				}
+				return stats.Total
+			}
+
+			if got := total(); got != 0 {
+				t.Errorf("total %d, want 0", got)
+			}
+			if err := store.PutNode(&NodeInfo{Ip: "1.1.1.1", Port: 1}); err != nil {
+				t.Fatal(err)
+			}
+			if got := total(); got != 1 {
+				t.Errorf("total after put %d, want 1", got)
+			}
+			// the writes of other buckets keep the stats
+			generation := store.Generation()
+			if err := store.AppendObservation("1.1.1.1:1", &Observation{Time: 1}); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.PutCensus(&Census{Time: 1}); err != nil {
+				t.Fatal(err)
+			}
+			if got := store.Generation(); got != generation {
+				t.Errorf("generation %d after other writes, want %d", got, generation)
+			}
+			err := store.UpdateNode("2.2.2.2:2", func(*NodeInfo) (*NodeInfo, error) {
+				return &NodeInfo{Ip: "2.2.2.2", Port: 2}, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := total(); got != 2 {
+				t.Errorf("total after update %d, want 2", got)
+			}
+			// a probe updates the availabilities of the node
+			generation = store.Generation()
+			if err := store.RecordProbe("2.2.2.2:2", NowInMs(), true); err != nil {
+				t.Fatal(err)
+			}
+			if got := store.Generation(); got == generation {
+				t.Errorf("generation %d kept after a probe", got)
+			}
+			if err := store.DeleteNode("1.1.1.1:1"); err != nil {
+				t.Fatal(err)
+			}
+			if got := total(); got != 1 {
+				t.Errorf("total after delete %d, want 1", got)
+			}
+		})
+	}
+}
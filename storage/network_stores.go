@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrNetworkNotFound = errors.New("network not found")
+
+// NetworkStores resolves the NodeStore of each network of a BoltNodeDb, the
+// crawled network being served by its own store.
+type NetworkStores struct {
+	Default uint32 // magic of the crawled network
+	store   NodeStore
+	db      *BoltNodeDb
+
+	lock  sync.Mutex
+	stats map[uint32]*StatsCache
+}
+
+func NewNetworkStores(db *BoltNodeDb, network uint32, store NodeStore) *NetworkStores {
+	return &NetworkStores{
+		Default: network,
+		store:   store,
+		db:      db,
+		stats:   make(map[uint32]*StatsCache),
+	}
+}
+
+// Has tells if network is the crawled one or has a store in the database.
+func (self *NetworkStores) Has(network uint32) (bool, error) {
+	if network == self.Default {
+		return true, nil
+	}
+	if self.db == nil {
+		return false, nil
+	}
+	networks, err := self.db.Networks()
+	if err != nil {
+		return false, err
+	}
+	for _, known := range networks {
+		if known == network {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Get returns ErrNetworkNotFound if network is unknown.
+func (self *NetworkStores) Get(network uint32) (NodeStore, error) {
+	if network == self.Default {
+		return self.store, nil
+	}
+	if ok, err := self.Has(network); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, ErrNetworkNotFound
+	}
+	return self.db.Network(network), nil
+}
+
+// Stats returns the NetworkStats of network, cached until its nodes change.
+func (self *NetworkStores) Stats(network uint32) (*NetworkStats, error) {
+	self.lock.Lock()
+	cache := self.stats[network]
+	self.lock.Unlock()
+	if cache == nil {
+		store, err := self.Get(network)
+		if err != nil {
+			return nil, err
+		}
+		self.lock.Lock()
+		if cache = self.stats[network]; cache == nil {
+			cache = NewStatsCache(store)
+			self.stats[network] = cache
+		}
+		self.lock.Unlock()
+	}
+	return cache.Get()
+}
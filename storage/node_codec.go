@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// A node record is a one byte version followed by the payload of that version.
+// Records written before versioning are raw JSON, which always start with '{'.
+const (
+	NODE_RECORD_JSON = '{'
+	NODE_RECORD_V1   = 1
+	// NODE_RECORD_V2 is V1 followed by groups of fields, each read only if the
+	// record goes on: a record written before a group was added leaves its
+	// fields zero, so new groups need neither a new version nor a migration.
+	NODE_RECORD_V2 = 2
+
+	NODE_RECORD_LATEST = NODE_RECORD_V2
+)
+
+func EncodeNodeInfo(node *NodeInfo) []byte {
+	w := &recordWriter{}
+	w.buf.WriteByte(NODE_RECORD_LATEST)
+	writeNodeFieldsV1(w, node)
+	// the groups of V2, in the order they were added
+	w.writeString(node.PeerId)
+	w.writeBool(node.PseudoPeerId)
+	w.writeString(node.PreviousPeerId)
+	w.writeOptionalFloat(node.Availability24h)
+	w.writeOptionalFloat(node.Availability7d)
+	w.writeOptionalFloat(node.Availability30d)
+	w.writeString(node.Reachability)
+	w.writeUint(node.ReachabilityTime)
+	w.writeString(node.LocationState)
+	w.writeUint(node.LocationRetryTime)
+	w.writeUint(node.Asn)
+	w.writeString(node.AsOrg)
+	w.writeBool(node.IsHosting)
+	w.writeString(node.Hostname)
+	w.writeUint(node.HostnameTime)
+	return w.buf.Bytes()
+}
+
+func writeNodeFieldsV1(w *recordWriter, node *NodeInfo) {
+	w.writeString(node.Ip)
+	w.writeUint(uint64(node.Port))
+	w.writeUint(node.Services)
+	w.writeUint(node.Height)
+	w.writeBool(node.IsConsensus)
+	w.writeString(node.SoftVersion)
+	w.writeBool(node.IsHttp)
+	w.writeUint(uint64(node.HttpInfoPort))
+	w.writeUint(uint64(node.ConsensusPort))
+	w.writeUint(node.LastActiveTime)
+	w.writeBool(node.CanConnect)
+	w.writeFloat(node.Lat)
+	w.writeFloat(node.Lon)
+	w.writeString(node.Country)
+	w.writeUint(node.FirstSeenTime)
+	w.writeString(node.Status)
+}
+
+// DecodeNodeInfo decodes a record of any known version, returning the version.
+func DecodeNodeInfo(data []byte) (*NodeInfo, byte, error) {
+	if len(data) == 0 {
+		return nil, 0, errors.New("empty node record")
+	}
+	version := data[0]
+	switch version {
+	case NODE_RECORD_JSON:
+		node := &NodeInfo{}
+		if err := json.Unmarshal(data, node); err != nil {
+			return nil, version, err
+		}
+		return node, version, nil
+	case NODE_RECORD_V1, NODE_RECORD_V2:
+		node, err := decodeNodeInfoBinary(data[1:], version)
+		return node, version, err
+	default:
+		return nil, version, fmt.Errorf("unknown node record version %d", version)
+	}
+}
+
+func decodeNodeInfoBinary(data []byte, version byte) (*NodeInfo, error) {
+	r := &recordReader{buf: bytes.NewReader(data)}
+	node := &NodeInfo{}
+	readNodeFieldsV1(r, node)
+	if version >= NODE_RECORD_V2 && r.more() {
+		node.PeerId = r.readString()
+		node.PseudoPeerId = r.readBool()
+		node.PreviousPeerId = r.readString()
+	}
+	if version >= NODE_RECORD_V2 && r.more() {
+		node.Availability24h = r.readOptionalFloat()
+		node.Availability7d = r.readOptionalFloat()
+		node.Availability30d = r.readOptionalFloat()
+	}
+	if version >= NODE_RECORD_V2 && r.more() {
+		node.Reachability = r.readString()
+		node.ReachabilityTime = r.readUint()
+	}
+	if version >= NODE_RECORD_V2 && r.more() {
+		node.LocationState = r.readString()
+		node.LocationRetryTime = r.readUint()
+	}
+	if version >= NODE_RECORD_V2 && r.more() {
+		node.Asn = r.readUint()
+		node.AsOrg = r.readString()
+		node.IsHosting = r.readBool()
+	}
+	if version >= NODE_RECORD_V2 && r.more() {
+		node.Hostname = r.readString()
+		node.HostnameTime = r.readUint()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if r.buf.Len() != 0 {
+		return nil, errors.New("trailing bytes in node record")
+	}
+	return node, nil
+}
+
+func readNodeFieldsV1(r *recordReader, node *NodeInfo) {
+	node.Ip = r.readString()
+	node.Port = int(r.readUint())
+	node.Services = r.readUint()
+	node.Height = r.readUint()
+	node.IsConsensus = r.readBool()
+	node.SoftVersion = r.readString()
+	node.IsHttp = r.readBool()
+	node.HttpInfoPort = uint16(r.readUint())
+	node.ConsensusPort = uint16(r.readUint())
+	node.LastActiveTime = r.readUint()
+	node.CanConnect = r.readBool()
+	node.Lat = r.readFloat()
+	node.Lon = r.readFloat()
+	node.Country = r.readString()
+	node.FirstSeenTime = r.readUint()
+	node.Status = r.readString()
+}
+
+type recordWriter struct {
+	buf bytes.Buffer
+}
+
+func (self *recordWriter) writeUint(v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	self.buf.Write(tmp[:n])
+}
+
+func (self *recordWriter) writeBool(v bool) {
+	if v {
+		self.buf.WriteByte(1)
+	} else {
+		self.buf.WriteByte(0)
+	}
+}
+
+func (self *recordWriter) writeFloat(v float32) {
+	var tmp [4]byte
+	binary.BigEndian.PutUint32(tmp[:], math.Float32bits(v))
+	self.buf.Write(tmp[:])
+}
+
+func (self *recordWriter) writeOptionalFloat(v *float32) {
+	self.writeBool(v != nil)
+	if v != nil {
+		self.writeFloat(*v)
+	}
+}
+
+func (self *recordWriter) writeString(v string) {
+	self.writeUint(uint64(len(v)))
+	self.buf.WriteString(v)
+}
+
+// recordReader keeps the first error, so fields can be read without checks.
+type recordReader struct {
+	buf *bytes.Reader
+	err error
+}
+
+// more returns whether fields are left to read.
+func (self *recordReader) more() bool {
+	return self.err == nil && self.buf.Len() > 0
+}
+
+func (self *recordReader) readUint() uint64 {
+	if self.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(self.buf)
+	self.err = err
+	return v
+}
+
+func (self *recordReader) readBool() bool {
+	if self.err != nil {
+		return false
+	}
+	b, err := self.buf.ReadByte()
+	if err == nil && b > 1 {
+		err = errors.New("invalid bool in node record")
+	}
+	self.err = err
+	return b == 1
+}
+
+func (self *recordReader) readFloat() float32 {
+	if self.err != nil {
+		return 0
+	}
+	var tmp [4]byte
+	_, self.err = io.ReadFull(self.buf, tmp[:])
+	return math.Float32frombits(binary.BigEndian.Uint32(tmp[:]))
+}
+
+func (self *recordReader) readOptionalFloat() *float32 {
+	if !self.readBool() {
+		return nil
+	}
+	v := self.readFloat()
+	return &v
+}
+
+func (self *recordReader) readString() string {
+	l := self.readUint()
+	if self.err != nil {
+		return ""
+	}
+	if l > uint64(self.buf.Len()) {
+		self.err = io.ErrUnexpectedEOF
+		return ""
+	}
+	tmp := make([]byte, l)
+	_, self.err = io.ReadFull(self.buf, tmp)
+	return string(tmp)
+}
@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// encodeNodeRecord encodes node as a record of version.
+func encodeNodeRecord(node *NodeInfo, version byte) []byte {
+	switch version {
+	case NODE_RECORD_JSON:
+		data, _ := json.Marshal(node)
+		return data
+	case NODE_RECORD_V1:
+		w := &recordWriter{}
+		w.buf.WriteByte(NODE_RECORD_V1)
+		writeNodeFieldsV1(w, node)
+		return w.buf.Bytes()
+	}
+	return EncodeNodeInfo(node)
+}
+
+// v2NoGroups encodes node as a v2 record written before any group was added.
+func v2NoGroups(node *NodeInfo) []byte {
+	data := encodeNodeRecord(node, NODE_RECORD_V1)
+	data[0] = NODE_RECORD_V2
+	return data
+}
+
+// v1Fields returns the fields of node known to V1 records.
+func v1Fields(node *NodeInfo) *NodeInfo {
+	return &NodeInfo{
+		Ip:             node.Ip,
+		Port:           node.Port,
+		Services:       node.Services,
+		Height:         node.Height,
+		IsConsensus:    node.IsConsensus,
+		SoftVersion:    node.SoftVersion,
+		IsHttp:         node.IsHttp,
+		HttpInfoPort:   node.HttpInfoPort,
+		ConsensusPort:  node.ConsensusPort,
+		LastActiveTime: node.LastActiveTime,
+		CanConnect:     node.CanConnect,
+		Lat:            node.Lat,
+		Lon:            node.Lon,
+		Country:        node.Country,
+		FirstSeenTime:  node.FirstSeenTime,
+		Status:         node.Status,
+	}
+}
+
+// fullNode sets every field of a node.
+func fullNode() *NodeInfo {
+	return &NodeInfo{
+		Ip:                "1.2.3.4",
+		Port:              20338,
+		Services:          1,
+		Height:            12345678,
+		IsConsensus:       true,
+		SoftVersion:       "v1.6.2-0-g2702656",
+		IsHttp:            true,
+		HttpInfoPort:      20335,
+		ConsensusPort:     20339,
+		LastActiveTime:    1600000000000,
+		CanConnect:        true,
+		Lat:               48.85,
+		Lon:               2.35,
+		Country:           "FR",
+		FirstSeenTime:     1500000000000,
+		Status:            NODE_STATUS_OFFLINE,
+		PeerId:            "12345678901234567890",
+		PseudoPeerId:      true,
+		PreviousPeerId:    "98765432109876543210",
+		Availability24h:   float32Ptr(100),
+		Availability7d:    float32Ptr(87.5),
+		Reachability:      REACHABILITY_DIALABLE,
+		ReachabilityTime:  1600000000000,
+		LocationState:     LOCATION_FAILED,
+		LocationRetryTime: 1600000001000,
+		Asn:               16276,
+		AsOrg:             "OVH SAS",
+		IsHosting:         true,
+		Hostname:          "ns3000000.ip-1-2-3.eu",
+		HostnameTime:      1600000002000,
+	}
+}
+
+func float32Ptr(v float32) *float32 {
+	return &v
+}
+
+func TestDecodeNodeInfoVersions(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		version byte
+		want    *NodeInfo
+	}{
+		{"json", encodeNodeRecord(fullNode(), NODE_RECORD_JSON), NODE_RECORD_JSON, fullNode()},
+		{"v1", encodeNodeRecord(fullNode(), NODE_RECORD_V1), NODE_RECORD_V1, v1Fields(fullNode())},
+		{"v1 empty node", encodeNodeRecord(&NodeInfo{}, NODE_RECORD_V1), NODE_RECORD_V1, &NodeInfo{}},
+		{"v2", EncodeNodeInfo(fullNode()), NODE_RECORD_V2, fullNode()},
+		{"v2 without groups", v2NoGroups(fullNode()), NODE_RECORD_V2, v1Fields(fullNode())},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node, version, err := DecodeNodeInfo(test.data)
+			if err != nil {
+				t.Fatalf("decode: %s", err)
+			}
+			if version != test.version {
+				t.Errorf("version = %d, want %d", version, test.version)
+			}
+			if !reflect.DeepEqual(node, test.want) {
+				t.Errorf("decoded %+v, want %+v", node, test.want)
+			}
+			// a decoded record of any version is written as the latest one
+			again, version, err := DecodeNodeInfo(EncodeNodeInfo(node))
+			if err != nil || version != NODE_RECORD_LATEST || !reflect.DeepEqual(again, node) {
+				t.Errorf("re-encoded %+v (version %d, %v), want %+v", again, version, err, node)
+			}
+		})
+	}
+}
+
+func TestDecodeNodeInfoErrors(t *testing.T) {
+	latest := EncodeNodeInfo(fullNode())
+	invalidBool := EncodeNodeInfo(&NodeInfo{})
+	// the IsConsensus byte follows the empty ip and the zero port, services and height
+	invalidBool[5] = 2
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"unknown version", append([]byte{NODE_RECORD_LATEST + 1}, latest[1:]...)},
+		{"truncated", latest[:len(latest)-1]},
+		{"trailing bytes", append(append([]byte(nil), latest...), 0)},
+		{"v1 trailing group", append([]byte{NODE_RECORD_V1}, latest[1:]...)},
+		{"partial group", append(v2NoGroups(fullNode()), 3, 'a')},
+		{"invalid bool", invalidBool},
+		{"invalid json", []byte("{\"ip\":")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if node, _, err := DecodeNodeInfo(test.data); err == nil {
+				t.Errorf("decoded %+v, want an error", node)
+			}
+		})
+	}
+}
@@ -2,11 +2,94 @@ package storage
 
 import (
 	"errors"
+	"net"
 	"strconv"
 	"strings"
 	"time"
 )
 
+var ErrNodeNotFound = errors.New("node not found")
+
+// NodeStore persists the node records collected by the crawler, keyed by the
+// node's remote listen address (ip:port, or [ipv6]:port) as
+// returned by NormalizeAddr.
+type NodeStore interface {
+	// PutNode inserts or replaces the record of node.
+	PutNode(node *NodeInfo) error
+	// UpdateNode atomically reads the record of addr and stores whatever update
+	// returns. update receives nil if the record does not exist yet, and may
+	// return nil to leave the store untouched.
+	UpdateNode(addr string, update func(old *NodeInfo) (*NodeInfo, error)) error
+	// GetNode returns ErrNodeNotFound if addr is unknown.
+	GetNode(addr string) (*NodeInfo, error)
+	ListNodes() ([]*NodeInfo, error)
+	// QueryNodes returns the nodes matching filter, using the indexes if any.
+	QueryNodes(filter *NodeFilter) ([]*NodeInfo, error)
+	DeleteNode(addr string) error
+	// WriteBatch applies the writes of batch at once.
+	WriteBatch(batch *NodeBatch) error
+	// Generation changes whenever nodes are written or deleted, to tell when
+	// the aggregates of the nodes are outdated.
+	Generation() uint64
+
+	// AppendObservation adds obs to the history of addr, a ms after any other
+	// observation made at the same time.
+	AppendObservation(addr string, obs *Observation) error
+	// ListObservations returns the history of addr with from <= Time <= to,
+	// oldest first.
+	ListObservations(addr string, from, to uint64) ([]*Observation, error)
+	// ListObservedAddrs returns every address having a history.
+	ListObservedAddrs() ([]string, error)
+	// DeleteObservations removes the observations of addr taken at times.
+	DeleteObservations(addr string, times []uint64) error
+
+	// PutCensus stores the network census taken at census.Time.
+	PutCensus(census *Census) error
+	// ListCensus returns the censuses with from <= Time <= to, oldest first.
+	ListCensus(from, to uint64) ([]*Census, error)
+
+	// RecordPeerAddress records that the peer identified by id was seen at
+	// addr at time.
+	RecordPeerAddress(id string, addr string, time uint64) error
+	// ListPeerAddresses returns every address seen for id, most recent first.
+	ListPeerAddresses(id string) ([]*PeerAddress, error)
+
+	// RecordProbe counts a connection attempt to addr at time in its
+	// ProbeSlot, and updates the availabilities and the reachability of its
+	// node at once. The probes of unknown addresses are ignored.
+	RecordProbe(addr string, time uint64, success bool) error
+	// ListProbes returns the probe slots of addr covering from to to, oldest first.
+	ListProbes(addr string, from, to uint64) ([]*ProbeSlot, error)
+	// ListProbedAddrs returns every address having probe slots.
+	ListProbedAddrs() ([]string, error)
+	// DeleteProbes deletes the probe slots of addr starting before before.
+	DeleteProbes(addr string, before uint64) error
+
+	// AppendConnectAttempt adds attempt to the connection attempts of addr.
+	AppendConnectAttempt(addr string, attempt *ConnectAttempt) error
+	// ListConnectAttempts returns the attempts of addr with from <= Time <= to, oldest first.
+	ListConnectAttempts(addr string, from, to uint64) ([]*ConnectAttempt, error)
+	// ListAttemptedAddrs returns every address having connection attempts.
+	ListAttemptedAddrs() ([]string, error)
+	// DeleteConnectAttempts deletes the attempts of addr made before before.
+	DeleteConnectAttempts(addr string, before uint64) error
+
+	Close() error
+}
+
+// NodeBatch holds the writes of a WriteBatch, keyed by address.
+type NodeBatch struct {
+	// Nodes are put
+	Nodes []*NodeInfo
+	// Observations are appended to the histories
+	Observations map[string][]*Observation
+	// Attempts are appended to the connection attempts
+	Attempts map[string][]*ConnectAttempt
+	// Probes are counted in their ProbeSlot, unless their address is unknown.
+	// The availabilities they change are written with Nodes.
+	Probes map[string][]*Probe
+}
+
 type NodeInfo struct {
 	Ip             string  `json:"ip"`
 	Port           int     `json:"port"`
@@ -22,31 +105,180 @@ type NodeInfo struct {
 	Lat            float32 `json:"lat"`
 	Lon            float32 `json:"lon"`
 	Country        string  `json:"country"`
+	FirstSeenTime  uint64  `json:"first_seen_time"`
+	Status         string  `json:"status"`
+	// PeerId is the hex kad id of the node, a pseudo id derived from its
+	// version nonce if it does not support the DHT.
+	PeerId         string `json:"peer_id"`
+	PseudoPeerId   bool   `json:"pseudo_peer_id"`
+	PreviousPeerId string `json:"previous_peer_id"`
+	// the percentages of successful probes over the last 24 hours, 7 and 30
+	// days as of the last probe, nil if the window has none
+	Availability24h *float32 `json:"availability_24h"`
+	Availability7d  *float32 `json:"availability_7d"`
+	Availability30d *float32 `json:"availability_30d"`
+	// Reachability is one of the REACHABILITY_* classes, ReachabilityTime (in
+	// ms) the time it was last determined by dialing the node
+	Reachability     string `json:"reachability"`
+	ReachabilityTime uint64 `json:"reachability_time"`
+	// LocationState is one of the LOCATION_* states of the geo lookup, a
+	// failed one is retried from LocationRetryTime (in ms)
+	LocationState     string `json:"location_state"`
+	LocationRetryTime uint64 `json:"location_retry_time"`
+	// the autonomous system of the ip, 0 if unknown, and whether its
+	// organization is a hosting or cloud provider
+	Asn       uint64 `json:"asn"`
+	AsOrg     string `json:"as_org"`
+	IsHosting bool   `json:"is_hosting"`
+	// Hostname is the PTR name of the ip, "" if it has none, as of
+	// HostnameTime (in ms), 0 until it is resolved
+	Hostname     string `json:"hostname"`
+	HostnameTime uint64 `json:"hostname_time"`
+}
+
+const (
+	NODE_STATUS_ACTIVE    = ""
+	NODE_STATUS_OFFLINE   = "offline"
+	NODE_STATUS_TOMBSTONE = "tombstone"
+)
+
+func (n *NodeInfo) IsTombstoned() bool {
+	return n.Status == NODE_STATUS_TOMBSTONE
+}
+
+// LastSeenTime is the latest of the activity and discovery times of the node.
+func (n *NodeInfo) LastSeenTime() uint64 {
+	if n.FirstSeenTime > n.LastActiveTime {
+		return n.FirstSeenTime
+	}
+	return n.LastActiveTime
+}
+
+// IsLocated reports whether the geo location of the node has been resolved.
+func (n *NodeInfo) IsLocated() bool {
+	return n.LocationState == LOCATION_RESOLVED
+}
+
+// NeedsLocation reports whether the geo location of the node should be looked
+// up at now (in ms).
+func (n *NodeInfo) NeedsLocation(now uint64) bool {
+	switch n.LocationState {
+	case LOCATION_RESOLVED, LOCATION_PRIVATE:
+		return false
+	case LOCATION_FAILED:
+		return now >= n.LocationRetryTime
+	}
+	return true
+}
+
+// NodeFilter selects nodes by their fields, unset fields match any node. The
+// indexed fields come first, the others are checked on the indexed matches.
+type NodeFilter struct {
+	Country      string
+	SoftVersion  string
+	CanConnect   *bool
+	IsConsensus  *bool
+	IsLocated    *bool
+	Reachability string
+
+	SoftVersionPrefix string
+	Services          *uint64
+	MinHeight         uint64
+	MaxHeight         *uint64
+	// ActiveFrom and ActiveTo (in ms, 0 if unset) bound the LastActiveTime
+	ActiveFrom uint64
+	ActiveTo   uint64
+}
+
+func (f *NodeFilter) Match(n *NodeInfo) bool {
+	if f.Country != "" && f.Country != n.Country {
+		return false
+	}
+	if f.SoftVersion != "" && f.SoftVersion != n.SoftVersion {
+		return false
+	}
+	if f.CanConnect != nil && *f.CanConnect != n.CanConnect {
+		return false
+	}
+	if f.IsConsensus != nil && *f.IsConsensus != n.IsConsensus {
+		return false
+	}
+	if f.IsLocated != nil && *f.IsLocated != n.IsLocated() {
+		return false
+	}
+	if f.Reachability != "" && f.Reachability != n.Reachability {
+		return false
+	}
+	if !strings.HasPrefix(n.SoftVersion, f.SoftVersionPrefix) {
+		return false
+	}
+	if f.Services != nil && *f.Services != n.Services {
+		return false
+	}
+	if n.Height < f.MinHeight || (f.MaxHeight != nil && n.Height > *f.MaxHeight) {
+		return false
+	}
+	if n.LastActiveTime < f.ActiveFrom || (f.ActiveTo != 0 && n.LastActiveTime > f.ActiveTo) {
+		return false
+	}
+	return true
 }
 
 func (n *NodeInfo) RemoteListenAddress() string {
-	sb := strings.Builder{}
-	sb.WriteString(n.Ip)
-	sb.WriteString(":")
-	sb.WriteString(strconv.Itoa(int(n.Port)))
-	return sb.String()
+	return JoinIpPort(n.Ip, n.Port)
 }
 
+// NormalizeIp returns the canonical form of ip: IPv4-mapped IPv6 addresses are
+// converted to IPv4 and IPv6 addresses are compressed. ip is returned as is if
+// it is not an ip address.
+func NormalizeIp(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	return parsed.String()
+}
+
+// JoinIpPort builds the ip:port address of a node, bracketing IPv6 addresses.
+func JoinIpPort(ip string, port int) string {
+	return net.JoinHostPort(NormalizeIp(ip), strconv.Itoa(port))
+}
+
+// ParseIpPort splits addr into its normalized ip and port. Besides ip:port and
+// [ipv6]:port, it accepts an unbracketed ipv6:port, whose port is after the
+// last colon.
 func ParseIpPort(addr string) (string, int, error) {
-	i := strings.Index(addr, ":")
-	if i < 0 {
-		return "", 0, errors.New("format error, " + addr)
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		i := strings.LastIndex(addr, ":")
+		if i < 0 || net.ParseIP(addr[:i]) == nil {
+			return "", 0, errors.New("format error, " + addr)
+		}
+		host, portStr = addr[:i], addr[i+1:]
 	}
-	port, err := strconv.Atoi(addr[i+1:])
+	port, err := strconv.Atoi(portStr)
 	if err != nil {
 		return "", 0, errors.New("cannot parse port to number, " + addr)
 	}
 	if port <= 0 || port >= 65535 {
 		return "", 0, errors.New("[p2p]port out of bound")
 	}
-	return addr[:i], port, nil
+	return NormalizeIp(host), port, nil
+}
+
+// NormalizeAddr returns the canonical form of addr, which keys the node stores.
+func NormalizeAddr(addr string) (string, error) {
+	ip, port, err := ParseIpPort(addr)
+	if err != nil {
+		return "", err
+	}
+	return JoinIpPort(ip, port), nil
 }
 
 func NowInMs() uint64 {
-	return uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	return TimeInMs(time.Now())
+}
+
+func TimeInMs(t time.Time) uint64 {
+	return uint64(t.UnixNano() / int64(time.Millisecond))
 }
@@ -0,0 +1,35 @@
+package storage
+
+import "testing"
+
+func TestParseIpPort(t *testing.T) {
+	tests := []struct {
+		addr     string
+		wantIp   string
+		wantPort int
+		wantAddr string
+	}{
+		{"1.2.3.4:20338", "1.2.3.4", 20338, "1.2.3.4:20338"},
+		{"[2001:db8::1]:20338", "2001:db8::1", 20338, "[2001:db8::1]:20338"},
+		{"2001:0db8:0:0::1:20338", "2001:db8::1", 20338, "[2001:db8::1]:20338"},
+		{"[::ffff:1.2.3.4]:20338", "1.2.3.4", 20338, "1.2.3.4:20338"},
+		{"::ffff:1.2.3.4:20338", "1.2.3.4", 20338, "1.2.3.4:20338"},
+	}
+	for _, test := range tests {
+		t.Run(test.addr, func(t *testing.T) {
+			ip, port, err := ParseIpPort(test.addr)
+			if err != nil || ip != test.wantIp || port != test.wantPort {
+				t.Errorf("parsed %s, %d (%v), want %s, %d", ip, port, err, test.wantIp, test.wantPort)
+			}
+			if addr, err := NormalizeAddr(test.addr); err != nil || addr != test.wantAddr {
+				t.Errorf("normalized to %s (%v), want %s", addr, err, test.wantAddr)
+			}
+		})
+	}
+
+	for _, addr := range []string{"", "1.2.3.4", "1.2.3.4:x", "1.2.3.4:0", "1.2.3.4:70000", "host:port:20338"} {
+		if _, _, err := ParseIpPort(addr); err == nil {
+			t.Errorf("parse of %q succeeded", addr)
+		}
+	}
+}
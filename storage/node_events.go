@@ -0,0 +1,392 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ontio/ontology/common/log"
+	"github.com/ontio/ontology/p2pserver/message/types"
+	"github.com/ontio/ontology/p2pserver/peer"
+)
+
+func getSyncAddrInfoFromPeer(peer *peer.Peer) (string, int, string, error) {
+	addr := peer.GetAddr()
+	ip, _, err := ParseIpPort(addr)
+	if err != nil {
+		return "", 0, "", err
+	}
+	port := int(peer.GetPort())
+	return ip, port, JoinIpPort(ip, port), nil
+}
+
+// NodeLookups queues the lookups of the nodes met by the crawler. A nil
+// NodeLookups, or field, skips them.
+type NodeLookups struct {
+	Locator  *GeoLocator
+	Resolver *HostnameResolver
+}
+
+func (self *NodeLookups) locate(store NodeStore, addr string) {
+	if self != nil && self.Locator != nil {
+		self.Locator.Locate(store, addr)
+	}
+}
+
+func (self *NodeLookups) resolve(store NodeStore, addr string) {
+	if self != nil && self.Resolver != nil {
+		self.Resolver.Resolve(store, addr)
+	}
+}
+
+func TryAddNodeAfterReceiveAddrMessage(store NodeStore, lookups *NodeLookups, addr string, services uint64, activeTime uint64) {
+	ip, port, err := ParseIpPort(addr)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	addr = JoinIpPort(ip, port)
+
+	added := false
+	err = store.UpdateNode(addr, func(old *NodeInfo) (*NodeInfo, error) {
+		if old != nil {
+			return nil, nil
+		}
+		added = true
+		return &NodeInfo{
+			Ip:             ip,
+			Port:           port,
+			Services:       services,
+			CanConnect:     false,
+			LastActiveTime: activeTime,
+			Lat:            DEFAULT_LAT_LON,
+			Lon:            DEFAULT_LAT_LON,
+			LocationState:  LOCATION_PENDING,
+			FirstSeenTime:  NowInMs(),
+			Reachability:   REACHABILITY_ADVERTISED,
+		}, nil
+	})
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if added {
+		lookups.locate(store, addr)
+		lookups.resolve(store, addr)
+	}
+}
+
+func AddOrUpdateNodeAfterReceiveVersionMsg(store NodeStore, lookups *NodeLookups, peer *peer.Peer, payload types.VersionPayload, isHttp bool) {
+	ip, port, addr, err := getSyncAddrInfoFromPeer(peer)
+	if err != nil {
+		log.Error("get addr info from peer error " + err.Error())
+		return
+	}
+	id := peer.GetID()
+
+	now := NowInMs()
+	var updated *NodeInfo
+	err = store.UpdateNode(addr, func(old *NodeInfo) (*NodeInfo, error) {
+		if old == nil {
+			old = &NodeInfo{
+				Ip:            ip,
+				Port:          port,
+				Lat:           DEFAULT_LAT_LON,
+				Lon:           DEFAULT_LAT_LON,
+				LocationState: LOCATION_PENDING,
+				FirstSeenTime: now,
+			}
+		}
+		old.Services = payload.Services
+		old.Height = payload.StartHeight
+		old.IsConsensus = payload.IsConsensus
+		old.SoftVersion = payload.SoftVersion
+		old.IsHttp = isHttp
+		old.HttpInfoPort = payload.HttpInfoPort
+		old.ConsensusPort = payload.ConsPort
+		old.LastActiveTime = now
+		old.Status = NODE_STATUS_ACTIVE
+		if old.PeerId != "" && old.PeerId != id.ToHexString() {
+			log.Infof("node %s changed peer id from %s to %s", addr, old.PeerId, id.ToHexString())
+			old.PreviousPeerId = old.PeerId
+		}
+		old.PeerId = id.ToHexString()
+		old.PseudoPeerId = id.IsPseudoPeerId()
+		updated = old
+		return old, nil
+	})
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	recordPeerIdentity(store, updated, now)
+	lookups.locate(store, addr)
+	lookups.resolve(store, addr)
+}
+
+// AddOrUpdateNodeAfterReceiveVersionAckMsg saves the node of a completed
+// handshake. The inbound ones are only reachable once dialed back.
+func AddOrUpdateNodeAfterReceiveVersionAckMsg(store NodeStore, lookups *NodeLookups, remotePeer *peer.Peer, inbound bool) {
+	ip, port, addr, err := getSyncAddrInfoFromPeer(remotePeer)
+	if err != nil {
+		log.Error("get addr info from peer error " + err.Error())
+		return
+	}
+
+	now := NowInMs()
+	var updated *NodeInfo
+	err = store.UpdateNode(addr, func(old *NodeInfo) (*NodeInfo, error) {
+		if old == nil {
+			old = &NodeInfo{
+				Ip:            ip,
+				Port:          port,
+				Lat:           DEFAULT_LAT_LON,
+				Lon:           DEFAULT_LAT_LON,
+				LocationState: LOCATION_PENDING,
+				FirstSeenTime: now,
+			}
+		}
+		old.Services = remotePeer.GetServices()
+		old.Height = remotePeer.GetHeight()
+		if !inbound {
+			old.CanConnect = true
+			setReachability(old, REACHABILITY_DIALABLE, now)
+		}
+		old.LastActiveTime = now
+		old.Status = NODE_STATUS_ACTIVE
+		updated = old
+		return old, nil
+	})
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	// the version message is always saved right before, so this observation
+	// covers both the version and the reachability of the handshake
+	recordObservation(store, updated)
+	lookups.locate(store, addr)
+	if inbound {
+		go DialBack(store, addr)
+	}
+}
+
+// Receive pong message
+func UpdateNodeHeight(store NodeStore, peer *peer.Peer, height uint64) {
+	_, _, addr, err := getSyncAddrInfoFromPeer(peer)
+	if err != nil {
+		log.Error("get addr info from peer error " + err.Error())
+		return
+	}
+	if err := updateHeight(store, addr, height); err != nil {
+		log.Error("Update height error", err)
+	}
+}
+
+// updateHeight records a new height of addr. A pong says nothing about the
+// reachability of the node, which is left as is, and the observation is
+// recorded only when the height changed.
+func updateHeight(store NodeStore, addr string, height uint64) error {
+	var updated *NodeInfo
+	err := store.UpdateNode(addr, func(old *NodeInfo) (*NodeInfo, error) {
+		if old == nil || old.Height == height {
+			return nil, nil
+		}
+		old.Height = height
+		// the time of the observation
+		old.LastActiveTime = NowInMs()
+		updated = old
+		return old, nil
+	})
+	if err != nil {
+		return err
+	}
+	if updated != nil {
+		recordObservation(store, updated)
+	}
+	return nil
+}
+
+func ListAllNodes(store NodeStore) ([]*NodeInfo, error) {
+	return QueryNodes(store, &NodeFilter{})
+}
+
+// QueryNodes returns the nodes matching filter, reachable and recently active first.
+func QueryNodes(store NodeStore, filter *NodeFilter) ([]*NodeInfo, error) {
+	res, err := store.QueryNodes(filter)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(res, func(i, j int) bool { return defaultNodeOrder(res[i], res[j]) })
+	return res, nil
+}
+
+// defaultNodeOrder orders the reachable nodes first, then the most recently
+// active and the highest.
+func defaultNodeOrder(a, b *NodeInfo) bool {
+	if a.CanConnect != b.CanConnect {
+		return a.CanConnect
+	}
+	if a.LastActiveTime != b.LastActiveTime {
+		return a.LastActiveTime > b.LastActiveTime
+	}
+	return a.Height > b.Height
+}
+
+// nodeSortKeys are the keys of SortNodes, each ordering the nodes ascending.
+var nodeSortKeys = map[string]func(a, b *NodeInfo) bool{
+	"addr":             func(a, b *NodeInfo) bool { return a.RemoteListenAddress() < b.RemoteListenAddress() },
+	"country":          func(a, b *NodeInfo) bool { return a.Country < b.Country },
+	"soft_version":     func(a, b *NodeInfo) bool { return a.SoftVersion < b.SoftVersion },
+	"services":         func(a, b *NodeInfo) bool { return a.Services < b.Services },
+	"height":           func(a, b *NodeInfo) bool { return a.Height < b.Height },
+	"last_active_time": func(a, b *NodeInfo) bool { return a.LastActiveTime < b.LastActiveTime },
+	"first_seen_time":  func(a, b *NodeInfo) bool { return a.FirstSeenTime < b.FirstSeenTime },
+	"can_connect":      func(a, b *NodeInfo) bool { return !a.CanConnect && b.CanConnect },
+	"is_consensus":     func(a, b *NodeInfo) bool { return !a.IsConsensus && b.IsConsensus },
+	"availability_24h": func(a, b *NodeInfo) bool { return lessAvailability(a.Availability24h, b.Availability24h) },
+	"availability_7d":  func(a, b *NodeInfo) bool { return lessAvailability(a.Availability7d, b.Availability7d) },
+	"availability_30d": func(a, b *NodeInfo) bool { return lessAvailability(a.Availability30d, b.Availability30d) },
+	"reachability":     func(a, b *NodeInfo) bool { return a.Reachability < b.Reachability },
+	"asn":              func(a, b *NodeInfo) bool { return a.Asn < b.Asn },
+	"hostname":         func(a, b *NodeInfo) bool { return a.Hostname < b.Hostname },
+}
+
+// lessAvailability orders the unknown availabilities first.
+func lessAvailability(a, b *float32) bool {
+	if a == nil || b == nil {
+		return a == nil && b != nil
+	}
+	return *a < *b
+}
+
+// NodeOrder is a total order of the nodes: by a sort key, then in the order
+// of QueryNodes, then by address.
+type NodeOrder struct {
+	key  string
+	less func(a, b *NodeInfo) bool
+	desc bool
+}
+
+// NewNodeOrder orders by key, descending if desc. The empty key keeps the
+// order of QueryNodes.
+func NewNodeOrder(key string, desc bool) (*NodeOrder, error) {
+	if key == "" {
+		return &NodeOrder{}, nil
+	}
+	less, ok := nodeSortKeys[key]
+	if !ok {
+		return nil, fmt.Errorf("unknown sort key %s", key)
+	}
+	return &NodeOrder{key: key, less: less, desc: desc}, nil
+}
+
+func (self *NodeOrder) Less(a, b *NodeInfo) bool {
+	if self.less != nil {
+		if self.desc {
+			a, b = b, a
+		}
+		if self.less(a, b) {
+			return true
+		} else if self.less(b, a) {
+			return false
+		}
+	}
+	if defaultNodeOrder(a, b) {
+		return true
+	} else if defaultNodeOrder(b, a) {
+		return false
+	}
+	return a.RemoteListenAddress() < b.RemoteListenAddress()
+}
+
+func (self *NodeOrder) Sort(nodes []*NodeInfo) {
+	sort.Slice(nodes, func(i, j int) bool { return self.Less(nodes[i], nodes[j]) })
+}
+
+// cursorFields are the fields every NodeOrder compares, by their json name.
+var cursorFields = []string{"ip", "port", "can_connect", "last_active_time", "height"}
+
+// Cursor returns the position of node in the order: the values of the fields
+// it is compared by, for a page to resume after it even if it changed or was
+// deleted since. The sort keys are named after the fields they compare.
+func (self *NodeOrder) Cursor(node *NodeInfo) string {
+	raw, _ := json.Marshal(node)
+	var fields map[string]json.RawMessage
+	json.Unmarshal(raw, &fields)
+	cursor := make(map[string]json.RawMessage, len(cursorFields)+1)
+	for _, name := range append(cursorFields, self.key) {
+		if value, ok := fields[name]; ok {
+			cursor[name] = value
+		}
+	}
+	raw, _ = json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// ParseCursor returns a node holding the values of cursor, to pass to After.
+func (self *NodeOrder) ParseCursor(cursor string) (*NodeInfo, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %s", cursor)
+	}
+	node := &NodeInfo{}
+	if err := json.Unmarshal(raw, node); err != nil {
+		return nil, fmt.Errorf("invalid cursor: %s", cursor)
+	}
+	return node, nil
+}
+
+// After returns the nodes, sorted, that come after cursor.
+func (self *NodeOrder) After(nodes []*NodeInfo, cursor *NodeInfo) []*NodeInfo {
+	i := sort.Search(len(nodes), func(i int) bool { return self.Less(cursor, nodes[i]) })
+	return nodes[i:]
+}
+
+// SortNodes sorts nodes by key, descending if desc.
+func SortNodes(nodes []*NodeInfo, key string, desc bool) error {
+	order, err := NewNodeOrder(key, desc)
+	if err != nil {
+		return err
+	}
+	order.Sort(nodes)
+	return nil
+}
+
+// ExcludeTombstoned filters the tombstoned nodes out of nodes.
+func ExcludeTombstoned(nodes []*NodeInfo) []*NodeInfo {
+	res := make([]*NodeInfo, 0, len(nodes))
+	for _, node := range nodes {
+		if !node.IsTombstoned() {
+			res = append(res, node)
+		}
+	}
+	return res
+}
+
+// SearchNodes keeps the nodes whose address, hostname, peer id, country or AS
+// organization contains term, ignoring case.
+func SearchNodes(nodes []*NodeInfo, term string) []*NodeInfo {
+	term = strings.ToLower(term)
+	res := make([]*NodeInfo, 0, len(nodes))
+	for _, node := range nodes {
+		for _, field := range []string{node.RemoteListenAddress(), node.Hostname, node.PeerId, node.Country, node.AsOrg} {
+			if strings.Contains(strings.ToLower(field), term) {
+				res = append(res, node)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// IsTombstoned reports whether addr is known as a tombstoned node.
+func IsTombstoned(store NodeStore, addr string) bool {
+	addr, err := NormalizeAddr(addr)
+	if err != nil {
+		return false
+	}
+	node, err := store.GetNode(addr)
+	return err == nil && node.IsTombstoned()
+}
@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+// orderFixture are nodes tied on some keys, for the ties to be broken.
+func orderFixture() []*NodeInfo {
+	return []*NodeInfo{
+		{Ip: "1.1.1.1", Port: 1, Height: 10, LastActiveTime: 100, CanConnect: true, Country: "FR",
+			Availability24h: float32Ptr(0.5)},
+		{Ip: "2.2.2.2", Port: 2, Height: 20, LastActiveTime: 300, Country: "DE"},
+		{Ip: "3.3.3.3", Port: 3, Height: 20, LastActiveTime: 200, CanConnect: true, Country: "FR",
+			Availability24h: float32Ptr(1)},
+		{Ip: "4.4.4.4", Port: 4, Height: 30, LastActiveTime: 200, CanConnect: true, Country: "DE",
+			Availability24h: float32Ptr(0)},
+	}
+}
+
+func TestNodeOrder(t *testing.T) {
+	tests := []struct {
+		key  string
+		desc bool
+		want []string
+	}{
+		// reachable first, then the most recently active and the highest
+		{"", false, []string{"4.4.4.4:4", "3.3.3.3:3", "1.1.1.1:1", "2.2.2.2:2"}},
+		{"height", false, []string{"1.1.1.1:1", "3.3.3.3:3", "2.2.2.2:2", "4.4.4.4:4"}},
+		{"height", true, []string{"4.4.4.4:4", "2.2.2.2:2", "3.3.3.3:3", "1.1.1.1:1"}},
+		{"country", false, []string{"4.4.4.4:4", "2.2.2.2:2", "3.3.3.3:3", "1.1.1.1:1"}},
+		{"addr", true, []string{"4.4.4.4:4", "3.3.3.3:3", "2.2.2.2:2", "1.1.1.1:1"}},
+		// the unknown availabilities first
+		{"availability_24h", false, []string{"2.2.2.2:2", "4.4.4.4:4", "1.1.1.1:1", "3.3.3.3:3"}},
+	}
+	for _, test := range tests {
+		t.Run(test.key, func(t *testing.T) {
+			order, err := NewNodeOrder(test.key, test.desc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nodes := orderFixture()
+			order.Sort(nodes)
+			got := make([]string, len(nodes))
+			for i, node := range nodes {
+				got[i] = node.RemoteListenAddress()
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("order = %v, want %v", got, test.want)
+			}
+		})
+	}
+	if _, err := NewNodeOrder("unknown", false); err == nil {
+		t.Error("unknown sort key accepted")
+	}
+}
+
+func TestNodeCursor(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		desc bool
+		// change runs on the nodes once the first page is read, and returns
+		// the nodes left
+		change func(nodes []*NodeInfo, last *NodeInfo) []*NodeInfo
+	}{
+		{"unchanged", "height", true, nil},
+		{"last node deleted", "height", true, func(nodes []*NodeInfo, last *NodeInfo) []*NodeInfo {
+			var res []*NodeInfo
+			for _, node := range nodes {
+				if node != last {
+					res = append(res, node)
+				}
+			}
+			return res
+		}},
+		{"last node active again", "", false, func(nodes []*NodeInfo, last *NodeInfo) []*NodeInfo {
+			last.LastActiveTime = 1000
+			return nodes
+		}},
+		{"availability", "availability_24h", false, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			order, err := NewNodeOrder(test.key, test.desc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nodes := orderFixture()
+			order.Sort(nodes)
+			first := nodes[:2]
+			want := append([]*NodeInfo(nil), nodes[2:]...)
+			cursor := order.Cursor(first[1])
+			if test.change != nil {
+				nodes = test.change(nodes, first[1])
+				order.Sort(nodes)
+			}
+
+			last, err := order.ParseCursor(cursor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the nodes not changed since the first page follow it
+			if got := order.After(nodes, last); !reflect.DeepEqual(got, want) {
+				t.Errorf("next page %v, want %v", nodeAddrs(got), nodeAddrs(want))
+			}
+		})
+	}
+	order, _ := NewNodeOrder("", false)
+	for _, cursor := range []string{"!", "bm90IGpzb24"} {
+		if _, err := order.ParseCursor(cursor); err == nil {
+			t.Errorf("invalid cursor %s accepted", cursor)
+		}
+	}
+}
+
+func TestUpdateHeight(t *testing.T) {
+	store := NewMemNodeStore()
+	node := &NodeInfo{Ip: "1.1.1.1", Port: 1, Height: 10, Reachability: REACHABILITY_INBOUND}
+	if err := store.PutNode(node); err != nil {
+		t.Fatal(err)
+	}
+	for _, height := range []uint64{10, 11, 11} {
+		if err := updateHeight(store, "1.1.1.1:1", height); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// unknown nodes are not added
+	if err := updateHeight(store, "2.2.2.2:2", 5); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.GetNode("1.1.1.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Height != 11 || got.CanConnect || got.Reachability != REACHABILITY_INBOUND {
+		t.Errorf("node = %+v, want only the height updated", got)
+	}
+	obs, err := store.ListObservations("1.1.1.1:1", 0, NowInMs()+1)
+	if err != nil || len(obs) != 1 || obs[0].Height != 11 {
+		t.Errorf("observations = %v (%v), want the height change only", obs, err)
+	}
+	if _, err := store.GetNode("2.2.2.2:2"); err != ErrNodeNotFound {
+		t.Errorf("unknown node = %v", err)
+	}
+}
@@ -0,0 +1,397 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+)
+
+const (
+	EXPORT_FORMAT_JSONL = "jsonl"
+	EXPORT_FORMAT_CSV   = "csv"
+)
+
+// exportRecord is a JSONL line: a node and, optionally, its history.
+type exportRecord struct {
+	Node    *NodeInfo      `json:"node"`
+	History []*Observation `json:"history,omitempty"`
+}
+
+type ImportStats struct {
+	Nodes        int // records read
+	Merged       int // records newer than the stored ones
+	Observations int
+}
+
+// MergeNode stores node unless the stored record of its address is at least
+// as recently active. It returns whether node was stored.
+func MergeNode(store NodeStore, node *NodeInfo) (bool, error) {
+	merged := false
+	err := store.UpdateNode(node.RemoteListenAddress(), func(old *NodeInfo) (*NodeInfo, error) {
+		if old != nil && old.LastActiveTime >= node.LastActiveTime {
+			return nil, nil
+		}
+		merged = true
+		return node, nil
+	})
+	return merged, err
+}
+
+func ExportJSONL(store NodeStore, w io.Writer, withHistory bool) (int, error) {
+	nodes, err := store.ListNodes()
+	if err != nil {
+		return 0, err
+	}
+	enc := json.NewEncoder(w)
+	for _, node := range nodes {
+		record := exportRecord{Node: node}
+		if withHistory {
+			record.History, err = store.ListObservations(node.RemoteListenAddress(), 0, math.MaxUint64)
+			if err != nil {
+				return 0, err
+			}
+		}
+		if err := enc.Encode(&record); err != nil {
+			return 0, err
+		}
+	}
+	return len(nodes), nil
+}
+
+func ImportJSONL(store NodeStore, r io.Reader) (*ImportStats, error) {
+	stats := &ImportStats{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record exportRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return stats, fmt.Errorf("line %d: %s", line, err)
+		}
+		if record.Node == nil {
+			return stats, fmt.Errorf("line %d: missing node", line)
+		}
+		if _, err := importNode(store, record.Node, record.History, stats); err != nil {
+			return stats, fmt.Errorf("line %d: %s", line, err)
+		}
+	}
+	return stats, scanner.Err()
+}
+
+// importNode merges node, along with its history if it is newer than the
+// stored record. It returns whether node was merged.
+func importNode(store NodeStore, node *NodeInfo, history []*Observation, stats *ImportStats) (bool, error) {
+	stats.Nodes++
+	ip, port, err := ParseIpPort(JoinIpPort(node.Ip, node.Port))
+	if err != nil {
+		return false, err
+	}
+	if net.ParseIP(ip) == nil {
+		return false, fmt.Errorf("invalid ip %q", node.Ip)
+	}
+	node.Ip, node.Port = ip, port
+	initLocationState(node)
+	merged, err := MergeNode(store, node)
+	if err != nil || !merged {
+		return false, err
+	}
+	stats.Merged++
+	addr := node.RemoteListenAddress()
+	for _, obs := range history {
+		if err := store.AppendObservation(addr, obs); err != nil {
+			return false, err
+		}
+		stats.Observations++
+	}
+	return true, nil
+}
+
+type csvColumn struct {
+	name string
+	get  func(node *NodeInfo) string
+	set  func(node *NodeInfo, val string) error
+}
+
+func uintColumn(name string, field func(node *NodeInfo) *uint64) csvColumn {
+	return csvColumn{
+		name: name,
+		get:  func(node *NodeInfo) string { return strconv.FormatUint(*field(node), 10) },
+		set: func(node *NodeInfo, val string) (err error) {
+			*field(node), err = strconv.ParseUint(val, 10, 64)
+			return
+		},
+	}
+}
+
+func boolColumn(name string, field func(node *NodeInfo) *bool) csvColumn {
+	return csvColumn{
+		name: name,
+		get:  func(node *NodeInfo) string { return strconv.FormatBool(*field(node)) },
+		set: func(node *NodeInfo, val string) (err error) {
+			*field(node), err = strconv.ParseBool(val)
+			return
+		},
+	}
+}
+
+func stringColumn(name string, field func(node *NodeInfo) *string) csvColumn {
+	return csvColumn{
+		name: name,
+		get:  func(node *NodeInfo) string { return *field(node) },
+		set: func(node *NodeInfo, val string) error {
+			*field(node) = val
+			return nil
+		},
+	}
+}
+
+func floatColumn(name string, field func(node *NodeInfo) *float32) csvColumn {
+	return csvColumn{
+		name: name,
+		get:  func(node *NodeInfo) string { return strconv.FormatFloat(float64(*field(node)), 'f', -1, 32) },
+		set: func(node *NodeInfo, val string) error {
+			f, err := strconv.ParseFloat(val, 32)
+			*field(node) = float32(f)
+			return err
+		},
+	}
+}
+
+// optionalFloatColumn writes nil as an empty value.
+func optionalFloatColumn(name string, field func(node *NodeInfo) **float32) csvColumn {
+	return csvColumn{
+		name: name,
+		get: func(node *NodeInfo) string {
+			if *field(node) == nil {
+				return ""
+			}
+			return strconv.FormatFloat(float64(**field(node)), 'f', -1, 32)
+		},
+		set: func(node *NodeInfo, val string) error {
+			if val == "" {
+				*field(node) = nil
+				return nil
+			}
+			f, err := strconv.ParseFloat(val, 32)
+			v := float32(f)
+			*field(node) = &v
+			return err
+		},
+	}
+}
+
+func portColumn(name string, field func(node *NodeInfo) *uint16) csvColumn {
+	return csvColumn{
+		name: name,
+		get:  func(node *NodeInfo) string { return strconv.Itoa(int(*field(node))) },
+		set: func(node *NodeInfo, val string) error {
+			port, err := strconv.ParseUint(val, 10, 16)
+			*field(node) = uint16(port)
+			return err
+		},
+	}
+}
+
+// nodeCSVColumns are named after the json tags of NodeInfo.
+var nodeCSVColumns = []csvColumn{
+	stringColumn("ip", func(n *NodeInfo) *string { return &n.Ip }),
+	{
+		name: "port",
+		get:  func(n *NodeInfo) string { return strconv.Itoa(n.Port) },
+		set: func(n *NodeInfo, val string) (err error) {
+			n.Port, err = strconv.Atoi(val)
+			return
+		},
+	},
+	uintColumn("services", func(n *NodeInfo) *uint64 { return &n.Services }),
+	uintColumn("height", func(n *NodeInfo) *uint64 { return &n.Height }),
+	boolColumn("is_consensus", func(n *NodeInfo) *bool { return &n.IsConsensus }),
+	stringColumn("soft_version", func(n *NodeInfo) *string { return &n.SoftVersion }),
+	boolColumn("is_http", func(n *NodeInfo) *bool { return &n.IsHttp }),
+	portColumn("http_info_port", func(n *NodeInfo) *uint16 { return &n.HttpInfoPort }),
+	portColumn("consensus_port", func(n *NodeInfo) *uint16 { return &n.ConsensusPort }),
+	uintColumn("last_active_time", func(n *NodeInfo) *uint64 { return &n.LastActiveTime }),
+	boolColumn("can_connect", func(n *NodeInfo) *bool { return &n.CanConnect }),
+	floatColumn("lat", func(n *NodeInfo) *float32 { return &n.Lat }),
+	floatColumn("lon", func(n *NodeInfo) *float32 { return &n.Lon }),
+	stringColumn("country", func(n *NodeInfo) *string { return &n.Country }),
+	uintColumn("first_seen_time", func(n *NodeInfo) *uint64 { return &n.FirstSeenTime }),
+	stringColumn("status", func(n *NodeInfo) *string { return &n.Status }),
+	stringColumn("peer_id", func(n *NodeInfo) *string { return &n.PeerId }),
+	boolColumn("pseudo_peer_id", func(n *NodeInfo) *bool { return &n.PseudoPeerId }),
+	stringColumn("previous_peer_id", func(n *NodeInfo) *string { return &n.PreviousPeerId }),
+	optionalFloatColumn("availability_24h", func(n *NodeInfo) **float32 { return &n.Availability24h }),
+	optionalFloatColumn("availability_7d", func(n *NodeInfo) **float32 { return &n.Availability7d }),
+	optionalFloatColumn("availability_30d", func(n *NodeInfo) **float32 { return &n.Availability30d }),
+	stringColumn("reachability", func(n *NodeInfo) *string { return &n.Reachability }),
+	uintColumn("reachability_time", func(n *NodeInfo) *uint64 { return &n.ReachabilityTime }),
+	stringColumn("location_state", func(n *NodeInfo) *string { return &n.LocationState }),
+	uintColumn("location_retry_time", func(n *NodeInfo) *uint64 { return &n.LocationRetryTime }),
+	uintColumn("asn", func(n *NodeInfo) *uint64 { return &n.Asn }),
+	stringColumn("as_org", func(n *NodeInfo) *string { return &n.AsOrg }),
+	boolColumn("is_hosting", func(n *NodeInfo) *bool { return &n.IsHosting }),
+	stringColumn("hostname", func(n *NodeInfo) *string { return &n.Hostname }),
+	uintColumn("hostname_time", func(n *NodeInfo) *uint64 { return &n.HostnameTime }),
+}
+
+var historyCSVHeader = []string{"addr", "time", "height", "soft_version", "can_connect", "is_consensus"}
+
+// ExportCSV writes the nodes to w, and their history to history unless nil.
+func ExportCSV(store NodeStore, w io.Writer, history io.Writer) (int, error) {
+	nodes, err := store.ListNodes()
+	if err != nil {
+		return 0, err
+	}
+	cw := csv.NewWriter(w)
+	header := make([]string, 0, len(nodeCSVColumns))
+	for _, col := range nodeCSVColumns {
+		header = append(header, col.name)
+	}
+	if err := cw.Write(header); err != nil {
+		return 0, err
+	}
+	for _, node := range nodes {
+		row := make([]string, 0, len(nodeCSVColumns))
+		for _, col := range nodeCSVColumns {
+			row = append(row, col.get(node))
+		}
+		if err := cw.Write(row); err != nil {
+			return 0, err
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return 0, err
+	}
+	if history == nil {
+		return len(nodes), nil
+	}
+
+	hw := csv.NewWriter(history)
+	if err := hw.Write(historyCSVHeader); err != nil {
+		return 0, err
+	}
+	for _, node := range nodes {
+		addr := node.RemoteListenAddress()
+		observations, err := store.ListObservations(addr, 0, math.MaxUint64)
+		if err != nil {
+			return 0, err
+		}
+		for _, obs := range observations {
+			err := hw.Write([]string{addr, strconv.FormatUint(obs.Time, 10), strconv.FormatUint(obs.Height, 10),
+				obs.SoftVersion, strconv.FormatBool(obs.CanConnect), strconv.FormatBool(obs.IsConsensus)})
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	hw.Flush()
+	return len(nodes), hw.Error()
+}
+
+// ImportCSV merges the nodes of r, and the history of history unless nil.
+// Columns are matched by their header name, missing ones are left zero.
+func ImportCSV(store NodeStore, r io.Reader, history io.Reader) (*ImportStats, error) {
+	stats := &ImportStats{}
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return stats, err
+	}
+	columns := make([]*csvColumn, len(header))
+	for i, name := range header {
+		for j := range nodeCSVColumns {
+			if nodeCSVColumns[j].name == name {
+				columns[i] = &nodeCSVColumns[j]
+			}
+		}
+	}
+	// the history of the nodes not merged is left out
+	merged := make(map[string]bool)
+	for line := 2; ; line++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stats, err
+		}
+		node := &NodeInfo{}
+		for i, val := range row {
+			if columns[i] == nil {
+				continue
+			}
+			if err := columns[i].set(node, val); err != nil {
+				return stats, fmt.Errorf("line %d, column %s: %s", line, columns[i].name, err)
+			}
+		}
+		ok, err := importNode(store, node, nil, stats)
+		if err != nil {
+			return stats, fmt.Errorf("line %d: %s", line, err)
+		}
+		if ok {
+			merged[node.RemoteListenAddress()] = true
+		}
+	}
+	if history == nil {
+		return stats, nil
+	}
+
+	hr := csv.NewReader(history)
+	if _, err := hr.Read(); err != nil {
+		return stats, err
+	}
+	for line := 2; ; line++ {
+		row, err := hr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stats, err
+		}
+		if len(row) != len(historyCSVHeader) {
+			return stats, fmt.Errorf("history line %d: expected %d columns", line, len(historyCSVHeader))
+		}
+		obs, err := parseObservationRow(row)
+		if err != nil {
+			return stats, fmt.Errorf("history line %d: %s", line, err)
+		}
+		addr, err := NormalizeAddr(row[0])
+		if err != nil {
+			return stats, fmt.Errorf("history line %d: %s", line, err)
+		}
+		if !merged[addr] {
+			continue
+		}
+		if err := store.AppendObservation(addr, obs); err != nil {
+			return stats, err
+		}
+		stats.Observations++
+	}
+	return stats, nil
+}
+
+func parseObservationRow(row []string) (*Observation, error) {
+	obs := &Observation{SoftVersion: row[3]}
+	var err error
+	if obs.Time, err = strconv.ParseUint(row[1], 10, 64); err != nil {
+		return nil, err
+	}
+	if obs.Height, err = strconv.ParseUint(row[2], 10, 64); err != nil {
+		return nil, err
+	}
+	if obs.CanConnect, err = strconv.ParseBool(row[4]); err != nil {
+		return nil, err
+	}
+	if obs.IsConsensus, err = strconv.ParseBool(row[5]); err != nil {
+		return nil, err
+	}
+	return obs, nil
+}
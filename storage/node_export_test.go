@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	formats := []struct {
+		name       string
+		export     func(store NodeStore) ([]byte, []byte, error)
+		importFrom func(store NodeStore, nodes, history []byte) (*ImportStats, error)
+	}{
+		{
+			name: EXPORT_FORMAT_JSONL,
+			export: func(store NodeStore) ([]byte, []byte, error) {
+				var buf bytes.Buffer
+				_, err := ExportJSONL(store, &buf, true)
+				return buf.Bytes(), nil, err
+			},
+			importFrom: func(store NodeStore, nodes, _ []byte) (*ImportStats, error) {
+				return ImportJSONL(store, bytes.NewReader(nodes))
+			},
+		},
+		{
+			name: EXPORT_FORMAT_CSV,
+			export: func(store NodeStore) ([]byte, []byte, error) {
+				var buf, history bytes.Buffer
+				_, err := ExportCSV(store, &buf, &history)
+				return buf.Bytes(), history.Bytes(), err
+			},
+			importFrom: func(store NodeStore, nodes, history []byte) (*ImportStats, error) {
+				return ImportCSV(store, bytes.NewReader(nodes), bytes.NewReader(history))
+			},
+		},
+	}
+	for _, format := range formats {
+		t.Run(format.name, func(t *testing.T) {
+			src := NewMemNodeStore()
+			exported := []*NodeInfo{
+				{Ip: "1.1.1.1", Port: 1, Height: 10, Country: "FR", CanConnect: true, LastActiveTime: 100,
+					LocationState: LOCATION_RESOLVED},
+				{Ip: "2.2.2.2", Port: 2, Height: 20, SoftVersion: "v1.6.2", LastActiveTime: 100},
+			}
+			for _, node := range exported {
+				if err := src.PutNode(node); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := src.AppendObservation("1.1.1.1:1", &Observation{Time: 50, Height: 5, CanConnect: true}); err != nil {
+				t.Fatal(err)
+			}
+			if err := src.AppendObservation("2.2.2.2:2", &Observation{Time: 60, Height: 6}); err != nil {
+				t.Fatal(err)
+			}
+			nodes, history, err := format.export(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the stored records more recently active than the imported ones are
+			// kept, along with their history
+			dst := NewMemNodeStore()
+			newer := &NodeInfo{Ip: "2.2.2.2", Port: 2, Height: 30, LastActiveTime: 200}
+			if err := dst.PutNode(newer); err != nil {
+				t.Fatal(err)
+			}
+			stats, err := format.importFrom(dst, nodes, history)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := (ImportStats{Nodes: 2, Merged: 1, Observations: 1}); *stats != want {
+				t.Errorf("import stats = %+v, want %+v", *stats, want)
+			}
+			if got, err := dst.GetNode("1.1.1.1:1"); err != nil || !reflect.DeepEqual(got, exported[0]) {
+				t.Errorf("imported node = %+v (%v), want %+v", got, err, exported[0])
+			}
+			if got, err := dst.GetNode("2.2.2.2:2"); err != nil || !reflect.DeepEqual(got, newer) {
+				t.Errorf("merged node = %+v (%v), want the newer %+v", got, err, newer)
+			}
+			obs, err := dst.ListObservations("1.1.1.1:1", 0, math.MaxUint64)
+			if err != nil || len(obs) != 1 || !reflect.DeepEqual(obs[0], &Observation{Time: 50, Height: 5, CanConnect: true}) {
+				t.Errorf("imported history = %v (%v)", obs, err)
+			}
+			if obs, err := dst.ListObservations("2.2.2.2:2", 0, math.MaxUint64); err != nil || len(obs) != 0 {
+				t.Errorf("history of the older node = %v (%v), want none", obs, err)
+			}
+		})
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		jsonl string
+	}{
+		{"invalid json", "{"},
+		{"missing node", `{"history": []}`},
+		{"empty address", `{"node": {"ip": "", "port": 0}}`},
+		{"zero port", `{"node": {"ip": "1.1.1.1", "port": 0}}`},
+		{"invalid ip", `{"node": {"ip": "node1", "port": 20338}}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := ImportJSONL(NewMemNodeStore(), bytes.NewBufferString(test.jsonl)); err == nil {
+				t.Errorf("import of %q succeeded", test.jsonl)
+			}
+		})
+	}
+	if _, err := ImportCSV(NewMemNodeStore(), bytes.NewBufferString("ip,port\n1.1.1.1,x\n"), nil); err == nil {
+		t.Errorf("import of an invalid port succeeded")
+	}
+}
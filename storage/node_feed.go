@@ -0,0 +1,296 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+)
+
+// The types of the node events.
+const (
+	NODE_EVENT_ADDED   = "added"
+	NODE_EVENT_UPDATED = "updated"
+	NODE_EVENT_OFFLINE = "offline"
+	// NODE_EVENT_PRUNED nodes were tombstoned or deleted
+	NODE_EVENT_PRUNED = "pruned"
+)
+
+// NodeEvent is a change of a node, carrying its state after the change, or
+// before it if it was deleted.
+type NodeEvent struct {
+	Id   uint64    `json:"id"`
+	Type string    `json:"type"`
+	Time uint64    `json:"time"`
+	Addr string    `json:"addr"`
+	Node *NodeInfo `json:"node"`
+}
+
+// nodeEventType tells the type of the change of a node from old to node.
+func nodeEventType(old, node *NodeInfo) string {
+	switch {
+	case old == nil:
+		return NODE_EVENT_ADDED
+	case node.IsTombstoned() && !old.IsTombstoned():
+		return NODE_EVENT_PRUNED
+	case node.Status == NODE_STATUS_OFFLINE && old.Status != NODE_STATUS_OFFLINE:
+		return NODE_EVENT_OFFLINE
+	default:
+		return NODE_EVENT_UPDATED
+	}
+}
+
+// NodeEventFilter selects events by type and node, unset fields match any event.
+type NodeEventFilter struct {
+	Types map[string]bool
+	Nodes *NodeFilter
+}
+
+func (f *NodeEventFilter) Match(e *NodeEvent) bool {
+	if len(f.Types) != 0 && !f.Types[e.Type] {
+		return false
+	}
+	return f.Nodes == nil || f.Nodes.Match(e.Node)
+}
+
+type NodeFeedConfig struct {
+	// HistorySize is the number of past events a subscriber can resume from
+	HistorySize int
+	// SubscriberBuffer bounds the events pending for a subscriber, a slower
+	// subscriber is closed and can resume from its last event
+	SubscriberBuffer int
+}
+
+func DefaultNodeFeedConfig() NodeFeedConfig {
+	return NodeFeedConfig{
+		HistorySize:      10000,
+		SubscriberBuffer: 1000,
+	}
+}
+
+// NodeFeed numbers the node events from 1 and delivers them to its
+// subscribers. The ids restart with the process.
+type NodeFeed struct {
+	config NodeFeedConfig
+
+	lock        sync.Mutex
+	lastId      uint64
+	history     []*NodeEvent
+	subscribers map[*NodeSubscription]bool
+}
+
+func NewNodeFeed(config NodeFeedConfig) *NodeFeed {
+	return &NodeFeed{
+		config:      config,
+		subscribers: make(map[*NodeSubscription]bool),
+	}
+}
+
+// NodeSubscription receives the events of a NodeFeed on C, closed when the
+// subscriber falls behind.
+type NodeSubscription struct {
+	C    <-chan *NodeEvent
+	c    chan *NodeEvent
+	feed *NodeFeed
+}
+
+func (self *NodeFeed) publish(typ string, addr string, node *NodeInfo) {
+	copied := *node
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.lastId++
+	event := &NodeEvent{Id: self.lastId, Type: typ, Time: NowInMs(), Addr: addr, Node: &copied}
+	self.history = append(self.history, event)
+	if len(self.history) >= 2*self.config.HistorySize {
+		self.history = append([]*NodeEvent(nil), self.history[len(self.history)-self.config.HistorySize:]...)
+	}
+	for sub := range self.subscribers {
+		select {
+		case sub.c <- event:
+		default:
+			delete(self.subscribers, sub)
+			close(sub.c)
+		}
+	}
+}
+
+// Subscribe delivers the events following lastId, 0 for the new events only.
+// It also reports whether the kept history covers every event since lastId,
+// otherwise the subscriber missed some and should reload the nodes.
+func (self *NodeFeed) Subscribe(lastId uint64) (*NodeSubscription, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	var missed []*NodeEvent
+	complete := true
+	if lastId != 0 {
+		history := self.history
+		if len(history) > self.config.HistorySize {
+			history = history[len(history)-self.config.HistorySize:]
+		}
+		i := sort.Search(len(history), func(i int) bool { return history[i].Id > lastId })
+		missed = history[i:]
+		// lastId may be of an event lost with a former process
+		complete = lastId <= self.lastId && (len(history) == 0 || history[0].Id <= lastId+1)
+	}
+	c := make(chan *NodeEvent, len(missed)+self.config.SubscriberBuffer)
+	for _, event := range missed {
+		c <- event
+	}
+	sub := &NodeSubscription{C: c, c: c, feed: self}
+	self.subscribers[sub] = true
+	return sub, complete
+}
+
+// Close stops the delivery of the events.
+func (self *NodeSubscription) Close() {
+	self.feed.lock.Lock()
+	defer self.feed.lock.Unlock()
+	if self.feed.subscribers[self] {
+		delete(self.feed.subscribers, self)
+		close(self.c)
+	}
+}
+
+// displayChanged reports whether a field shown of the nodes changed from old
+// to node, the activity time and the availabilities change with every pong
+// and probe and are left out.
+func displayChanged(old, node *NodeInfo) bool {
+	return old.Ip != node.Ip || old.Port != node.Port || old.Height != node.Height ||
+		old.Services != node.Services || old.SoftVersion != node.SoftVersion ||
+		old.CanConnect != node.CanConnect || old.Status != node.Status ||
+		old.Country != node.Country || old.Lat != node.Lat || old.Lon != node.Lon
+}
+
+// FeedStore publishes the node changes made through it to a NodeFeed. The
+// writes are serialized with their publication, for the events to follow the
+// order of the writes, and a change of the fields not shown is not published.
+type FeedStore struct {
+	NodeStore
+	feed *NodeFeed
+	lock sync.Mutex
+}
+
+func NewFeedStore(store NodeStore, feed *NodeFeed) *FeedStore {
+	return &FeedStore{NodeStore: store, feed: feed}
+}
+
+// lookup returns the node of addr, nil if it is unknown.
+func (self *FeedStore) lookup(addr string) (*NodeInfo, error) {
+	node, err := self.NodeStore.GetNode(addr)
+	if err == ErrNodeNotFound {
+		return nil, nil
+	}
+	return node, err
+}
+
+// publish publishes the change of the node of addr from old to node.
+func (self *FeedStore) publish(addr string, old, node *NodeInfo) {
+	typ := nodeEventType(old, node)
+	if typ == NODE_EVENT_UPDATED && !displayChanged(old, node) {
+		return
+	}
+	self.feed.publish(typ, addr, node)
+}
+
+func (self *FeedStore) PutNode(node *NodeInfo) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	addr := node.RemoteListenAddress()
+	old, err := self.lookup(addr)
+	if err != nil {
+		return err
+	}
+	if err := self.NodeStore.PutNode(node); err != nil {
+		return err
+	}
+	self.publish(addr, old, node)
+	return nil
+}
+
+func (self *FeedStore) UpdateNode(addr string, update func(old *NodeInfo) (*NodeInfo, error)) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	var before, after *NodeInfo
+	err := self.NodeStore.UpdateNode(addr, func(old *NodeInfo) (*NodeInfo, error) {
+		if old != nil {
+			// update may modify old
+			copied := *old
+			before = &copied
+		}
+		node, err := update(old)
+		after = node
+		return node, err
+	})
+	if err != nil || after == nil {
+		return err
+	}
+	self.publish(addr, before, after)
+	return nil
+}
+
+func (self *FeedStore) DeleteNode(addr string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	old, err := self.lookup(addr)
+	if err != nil {
+		return err
+	}
+	if err := self.NodeStore.DeleteNode(addr); err != nil {
+		return err
+	}
+	if old != nil {
+		self.feed.publish(NODE_EVENT_PRUNED, addr, old)
+	}
+	return nil
+}
+
+// RecordProbe publishes the nodes a failed probe marks unconnectable.
+func (self *FeedStore) RecordProbe(addr string, time uint64, success bool) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.rewrite([]string{addr}, func() error {
+		return self.NodeStore.RecordProbe(addr, time, success)
+	})
+}
+
+func (self *FeedStore) WriteBatch(batch *NodeBatch) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	addrs := make([]string, 0, len(batch.Nodes)+len(batch.Probes))
+	for _, node := range batch.Nodes {
+		addrs = append(addrs, node.RemoteListenAddress())
+	}
+	for addr := range batch.Probes {
+		addrs = append(addrs, addr)
+	}
+	return self.rewrite(addrs, func() error {
+		return self.NodeStore.WriteBatch(batch)
+	})
+}
+
+// rewrite runs write and publishes the changes it made to the nodes of addrs,
+// read again after it as a batch may write a node twice.
+func (self *FeedStore) rewrite(addrs []string, write func() error) error {
+	olds := make(map[string]*NodeInfo, len(addrs))
+	for _, addr := range addrs {
+		if _, ok := olds[addr]; ok {
+			continue
+		}
+		old, err := self.lookup(addr)
+		if err != nil {
+			return err
+		}
+		olds[addr] = old
+	}
+	if err := write(); err != nil {
+		return err
+	}
+	for addr, old := range olds {
+		node, err := self.lookup(addr)
+		if err != nil {
+			return err
+		}
+		if node != nil {
+			self.publish(addr, old, node)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+// receive returns the types and addresses of the events pending on sub.
+func receive(sub *NodeSubscription) []string {
+	var res []string
+	for {
+		select {
+		case event, ok := <-sub.C:
+			if !ok {
+				return append(res, "closed")
+			}
+			res = append(res, event.Type+" "+event.Addr)
+		default:
+			return res
+		}
+	}
+}
+
+func TestNodeFeed(t *testing.T) {
+	feed := NewNodeFeed(NodeFeedConfig{HistorySize: 2, SubscriberBuffer: 2})
+	node := &NodeInfo{Ip: "1.1.1.1", Port: 1}
+	sub, complete := feed.Subscribe(0)
+	if !complete {
+		t.Error("new subscription incomplete")
+	}
+	feed.publish(NODE_EVENT_ADDED, "1.1.1.1:1", node)
+	feed.publish(NODE_EVENT_UPDATED, "1.1.1.1:1", node)
+	if got, want := receive(sub), []string{"added 1.1.1.1:1", "updated 1.1.1.1:1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("events %v, want %v", got, want)
+	}
+	// a subscriber falling behind is closed
+	for i := 0; i < 3; i++ {
+		feed.publish(NODE_EVENT_UPDATED, "1.1.1.1:1", node)
+	}
+	if got, want := receive(sub), []string{"updated 1.1.1.1:1", "updated 1.1.1.1:1", "closed"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("events of a slow subscriber %v, want %v", got, want)
+	}
+	sub.Close()
+
+	tests := []struct {
+		name         string
+		lastId       uint64
+		wantIds      []uint64
+		wantComplete bool
+	}{
+		{"resumed", 4, []uint64{5}, true},
+		{"up to date", 5, nil, true},
+		// events 2 and 3 are out of the history
+		{"missed", 1, []uint64{4, 5}, false},
+		{"former process", 10, nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sub, complete := feed.Subscribe(test.lastId)
+			defer sub.Close()
+			var ids []uint64
+			for len(sub.C) != 0 {
+				ids = append(ids, (<-sub.C).Id)
+			}
+			if !reflect.DeepEqual(ids, test.wantIds) || complete != test.wantComplete {
+				t.Errorf("resumed %v, complete %v, want %v, %v", ids, complete, test.wantIds, test.wantComplete)
+			}
+		})
+	}
+}
+
+func TestFeedStore(t *testing.T) {
+	feed := NewNodeFeed(DefaultNodeFeedConfig())
+	store := NewFeedStore(NewMemNodeStore(), feed)
+	sub, _ := feed.Subscribe(0)
+	defer sub.Close()
+	update := func(addr string, update func(*NodeInfo)) {
+		err := store.UpdateNode(addr, func(old *NodeInfo) (*NodeInfo, error) {
+			update(old)
+			return old, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.PutNode(&NodeInfo{Ip: "1.1.1.1", Port: 1, Height: 1}); err != nil {
+		t.Fatal(err)
+	}
+	// the activity time is not shown
+	update("1.1.1.1:1", func(node *NodeInfo) { node.LastActiveTime = 10 })
+	update("1.1.1.1:1", func(node *NodeInfo) { node.Height = 2 })
+	update("1.1.1.1:1", func(node *NodeInfo) { node.Status = NODE_STATUS_OFFLINE })
+	update("1.1.1.1:1", func(node *NodeInfo) { node.Status = NODE_STATUS_TOMBSTONE })
+	err := store.WriteBatch(&NodeBatch{Nodes: []*NodeInfo{
+		{Ip: "2.2.2.2", Port: 2},
+		// a node written twice is published once
+		{Ip: "2.2.2.2", Port: 2, Height: 3},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteNode("2.2.2.2:2"); err != nil {
+		t.Fatal(err)
+	}
+	// nothing to delete
+	if err := store.DeleteNode("2.2.2.2:2"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"added 1.1.1.1:1",
+		"updated 1.1.1.1:1",
+		"offline 1.1.1.1:1",
+		"pruned 1.1.1.1:1",
+		"added 2.2.2.2:2",
+		"pruned 2.2.2.2:2",
+	}
+	if got := receive(sub); !reflect.DeepEqual(got, want) {
+		t.Errorf("events %v, want %v", got, want)
+	}
+}
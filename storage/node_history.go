@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/ontio/ontology/common/log"
+)
+
+// Observation is the state of a node seen at Time (in ms).
+type Observation struct {
+	Time        uint64 `json:"time"`
+	Height      uint64 `json:"height"`
+	SoftVersion string `json:"soft_version"`
+	CanConnect  bool   `json:"can_connect"`
+	IsConsensus bool   `json:"is_consensus"`
+}
+
+func NewObservation(node *NodeInfo) *Observation {
+	return &Observation{
+		Time:        node.LastActiveTime,
+		Height:      node.Height,
+		SoftVersion: node.SoftVersion,
+		CanConnect:  node.CanConnect,
+		IsConsensus: node.IsConsensus,
+	}
+}
+
+// HistoryPolicy controls how long observations are kept. Observations younger
+// than FullResolution are kept as is, older ones are downsampled to the latest
+// one of every DownsampleInterval, and those older than Retention are dropped.
+type HistoryPolicy struct {
+	FullResolution     time.Duration
+	DownsampleInterval time.Duration
+	Retention          time.Duration
+	CompactInterval    time.Duration
+}
+
+func DefaultHistoryPolicy() HistoryPolicy {
+	return HistoryPolicy{
+		FullResolution:     24 * time.Hour,
+		DownsampleInterval: time.Hour,
+		Retention:          180 * 24 * time.Hour,
+		CompactInterval:    time.Hour,
+	}
+}
+
+func recordObservation(store NodeStore, node *NodeInfo) {
+	addr := node.RemoteListenAddress()
+	if err := store.AppendObservation(addr, NewObservation(node)); err != nil {
+		log.Error("append observation error", addr, err)
+	}
+}
+
+// CompactHistory applies policy to the history of every node, as of now (in ms).
+func CompactHistory(store NodeStore, policy HistoryPolicy, now uint64) error {
+	addrs, err := store.ListObservedAddrs()
+	if err != nil {
+		return err
+	}
+	fullFrom := msBefore(now, policy.FullResolution)
+	retainFrom := msBefore(now, policy.Retention)
+	interval := uint64(policy.DownsampleInterval / time.Millisecond)
+	if fullFrom == 0 {
+		return nil
+	}
+	for _, addr := range addrs {
+		obs, err := store.ListObservations(addr, 0, fullFrom-1)
+		if err != nil {
+			return err
+		}
+		var expired []uint64
+		for i, o := range obs {
+			if o.Time < retainFrom {
+				expired = append(expired, o.Time)
+				continue
+			}
+			// keep the latest observation of each interval
+			if interval > 0 && i+1 < len(obs) && obs[i+1].Time/interval == o.Time/interval {
+				expired = append(expired, o.Time)
+			}
+		}
+		if len(expired) == 0 {
+			continue
+		}
+		if err := store.DeleteObservations(addr, expired); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// msBefore returns the ms timestamp d before now, or 0 if that precedes the epoch.
+func msBefore(now uint64, d time.Duration) uint64 {
+	ms := uint64(d / time.Millisecond)
+	if ms > now {
+		return 0
+	}
+	return now - ms
+}
+
+// HistoryCompactor periodically runs CompactHistory in the background.
+type HistoryCompactor struct {
+	store  NodeStore
+	policy HistoryPolicy
+	quit   chan bool
+	done   chan bool
+}
+
+func NewHistoryCompactor(store NodeStore, policy HistoryPolicy) *HistoryCompactor {
+	return &HistoryCompactor{
+		store:  store,
+		policy: policy,
+		quit:   make(chan bool),
+		done:   make(chan bool),
+	}
+}
+
+func (self *HistoryCompactor) Start() {
+	go self.compactService()
+}
+
+// Stop returns once the running compaction is over.
+func (self *HistoryCompactor) Stop() {
+	close(self.quit)
+	<-self.done
+}
+
+func (self *HistoryCompactor) compactService() {
+	defer close(self.done)
+	t := time.NewTicker(self.policy.CompactInterval)
+	for {
+		select {
+		case <-t.C:
+			if err := CompactHistory(self.store, self.policy, NowInMs()); err != nil {
+				log.Error("compact node history error", err)
+			}
+		case <-self.quit:
+			t.Stop()
+			return
+		}
+	}
+}
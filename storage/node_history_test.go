@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func observationTimes(history []*Observation) []uint64 {
+	times := make([]uint64, len(history))
+	for i, obs := range history {
+		times[i] = obs.Time
+	}
+	return times
+}
+
+func TestObservations(t *testing.T) {
+	for _, impl := range testStores {
+		t.Run(impl.name, func(t *testing.T) {
+			store, closeStore := impl.open(t)
+			defer closeStore()
+
+			// appended out of order, listed oldest first
+			for _, tm := range []uint64{30, 10, 20} {
+				if err := store.AppendObservation("1.1.1.1:1", &Observation{Time: tm, Height: tm}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			history, err := store.ListObservations("1.1.1.1:1", 10, 20)
+			if err != nil || !reflect.DeepEqual(observationTimes(history), []uint64{10, 20}) {
+				t.Errorf("observations = %v (%v), want 10 and 20", observationTimes(history), err)
+			}
+			if history, err := store.ListObservations("2.2.2.2:2", 0, 100); err != nil || len(history) != 0 {
+				t.Errorf("observations of an unknown node = %v (%v)", history, err)
+			}
+
+			// a second observation of the same ms moves to the next free one,
+			// the same observation again is kept once
+			for _, obs := range []*Observation{{Time: 20, Height: 21}, {Time: 20, Height: 22}, {Time: 20, Height: 21}} {
+				if err := store.AppendObservation("1.1.1.1:1", obs); err != nil {
+					t.Fatal(err)
+				}
+			}
+			batch := &NodeBatch{Observations: map[string][]*Observation{"1.1.1.1:1": {{Time: 30, Height: 31}}}}
+			if err := store.WriteBatch(batch); err != nil {
+				t.Fatal(err)
+			}
+			history, err = store.ListObservations("1.1.1.1:1", 0, 100)
+			want := []uint64{10, 20, 21, 22, 30, 31}
+			if err != nil || !reflect.DeepEqual(observationTimes(history), want) {
+				t.Errorf("observations = %v (%v), want %v", observationTimes(history), err, want)
+			}
+
+			if err := store.DeleteObservations("1.1.1.1:1", want); err != nil {
+				t.Fatal(err)
+			}
+			// the addresses left without observations are forgotten
+			if addrs, err := store.ListObservedAddrs(); err != nil || len(addrs) != 0 {
+				t.Errorf("observed addrs = %v (%v), want none", addrs, err)
+			}
+		})
+	}
+}
+
+func TestCompactHistory(t *testing.T) {
+	hour := uint64(time.Hour / time.Millisecond)
+	policy := HistoryPolicy{
+		FullResolution:     24 * time.Hour,
+		DownsampleInterval: time.Hour,
+		Retention:          48 * time.Hour,
+	}
+	now := 100 * hour
+	tests := []struct {
+		name  string
+		times []uint64
+		want  []uint64
+	}{
+		{"recent kept as is", []uint64{now - 2, now - 1}, []uint64{now - 2, now - 1}},
+		{"expired", []uint64{now - 49*hour, now - hour}, []uint64{now - hour}},
+		{"downsampled to the latest of each hour", []uint64{70 * hour, 70*hour + 1, 70*hour + 2, 71 * hour},
+			[]uint64{70*hour + 2, 71 * hour}},
+		{"full resolution boundary", []uint64{now - 24*hour - 2, now - 24*hour - 1, now - 24*hour},
+			[]uint64{now - 24*hour - 1, now - 24*hour}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := NewMemNodeStore()
+			for _, tm := range test.times {
+				if err := store.AppendObservation("1.1.1.1:1", &Observation{Time: tm}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := CompactHistory(store, policy, now); err != nil {
+				t.Fatal(err)
+			}
+			history, err := store.ListObservations("1.1.1.1:1", 0, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := observationTimes(history); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("compacted to %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"math"
+	"time"
+
+	"github.com/ontio/ontology/common/log"
+)
+
+// PrunePolicy controls the expiry of nodes not seen for a while. A node is
+// marked offline after OfflineAfter, tombstoned after TombstoneAfter and
+// deleted with its history after PurgeAfter. A zero threshold disables its stage.
+type PrunePolicy struct {
+	OfflineAfter   time.Duration
+	TombstoneAfter time.Duration
+	PurgeAfter     time.Duration
+	PruneInterval  time.Duration
+}
+
+func DefaultPrunePolicy() PrunePolicy {
+	return PrunePolicy{
+		OfflineAfter:   6 * time.Hour,
+		TombstoneAfter: 7 * 24 * time.Hour,
+		PurgeAfter:     4 * 7 * 24 * time.Hour,
+		PruneInterval:  10 * time.Minute,
+	}
+}
+
+func expired(node *NodeInfo, threshold time.Duration, now uint64) bool {
+	return threshold > 0 && node.LastSeenTime() < msBefore(now, threshold)
+}
+
+// PruneNodes applies policy to every node of store, as of now (in ms), then
+// deletes the probes and connection attempts past their retention.
+func PruneNodes(store NodeStore, policy PrunePolicy, now uint64) error {
+	nodes, err := store.ListNodes()
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		addr := node.RemoteListenAddress()
+		if expired(node, policy.PurgeAfter, now) {
+			if err := purgeNode(store, addr); err != nil {
+				return err
+			}
+			continue
+		}
+		status := node.Status
+		if expired(node, policy.TombstoneAfter, now) {
+			status = NODE_STATUS_TOMBSTONE
+		} else if expired(node, policy.OfflineAfter, now) && status == NODE_STATUS_ACTIVE {
+			status = NODE_STATUS_OFFLINE
+		}
+		if status == node.Status {
+			continue
+		}
+		err := store.UpdateNode(addr, func(old *NodeInfo) (*NodeInfo, error) {
+			// skip nodes which became active since they were listed
+			if old == nil || old.LastSeenTime() != node.LastSeenTime() {
+				return nil, nil
+			}
+			old.Status = status
+			old.CanConnect = false
+			return old, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := expireProbes(store, now); err != nil {
+		return err
+	}
+	return expireConnectAttempts(store, now)
+}
+
+func purgeNode(store NodeStore, addr string) error {
+	if err := store.DeleteNode(addr); err != nil {
+		return err
+	}
+	if err := store.DeleteProbes(addr, math.MaxUint64); err != nil {
+		return err
+	}
+	if err := store.DeleteConnectAttempts(addr, math.MaxUint64); err != nil {
+		return err
+	}
+	history, err := store.ListObservations(addr, 0, math.MaxUint64)
+	if err != nil || len(history) == 0 {
+		return err
+	}
+	times := make([]uint64, 0, len(history))
+	for _, obs := range history {
+		times = append(times, obs.Time)
+	}
+	return store.DeleteObservations(addr, times)
+}
+
+// NodePruner periodically runs PruneNodes in the background.
+type NodePruner struct {
+	store  NodeStore
+	policy PrunePolicy
+	quit   chan bool
+	done   chan bool
+}
+
+func NewNodePruner(store NodeStore, policy PrunePolicy) *NodePruner {
+	return &NodePruner{
+		store:  store,
+		policy: policy,
+		quit:   make(chan bool),
+		done:   make(chan bool),
+	}
+}
+
+func (self *NodePruner) Start() {
+	go self.pruneService()
+}
+
+// Stop returns once the running pruning is over.
+func (self *NodePruner) Stop() {
+	close(self.quit)
+	<-self.done
+}
+
+func (self *NodePruner) pruneService() {
+	defer close(self.done)
+	t := time.NewTicker(self.policy.PruneInterval)
+	for {
+		select {
+		case <-t.C:
+			if err := PruneNodes(self.store, self.policy, NowInMs()); err != nil {
+				log.Error("prune nodes error", err)
+			}
+		case <-self.quit:
+			t.Stop()
+			return
+		}
+	}
+}
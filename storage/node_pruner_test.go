@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPruneNodes(t *testing.T) {
+	hour := uint64(time.Hour / time.Millisecond)
+	policy := PrunePolicy{OfflineAfter: time.Hour, TombstoneAfter: 24 * time.Hour, PurgeAfter: 48 * time.Hour}
+	now := 100 * hour
+	tests := []struct {
+		name       string
+		node       NodeInfo
+		policy     PrunePolicy
+		wantStatus string
+		wantPurged bool
+	}{
+		{"active", NodeInfo{LastActiveTime: now - 1, CanConnect: true}, policy, NODE_STATUS_ACTIVE, false},
+		{"offline", NodeInfo{LastActiveTime: now - 2*hour}, policy, NODE_STATUS_OFFLINE, false},
+		{"discovered recently", NodeInfo{LastActiveTime: now - 30*hour, FirstSeenTime: now - 1}, policy,
+			NODE_STATUS_ACTIVE, false},
+		{"tombstoned", NodeInfo{LastActiveTime: now - 30*hour, Status: NODE_STATUS_OFFLINE}, policy,
+			NODE_STATUS_TOMBSTONE, false},
+		{"purged", NodeInfo{LastActiveTime: now - 50*hour, Status: NODE_STATUS_TOMBSTONE}, policy, "", true},
+		{"stage disabled", NodeInfo{LastActiveTime: now - 50*hour}, PrunePolicy{OfflineAfter: time.Hour},
+			NODE_STATUS_OFFLINE, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := NewMemNodeStore()
+			node := test.node
+			node.Ip, node.Port = "1.1.1.1", 1
+			if err := store.PutNode(&node); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.AppendObservation("1.1.1.1:1", &Observation{Time: node.LastActiveTime}); err != nil {
+				t.Fatal(err)
+			}
+			if err := PruneNodes(store, test.policy, now); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := store.GetNode("1.1.1.1:1")
+			history, _ := store.ListObservations("1.1.1.1:1", 0, now)
+			if test.wantPurged {
+				if err != ErrNodeNotFound || len(history) != 0 {
+					t.Errorf("purged node left %+v and %d observations", got, len(history))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Status != test.wantStatus || len(history) != 1 {
+				t.Errorf("status %q with %d observations, want %q", got.Status, len(history), test.wantStatus)
+			}
+			// an expired node is no longer reachable
+			if got.Status != node.Status && got.CanConnect {
+				t.Errorf("node marked %s still reachable", got.Status)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+const TEST_NETWORK = 0x12345
+
+// tempDir creates a directory removed by the returned func.
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "nodedb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// newTestBoltStore opens an empty store, closed by the returned func.
+func newTestBoltStore(t *testing.T) (*BoltNodeStore, func()) {
+	dir, remove := tempDir(t)
+	db, err := NewBoltNodeDb(filepath.Join(dir, NODE_DB_FILE_NAME), TEST_NETWORK)
+	if err != nil {
+		remove()
+		t.Fatal(err)
+	}
+	return db.Network(TEST_NETWORK), func() {
+		db.Close()
+		remove()
+	}
+}
+
+// testStores are the implementations every NodeStore test runs against.
+var testStores = []struct {
+	name string
+	open func(t *testing.T) (NodeStore, func())
+}{
+	{"mem", func(*testing.T) (NodeStore, func()) { return NewMemNodeStore(), func() {} }},
+	{"bolt", func(t *testing.T) (NodeStore, func()) { return newTestBoltStore(t) }},
+}
+
+// nodeAddrs returns the sorted addresses of nodes.
+func nodeAddrs(nodes []*NodeInfo) []string {
+	addrs := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		addrs = append(addrs, node.RemoteListenAddress())
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func TestNodeStore(t *testing.T) {
+	for _, impl := range testStores {
+		t.Run(impl.name, func(t *testing.T) {
+			store, closeStore := impl.open(t)
+			defer closeStore()
+
+			if _, err := store.GetNode("1.1.1.1:1"); err != ErrNodeNotFound {
+				t.Errorf("get unknown node: %v, want %v", err, ErrNodeNotFound)
+			}
+			node := &NodeInfo{Ip: "2.2.2.2", Port: 2, Height: 10, Country: "FR"}
+			if err := store.PutNode(node); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := store.GetNode("2.2.2.2:2"); err != nil || !reflect.DeepEqual(got, node) {
+				t.Errorf("get node = %+v (%v), want %+v", got, err, node)
+			}
+
+			// update creates the record of an unknown address
+			err := store.UpdateNode("1.1.1.1:1", func(old *NodeInfo) (*NodeInfo, error) {
+				if old != nil {
+					t.Errorf("update of an unknown node got %+v", old)
+				}
+				return &NodeInfo{Ip: "1.1.1.1", Port: 1}, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// and leaves the store untouched when it returns nil
+			err = store.UpdateNode("2.2.2.2:2", func(old *NodeInfo) (*NodeInfo, error) {
+				old.Height = 20
+				return nil, nil
+			})
+			if got, _ := store.GetNode("2.2.2.2:2"); err != nil || got.Height != 10 {
+				t.Errorf("update returning nil stored %+v (%v)", got, err)
+			}
+			err = store.UpdateNode("2.2.2.2:2", func(old *NodeInfo) (*NodeInfo, error) {
+				old.Height = 20
+				return old, nil
+			})
+			if got, _ := store.GetNode("2.2.2.2:2"); err != nil || got.Height != 20 {
+				t.Errorf("updated node = %+v (%v), want height 20", got, err)
+			}
+
+			nodes, err := store.ListNodes()
+			if err != nil || !reflect.DeepEqual(nodeAddrs(nodes), []string{"1.1.1.1:1", "2.2.2.2:2"}) {
+				t.Errorf("list nodes = %v (%v)", nodeAddrs(nodes), err)
+			}
+			if err := store.DeleteNode("1.1.1.1:1"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.GetNode("1.1.1.1:1"); err != ErrNodeNotFound {
+				t.Errorf("get deleted node: %v, want %v", err, ErrNodeNotFound)
+			}
+		})
+	}
+}
+
+func TestNetworks(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	db, err := NewBoltNodeDb(filepath.Join(dir, NODE_DB_FILE_NAME), TEST_NETWORK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Network(TEST_NETWORK).PutNode(&NodeInfo{Ip: "1.1.1.1", Port: 1}); err != nil {
+		t.Fatal(err)
+	}
+	other := db.Network(TEST_NETWORK + 1)
+	if err := other.PutNode(&NodeInfo{Ip: "2.2.2.2", Port: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.GetNode("1.1.1.1:1"); err != ErrNodeNotFound {
+		t.Errorf("node of another network: %v, want %v", err, ErrNodeNotFound)
+	}
+	if networks, err := db.Networks(); err != nil || !reflect.DeepEqual(networks, []uint32{TEST_NETWORK, TEST_NETWORK + 1}) {
+		t.Errorf("networks = %v (%v)", networks, err)
+	}
+
+	// the crawled network is served by its own store
+	mem := NewMemNodeStore()
+	stores := NewNetworkStores(db, TEST_NETWORK, mem)
+	if store, err := stores.Get(TEST_NETWORK); err != nil || store != mem {
+		t.Errorf("default network not served by its store: %v", err)
+	}
+	store, err := stores.Get(TEST_NETWORK + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := store.ListNodes()
+	if err != nil || !reflect.DeepEqual(nodeAddrs(nodes), []string{"2.2.2.2:2"}) {
+		t.Errorf("other network nodes = %v (%v)", nodeAddrs(nodes), err)
+	}
+	// the unknown networks are neither served nor cached
+	if _, err := stores.Get(TEST_NETWORK + 2); err != ErrNetworkNotFound {
+		t.Errorf("unknown network: %v, want %v", err, ErrNetworkNotFound)
+	}
+	if _, err := stores.Stats(TEST_NETWORK + 2); err != ErrNetworkNotFound || len(stores.stats) != 0 {
+		t.Errorf("stats of an unknown network: %v, %d cached", err, len(stores.stats))
+	}
+}
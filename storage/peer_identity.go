@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/ontio/ontology/common/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+const PEER_BUCKET = "PEER_BUCKET"
+
+// peerBucketName holds one nested bucket per peer id, keyed by the addresses
+// seen for that id.
+var peerBucketName = []byte(PEER_BUCKET)
+
+// PeerState is the live state of a connected node, times in ms.
+type PeerState struct {
+	PeerId          string `json:"peer_id"`
+	Inbound         bool   `json:"inbound"`
+	ConnectedSince  uint64 `json:"connected_since"`
+	LastContactTime uint64 `json:"last_contact_time"`
+	Relay           bool   `json:"relay"`
+	// Height is the latest height reported by the pings of the node
+	Height uint64 `json:"height"`
+}
+
+// PeerAddress is an address seen for a peer identity.
+type PeerAddress struct {
+	Addr          string `json:"addr"`
+	FirstSeenTime uint64 `json:"first_seen_time"`
+	LastSeenTime  uint64 `json:"last_seen_time"`
+}
+
+// mergePeerAddress returns the record of addr seen at time, given its previous
+// record old, which may be nil.
+func mergePeerAddress(old *PeerAddress, addr string, time uint64) *PeerAddress {
+	if old == nil {
+		return &PeerAddress{Addr: addr, FirstSeenTime: time, LastSeenTime: time}
+	}
+	res := *old
+	if time < res.FirstSeenTime {
+		res.FirstSeenTime = time
+	}
+	if time > res.LastSeenTime {
+		res.LastSeenTime = time
+	}
+	return &res
+}
+
+func sortPeerAddresses(addrs []*PeerAddress) {
+	sort.Slice(addrs, func(i, j int) bool {
+		return addrs[i].LastSeenTime > addrs[j].LastSeenTime
+	})
+}
+
+// recordPeerIdentity records addr in the address history of the id of node,
+// logging the identities moving to another address.
+func recordPeerIdentity(store NodeStore, node *NodeInfo, now uint64) {
+	if node.PeerId == "" {
+		return
+	}
+	addr := node.RemoteListenAddress()
+	addrs, err := store.ListPeerAddresses(node.PeerId)
+	if err != nil {
+		log.Error("list peer addresses error", err)
+		return
+	}
+	if len(addrs) > 0 && addrs[0].Addr != addr {
+		log.Infof("peer %s moved from %s to %s", node.PeerId, addrs[0].Addr, addr)
+	}
+	if err := store.RecordPeerAddress(node.PeerId, addr, now); err != nil {
+		log.Error("record peer address error", err)
+	}
+}
+
+func (self *BoltNodeStore) RecordPeerAddress(id string, addr string, time uint64) error {
+	return self.update(func(root *bolt.Bucket) error {
+		pb := root.Bucket(peerBucketName)
+		if pb == nil {
+			return errors.New("bucket not exist")
+		}
+		b, err := pb.CreateBucketIfNotExists([]byte(id))
+		if err != nil {
+			return err
+		}
+		var old *PeerAddress
+		if val := b.Get([]byte(addr)); val != nil {
+			old = &PeerAddress{}
+			if err := json.Unmarshal(val, old); err != nil {
+				return err
+			}
+		}
+		val, err := json.Marshal(mergePeerAddress(old, addr, time))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(addr), val)
+	})
+}
+
+func (self *BoltNodeStore) ListPeerAddresses(id string) ([]*PeerAddress, error) {
+	var res []*PeerAddress
+	err := self.view(func(root *bolt.Bucket) error {
+		pb := root.Bucket(peerBucketName)
+		if pb == nil {
+			return nil
+		}
+		b := pb.Bucket([]byte(id))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			addr := &PeerAddress{}
+			if err := json.Unmarshal(v, addr); err != nil {
+				return err
+			}
+			res = append(res, addr)
+			return nil
+		})
+	})
+	sortPeerAddresses(res)
+	return res, err
+}
+
+func (self *MemNodeStore) RecordPeerAddress(id string, addr string, time uint64) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	addrs := self.peers[id]
+	if addrs == nil {
+		addrs = make(map[string]PeerAddress)
+		self.peers[id] = addrs
+	}
+	var old *PeerAddress
+	if val, ok := addrs[addr]; ok {
+		old = &val
+	}
+	addrs[addr] = *mergePeerAddress(old, addr, time)
+	return nil
+}
+
+func (self *MemNodeStore) ListPeerAddresses(id string) ([]*PeerAddress, error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	var res []*PeerAddress
+	for _, addr := range self.peers[id] {
+		copied := addr
+		res = append(res, &copied)
+	}
+	sortPeerAddresses(res)
+	return res, nil
+}
+
+func (self *WriteBehindStore) RecordPeerAddress(id string, addr string, time uint64) error {
+	return self.store.RecordPeerAddress(id, addr, time)
+}
+
+func (self *WriteBehindStore) ListPeerAddresses(id string) ([]*PeerAddress, error) {
+	return self.store.ListPeerAddresses(id)
+}
@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPeerAddresses(t *testing.T) {
+	for _, impl := range testStores {
+		t.Run(impl.name, func(t *testing.T) {
+			store, closeStore := impl.open(t)
+			defer closeStore()
+
+			seen := []struct {
+				addr string
+				time uint64
+			}{
+				{"1.1.1.1:1", 20},
+				{"2.2.2.2:2", 30},
+				{"1.1.1.1:1", 10},
+				{"1.1.1.1:1", 40},
+			}
+			for _, s := range seen {
+				if err := store.RecordPeerAddress("abcd", s.addr, s.time); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want := []*PeerAddress{
+				{Addr: "1.1.1.1:1", FirstSeenTime: 10, LastSeenTime: 40},
+				{Addr: "2.2.2.2:2", FirstSeenTime: 30, LastSeenTime: 30},
+			}
+			if addrs, err := store.ListPeerAddresses("abcd"); err != nil || !reflect.DeepEqual(addrs, want) {
+				t.Errorf("peer addresses = %v (%v), want %v", addrs, err, want)
+			}
+			if addrs, err := store.ListPeerAddresses("ef01"); err != nil || len(addrs) != 0 {
+				t.Errorf("addresses of an unknown peer = %v (%v)", addrs, err)
+			}
+		})
+	}
+}
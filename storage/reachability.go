@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"net"
+	"time"
+
+	"github.com/ontio/ontology/common/log"
+)
+
+// The reachability of a node, "" until it is first classified.
+const (
+	// REACHABILITY_ADVERTISED nodes were only heard of through addr messages
+	REACHABILITY_ADVERTISED = "advertised"
+	// REACHABILITY_INBOUND nodes connected to us but do not accept connections
+	// on their listen port, usually because they are behind a NAT
+	REACHABILITY_INBOUND = "inbound"
+	// REACHABILITY_DIALABLE nodes accepted a connection on their listen port
+	REACHABILITY_DIALABLE = "dialable"
+)
+
+const (
+	DIAL_BACK_TIMEOUT = 5 * time.Second
+	// DIAL_BACK_INTERVAL is the least time between two dial backs of a node
+	DIAL_BACK_INTERVAL = time.Hour
+	// UNDIALABLE_AFTER is how long the probes of a dialable node must all fail
+	// before it is no longer classified dialable
+	UNDIALABLE_AFTER = 6 * time.Hour
+)
+
+// setReachability classifies node as reachability at now (in ms).
+func setReachability(node *NodeInfo, reachability string, now uint64) {
+	node.Reachability = reachability
+	node.ReachabilityTime = now
+}
+
+// initReachability classifies a node stored before the reachability from
+// whether it accepted the last connection, and reports whether it changed.
+func initReachability(node *NodeInfo) bool {
+	if node.Reachability != "" {
+		return false
+	}
+	if node.CanConnect {
+		node.Reachability = REACHABILITY_DIALABLE
+	} else {
+		node.Reachability = REACHABILITY_ADVERTISED
+	}
+	return true
+}
+
+// DialBack checks whether the node of addr, which connected to us, listens on
+// its advertised address. Nodes already dialable or dialed back recently are
+// skipped.
+func DialBack(store NodeStore, addr string) {
+	node, err := store.GetNode(addr)
+	if err != nil {
+		return
+	}
+	now := NowInMs()
+	if node.Reachability == REACHABILITY_DIALABLE ||
+		node.ReachabilityTime >= msBefore(now, DIAL_BACK_INTERVAL) {
+		return
+	}
+
+	reachability := REACHABILITY_DIALABLE
+	conn, err := net.DialTimeout("tcp", addr, DIAL_BACK_TIMEOUT)
+	if err != nil {
+		log.Debugf("dial back %s failed: %s", addr, err)
+		reachability = REACHABILITY_INBOUND
+	} else {
+		_ = conn.Close()
+	}
+
+	err = store.UpdateNode(addr, func(old *NodeInfo) (*NodeInfo, error) {
+		if old == nil || old.Reachability == REACHABILITY_DIALABLE {
+			return nil, nil
+		}
+		setReachability(old, reachability, NowInMs())
+		return old, nil
+	})
+	if err != nil {
+		log.Error("update reachability error", addr, err)
+	}
+}
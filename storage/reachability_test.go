@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestProbeReachability(t *testing.T) {
+	hour := uint64(time.Hour / time.Millisecond)
+	now := 1000 * hour
+	failed := []*ProbeSlot{{Time: probeSlotTime(now - 7*hour), Failures: 1}, {Time: probeSlotTime(now), Failures: 1}}
+	tests := []struct {
+		name    string
+		node    NodeInfo
+		slots   []*ProbeSlot
+		success bool
+		want    string
+	}{
+		{"unclassified dialed", NodeInfo{}, nil, true, REACHABILITY_DIALABLE},
+		{"unclassified failed", NodeInfo{}, failed, false, REACHABILITY_ADVERTISED},
+		{"inbound dialed", NodeInfo{Reachability: REACHABILITY_INBOUND}, nil, true, REACHABILITY_DIALABLE},
+		{"inbound failed", NodeInfo{Reachability: REACHABILITY_INBOUND}, failed, false, REACHABILITY_INBOUND},
+		{"dialable failing for long", NodeInfo{Reachability: REACHABILITY_DIALABLE, ReachabilityTime: now - 8*hour},
+			failed, false, REACHABILITY_ADVERTISED},
+		{"dialable failing recently", NodeInfo{Reachability: REACHABILITY_DIALABLE, ReachabilityTime: now - 8*hour},
+			[]*ProbeSlot{{Time: probeSlotTime(now - hour), Successes: 1}, {Time: probeSlotTime(now), Failures: 1}},
+			false, REACHABILITY_DIALABLE},
+		{"dialable recently", NodeInfo{Reachability: REACHABILITY_DIALABLE, ReachabilityTime: now - hour},
+			failed, false, REACHABILITY_DIALABLE},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := test.node
+			applyProbe(&node, test.slots, now, test.success)
+			if node.Reachability != test.want {
+				t.Errorf("reachability = %q, want %q", node.Reachability, test.want)
+			}
+		})
+	}
+}
+
+func TestDialBack(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	listening := listener.Addr().(*net.TCPAddr).Port
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	notListening := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	store := NewMemNodeStore()
+	for _, port := range []int{listening, notListening} {
+		if err := store.PutNode(&NodeInfo{Ip: "127.0.0.1", Port: port, Reachability: REACHABILITY_ADVERTISED}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for port, want := range map[int]string{listening: REACHABILITY_DIALABLE, notListening: REACHABILITY_INBOUND} {
+		addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+		DialBack(store, addr)
+		node, err := store.GetNode(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node.Reachability != want || node.ReachabilityTime == 0 {
+			t.Errorf("%s dialed back as %q at %d, want %q", addr, node.Reachability, node.ReachabilityTime, want)
+		}
+	}
+
+	// a node dialed back recently is left alone
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(notListening))
+	inbound, _ := store.GetNode(addr)
+	DialBack(store, addr)
+	if node, _ := store.GetNode(addr); node.ReachabilityTime != inbound.ReachabilityTime {
+		t.Errorf("node dialed back again at %d", node.ReachabilityTime)
+	}
+}
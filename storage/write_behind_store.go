@@ -0,0 +1,507 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ontio/ontology/common/log"
+)
+
+type WriteBehindConfig struct {
+	FlushInterval time.Duration
+	// MaxPending bounds the buffered nodes, observations, connection attempts
+	// and probes, writers reaching
+	// it flush synchronously. The writes of a failed flush are buffered again
+	// up to MaxPending, the others are dropped.
+	MaxPending int
+}
+
+func DefaultWriteBehindConfig() WriteBehindConfig {
+	return WriteBehindConfig{
+		FlushInterval: time.Second,
+		MaxPending:    10000,
+	}
+}
+
+type WriteBehindStats struct {
+	Pending      int    `json:"pending"`
+	Updates      uint64 `json:"updates"`
+	Coalesced    uint64 `json:"coalesced"`
+	Flushes      uint64 `json:"flushes"`
+	FlushedNodes uint64 `json:"flushed_nodes"`
+	FlushErrors  uint64 `json:"flush_errors"`
+	// Stalls counts the writers blocked on a synchronous flush
+	Stalls uint64 `json:"stalls"`
+	// Dropped counts the writes of failed flushes not buffered again
+	Dropped uint64 `json:"dropped"`
+}
+
+// WriteBehindStore buffers the node updates, observations, connection attempts
+// and probes of an underlying NodeStore in memory, merging the updates of a
+// same address, and writes them in a single batch every FlushInterval. Reads
+// see the buffered updates.
+type WriteBehindStore struct {
+	store  NodeStore
+	config WriteBehindConfig
+
+	lock            sync.Mutex
+	pending         map[string]*NodeInfo
+	pendingObs      map[string][]*Observation
+	pendingAttempts map[string][]*ConnectAttempt
+	pendingProbes   map[string][]*Probe
+	pendingCount    int
+	generation      uint64
+	// flushing holds the nodes being written, until the batch is committed
+	flushing map[string]*NodeInfo
+	// writes counts the flushes and deletes started, writing tells if one runs
+	writes  uint64
+	writing bool
+	stats   WriteBehindStats
+
+	flushLock sync.Mutex // serializes flushes and deletes
+	quit      chan bool
+	done      chan bool
+}
+
+func NewWriteBehindStore(store NodeStore, config WriteBehindConfig) *WriteBehindStore {
+	self := &WriteBehindStore{
+		store:           store,
+		config:          config,
+		pending:         make(map[string]*NodeInfo),
+		pendingObs:      make(map[string][]*Observation),
+		pendingAttempts: make(map[string][]*ConnectAttempt),
+		pendingProbes:   make(map[string][]*Probe),
+		flushing:        make(map[string]*NodeInfo),
+		quit:            make(chan bool),
+		done:            make(chan bool),
+	}
+	go self.flushService()
+	return self
+}
+
+func (self *WriteBehindStore) flushService() {
+	defer close(self.done)
+	t := time.NewTicker(self.config.FlushInterval)
+	for {
+		select {
+		case <-t.C:
+			self.Flush()
+		case <-self.quit:
+			t.Stop()
+			return
+		}
+	}
+}
+
+// Close flushes the buffered writes before closing the underlying store.
+func (self *WriteBehindStore) Close() error {
+	close(self.quit)
+	<-self.done
+	if err := self.Flush(); err != nil {
+		log.Error("flush node store on close error", err)
+	}
+	return self.store.Close()
+}
+
+func (self *WriteBehindStore) Stats() WriteBehindStats {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	stats := self.stats
+	stats.Pending = self.pendingCount
+	return stats
+}
+
+// Flush writes the buffered updates to the underlying store.
+func (self *WriteBehindStore) Flush() error {
+	self.flushLock.Lock()
+	defer self.flushLock.Unlock()
+
+	self.lock.Lock()
+	if self.pendingCount == 0 {
+		self.lock.Unlock()
+		return nil
+	}
+	batch := &NodeBatch{
+		Nodes:        make([]*NodeInfo, 0, len(self.pending)),
+		Observations: self.pendingObs,
+		Attempts:     self.pendingAttempts,
+		Probes:       self.pendingProbes,
+	}
+	for addr, node := range self.pending {
+		batch.Nodes = append(batch.Nodes, node)
+		self.flushing[addr] = node
+	}
+	self.pending = make(map[string]*NodeInfo)
+	self.pendingObs = make(map[string][]*Observation)
+	self.pendingAttempts = make(map[string][]*ConnectAttempt)
+	self.pendingProbes = make(map[string][]*Probe)
+	self.pendingCount = 0
+	self.beginWrite()
+	self.lock.Unlock()
+
+	err := self.store.WriteBatch(batch)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.writing = false
+	self.stats.Flushes++
+	if err != nil {
+		self.stats.FlushErrors++
+		self.requeue(batch)
+	} else {
+		self.stats.FlushedNodes += uint64(len(batch.Nodes))
+	}
+	self.flushing = make(map[string]*NodeInfo)
+	return err
+}
+
+// requeue buffers again the writes of the failed batch, as room allows, but
+// the nodes updated since. Must hold lock.
+func (self *WriteBehindStore) requeue(batch *NodeBatch) {
+	dropped := self.stats.Dropped
+	for _, node := range batch.Nodes {
+		addr := node.RemoteListenAddress()
+		if _, ok := self.pending[addr]; !ok && self.room(1) == 1 {
+			self.pending[addr] = node
+		}
+	}
+	// the latest writes are kept
+	for addr, history := range batch.Observations {
+		if n := self.room(len(history)); n != 0 {
+			self.pendingObs[addr] = append(history[len(history)-n:], self.pendingObs[addr]...)
+		}
+	}
+	for addr, attempts := range batch.Attempts {
+		if n := self.room(len(attempts)); n != 0 {
+			self.pendingAttempts[addr] = append(attempts[len(attempts)-n:], self.pendingAttempts[addr]...)
+		}
+	}
+	for addr, probes := range batch.Probes {
+		if n := self.room(len(probes)); n != 0 {
+			self.pendingProbes[addr] = append(probes[len(probes)-n:], self.pendingProbes[addr]...)
+		}
+	}
+	if self.stats.Dropped != dropped {
+		log.Errorf("node store buffer full, dropped %d writes", self.stats.Dropped-dropped)
+	}
+}
+
+// room reserves the buffer for up to n writes, and returns how many fit. The
+// others are counted as dropped. Must hold lock.
+func (self *WriteBehindStore) room(n int) int {
+	free := self.config.MaxPending - self.pendingCount
+	if free < 0 {
+		free = 0
+	}
+	if n > free {
+		self.stats.Dropped += uint64(n - free)
+		n = free
+	}
+	self.pendingCount += n
+	return n
+}
+
+// beginWrite tells the readers of the underlying store that a flush or delete
+// starts, until endWrite. Must hold flushLock and lock.
+func (self *WriteBehindStore) beginWrite() {
+	self.writes++
+	self.writing = true
+}
+
+// endWrite tells the write started by beginWrite is over. Must hold flushLock.
+func (self *WriteBehindStore) endWrite() {
+	self.lock.Lock()
+	self.writing = false
+	self.lock.Unlock()
+}
+
+// readStore runs read on the underlying store with lock released, after copy
+// took what read needs from the buffer. The buffered writes are neither missing
+// from both nor in both, as copy runs once no flush or delete does and read is
+// run again if one started meanwhile. Must hold lock, held again on return.
+func (self *WriteBehindStore) readStore(copy func(), read func() error) error {
+	for {
+		if self.writing {
+			// wait for the write to be over
+			self.lock.Unlock()
+			self.flushLock.Lock()
+			self.flushLock.Unlock()
+			self.lock.Lock()
+			continue
+		}
+		copy()
+		writes := self.writes
+		self.lock.Unlock()
+		err := read()
+		self.lock.Lock()
+		if err != nil || self.writes == writes {
+			return err
+		}
+	}
+}
+
+// lookup returns the latest known node of addr, nil if none. Must hold lock,
+// which is released while the underlying store is read.
+func (self *WriteBehindStore) lookup(addr string) (*NodeInfo, error) {
+	if node, ok := self.pending[addr]; ok {
+		return node, nil
+	}
+	if node, ok := self.flushing[addr]; ok {
+		return node, nil
+	}
+	var node *NodeInfo
+	err := self.readStore(func() {}, func() error {
+		var err error
+		node, err = self.store.GetNode(addr)
+		if err == ErrNodeNotFound {
+			node, err = nil, nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	// buffered while the store was read
+	if pending, ok := self.pending[addr]; ok {
+		return pending, nil
+	}
+	return node, nil
+}
+
+// buffer queues node, it must not be modified afterwards. Must hold lock.
+func (self *WriteBehindStore) buffer(node *NodeInfo) {
+	addr := node.RemoteListenAddress()
+	self.generation++
+	self.stats.Updates++
+	if _, ok := self.pending[addr]; ok {
+		self.stats.Coalesced++
+	} else {
+		self.pendingCount++
+	}
+	self.pending[addr] = node
+}
+
+// throttle flushes synchronously if the buffer is full.
+func (self *WriteBehindStore) throttle() {
+	self.lock.Lock()
+	full := self.pendingCount >= self.config.MaxPending
+	if full {
+		self.stats.Stalls++
+	}
+	self.lock.Unlock()
+	if full {
+		if err := self.Flush(); err != nil {
+			log.Error("flush node store error", err)
+		}
+	}
+}
+
+func (self *WriteBehindStore) PutNode(node *NodeInfo) error {
+	copied := *node
+	self.lock.Lock()
+	self.buffer(&copied)
+	self.lock.Unlock()
+	self.throttle()
+	return nil
+}
+
+func (self *WriteBehindStore) UpdateNode(addr string, update func(old *NodeInfo) (*NodeInfo, error)) error {
+	self.lock.Lock()
+	old, err := self.lookup(addr)
+	if err != nil {
+		self.lock.Unlock()
+		return err
+	}
+	if old != nil {
+		copied := *old
+		old = &copied
+	}
+	node, err := update(old)
+	if err == nil && node != nil {
+		copied := *node
+		self.buffer(&copied)
+	}
+	self.lock.Unlock()
+	if err != nil || node == nil {
+		return err
+	}
+	self.throttle()
+	return nil
+}
+
+func (self *WriteBehindStore) GetNode(addr string) (*NodeInfo, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	node, err := self.lookup(addr)
+	if err != nil {
+		return nil, err
+	}
+	if node == nil {
+		return nil, ErrNodeNotFound
+	}
+	copied := *node
+	return &copied, nil
+}
+
+// readNodes reads nodes from the underlying store with read, replaces them by
+// their buffered version and adds the buffered nodes matching filter. Must hold
+// lock.
+func (self *WriteBehindStore) readNodes(read func() ([]*NodeInfo, error), filter *NodeFilter) ([]*NodeInfo, error) {
+	var buffered map[string]*NodeInfo
+	var nodes []*NodeInfo
+	err := self.readStore(func() {
+		buffered = make(map[string]*NodeInfo, len(self.pending))
+		for addr, node := range self.pending {
+			buffered[addr] = node
+		}
+	}, func() error {
+		var err error
+		nodes, err = read()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return overlay(nodes, buffered, filter), nil
+}
+
+// overlay replaces nodes by their buffered version and adds the buffered nodes
+// matching filter.
+func overlay(nodes []*NodeInfo, buffered map[string]*NodeInfo, filter *NodeFilter) []*NodeInfo {
+	res := make([]*NodeInfo, 0, len(nodes)+len(buffered))
+	for _, node := range nodes {
+		if _, ok := buffered[node.RemoteListenAddress()]; !ok {
+			res = append(res, node)
+		}
+	}
+	addrs := make([]string, 0, len(buffered))
+	for addr := range buffered {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		if filter.Match(buffered[addr]) {
+			copied := *buffered[addr]
+			res = append(res, &copied)
+		}
+	}
+	return res
+}
+
+func (self *WriteBehindStore) ListNodes() ([]*NodeInfo, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.readNodes(self.store.ListNodes, &NodeFilter{})
+}
+
+func (self *WriteBehindStore) QueryNodes(filter *NodeFilter) ([]*NodeInfo, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.readNodes(func() ([]*NodeInfo, error) { return self.store.QueryNodes(filter) }, filter)
+}
+
+// DeleteNode drops the buffered node, observations, connection attempts and
+// probes of addr, then deletes the node from the underlying store.
+func (self *WriteBehindStore) DeleteNode(addr string) error {
+	self.flushLock.Lock()
+	defer self.flushLock.Unlock()
+	self.lock.Lock()
+	if _, ok := self.pending[addr]; ok {
+		delete(self.pending, addr)
+		self.pendingCount--
+	}
+	self.pendingCount -= len(self.pendingObs[addr]) + len(self.pendingAttempts[addr]) + len(self.pendingProbes[addr])
+	delete(self.pendingObs, addr)
+	delete(self.pendingAttempts, addr)
+	delete(self.pendingProbes, addr)
+	self.generation++
+	self.beginWrite()
+	self.lock.Unlock()
+	err := self.store.DeleteNode(addr)
+	self.endWrite()
+	return err
+}
+
+func (self *WriteBehindStore) WriteBatch(batch *NodeBatch) error {
+	for _, node := range batch.Nodes {
+		if err := self.PutNode(node); err != nil {
+			return err
+		}
+	}
+	for addr, history := range batch.Observations {
+		for _, obs := range history {
+			if err := self.AppendObservation(addr, obs); err != nil {
+				return err
+			}
+		}
+	}
+	for addr, attempts := range batch.Attempts {
+		for _, attempt := range attempts {
+			if err := self.AppendConnectAttempt(addr, attempt); err != nil {
+				return err
+			}
+		}
+	}
+	for addr, probes := range batch.Probes {
+		self.lock.Lock()
+		node, err := self.lookup(addr)
+		self.lock.Unlock()
+		if err != nil {
+			return err
+		}
+		if node == nil {
+			continue
+		}
+		for _, probe := range probes {
+			copied := *probe
+			self.lock.Lock()
+			self.pendingProbes[addr] = append(self.pendingProbes[addr], &copied)
+			self.pendingCount++
+			self.lock.Unlock()
+			self.throttle()
+		}
+	}
+	return nil
+}
+
+func (self *WriteBehindStore) AppendObservation(addr string, obs *Observation) error {
+	copied := *obs
+	self.lock.Lock()
+	self.pendingObs[addr] = append(self.pendingObs[addr], &copied)
+	self.pendingCount++
+	self.lock.Unlock()
+	self.throttle()
+	return nil
+}
+
+// The history is read rarely, so its reads flush the buffer rather than merge it.
+
+func (self *WriteBehindStore) ListObservations(addr string, from, to uint64) ([]*Observation, error) {
+	if err := self.Flush(); err != nil {
+		return nil, err
+	}
+	return self.store.ListObservations(addr, from, to)
+}
+
+func (self *WriteBehindStore) ListObservedAddrs() ([]string, error) {
+	if err := self.Flush(); err != nil {
+		return nil, err
+	}
+	return self.store.ListObservedAddrs()
+}
+
+func (self *WriteBehindStore) DeleteObservations(addr string, times []uint64) error {
+	if err := self.Flush(); err != nil {
+		return err
+	}
+	return self.store.DeleteObservations(addr, times)
+}
+
+func (self *WriteBehindStore) PutCensus(census *Census) error {
+	return self.store.PutCensus(census)
+}
+
+func (self *WriteBehindStore) ListCensus(from, to uint64) ([]*Census, error) {
+	return self.store.ListCensus(from, to)
+}
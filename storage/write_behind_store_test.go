@@ -0,0 +1,335 @@
+package storage
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var errTestWrite = errors.New("test write failure")
+
+// failingStore fails the batches while fail is set, and runs during, if set,
+// as a batch is written.
+type failingStore struct {
+	NodeStore
+	fail   bool
+	during func()
+}
+
+func (self *failingStore) WriteBatch(batch *NodeBatch) error {
+	if self.during != nil {
+		self.during()
+	}
+	if self.fail {
+		return errTestWrite
+	}
+	return self.NodeStore.WriteBatch(batch)
+}
+
+// newTestWriteBehind buffers up to 100 writes to a MemNodeStore until flushed
+// explicitly.
+func newTestWriteBehind() (*WriteBehindStore, *failingStore) {
+	under := &failingStore{NodeStore: NewMemNodeStore()}
+	config := WriteBehindConfig{FlushInterval: time.Hour, MaxPending: 100}
+	return NewWriteBehindStore(under, config), under
+}
+
+func setHeight(height uint64) func(*NodeInfo) (*NodeInfo, error) {
+	return func(old *NodeInfo) (*NodeInfo, error) {
+		if old == nil {
+			old = &NodeInfo{Ip: "1.1.1.1", Port: 1}
+		}
+		old.Height = height
+		return old, nil
+	}
+}
+
+func TestWriteBehindCoalescing(t *testing.T) {
+	tests := []struct {
+		name          string
+		updates       []string // the addresses updated, in order
+		wantPending   int
+		wantCoalesced uint64
+	}{
+		{"single update", []string{"1.1.1.1:1"}, 1, 0},
+		{"same node", []string{"1.1.1.1:1", "1.1.1.1:1", "1.1.1.1:1"}, 1, 2},
+		{"two nodes", []string{"1.1.1.1:1", "2.2.2.2:2", "1.1.1.1:1"}, 2, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store, under := newTestWriteBehind()
+			defer store.Close()
+			for i, addr := range test.updates {
+				ip, port, _ := ParseIpPort(addr)
+				node := &NodeInfo{Ip: ip, Port: port, Height: uint64(i)}
+				if err := store.PutNode(node); err != nil {
+					t.Fatal(err)
+				}
+			}
+			stats := store.Stats()
+			if stats.Pending != test.wantPending || stats.Coalesced != test.wantCoalesced {
+				t.Errorf("pending %d, coalesced %d, want %d and %d", stats.Pending, stats.Coalesced,
+					test.wantPending, test.wantCoalesced)
+			}
+			// the buffered nodes are read before they are flushed
+			last := test.updates[len(test.updates)-1]
+			if node, err := store.GetNode(last); err != nil || node.Height != uint64(len(test.updates)-1) {
+				t.Errorf("buffered node %+v (%v), want the last update", node, err)
+			}
+			if _, err := under.GetNode(last); err != ErrNodeNotFound {
+				t.Errorf("node written before the flush: %v", err)
+			}
+			if err := store.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if node, err := under.GetNode(last); err != nil || node.Height != uint64(len(test.updates)-1) {
+				t.Errorf("flushed node %+v (%v), want the last update", node, err)
+			}
+			if stats := store.Stats(); stats.Pending != 0 || stats.FlushedNodes != uint64(test.wantPending) {
+				t.Errorf("stats after flush %+v, want %d nodes flushed", stats, test.wantPending)
+			}
+		})
+	}
+}
+
+func TestWriteBehindFlushFailure(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxPending   int
+		observations int
+		wantPending  int
+		wantDropped  uint64
+	}{
+		{"requeued", 10, 3, 4, 0},
+		{"over the buffer", 3, 3, 3, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store, under := newTestWriteBehind()
+			defer store.Close()
+			if err := store.UpdateNode("1.1.1.1:1", setHeight(1)); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < test.observations; i++ {
+				obs := &Observation{Time: uint64(i + 1), Height: uint64(i)}
+				if err := store.AppendObservation("1.1.1.1:1", obs); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// the buffer shrinks to maxPending, an update made meanwhile is kept
+			store.config.MaxPending = test.maxPending
+			under.fail = true
+			under.during = func() {
+				under.during = nil
+				store.UpdateNode("1.1.1.1:1", setHeight(2))
+			}
+			if err := store.Flush(); err != errTestWrite {
+				t.Fatalf("flush error %v, want %v", err, errTestWrite)
+			}
+			stats := store.Stats()
+			if stats.Pending != test.wantPending || stats.Dropped != test.wantDropped || stats.FlushErrors != 1 {
+				t.Errorf("stats %+v, want %d pending and %d dropped", stats, test.wantPending, test.wantDropped)
+			}
+
+			under.fail = false
+			if err := store.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if node, err := under.GetNode("1.1.1.1:1"); err != nil || node.Height != 2 {
+				t.Errorf("flushed node %+v (%v), want the update made during the failed flush", node, err)
+			}
+			history, err := under.ListObservations("1.1.1.1:1", 0, NowInMs())
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := test.observations - int(test.wantDropped)
+			if len(history) != want || history[len(history)-1].Time != uint64(test.observations) {
+				t.Errorf("flushed %d observations, want the %d latest", len(history), want)
+			}
+		})
+	}
+}
+
+func TestWriteBehindDelete(t *testing.T) {
+	store, under := newTestWriteBehind()
+	defer store.Close()
+	if err := under.PutNode(&NodeInfo{Ip: "1.1.1.1", Port: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdateNode("1.1.1.1:1", setHeight(5)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AppendObservation("1.1.1.1:1", &Observation{Time: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AppendConnectAttempt("1.1.1.1:1", &ConnectAttempt{Time: 1, Reason: CONNECT_OK}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RecordProbe("1.1.1.1:1", NowInMs(), true); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteNode("1.1.1.1:1"); err != nil {
+		t.Fatal(err)
+	}
+	// the buffered writes of the deleted node are not written back
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := under.GetNode("1.1.1.1:1"); err != ErrNodeNotFound {
+		t.Errorf("deleted node written back: %v", err)
+	}
+	if history, _ := under.ListObservations("1.1.1.1:1", 0, NowInMs()); len(history) != 0 {
+		t.Errorf("observations of the deleted node written back: %d", len(history))
+	}
+	if attempts, _ := under.ListConnectAttempts("1.1.1.1:1", 0, NowInMs()); len(attempts) != 0 {
+		t.Errorf("attempts of the deleted node written back: %d", len(attempts))
+	}
+	if stats := store.Stats(); stats.Pending != 0 {
+		t.Errorf("pending %d after the delete, want 0", stats.Pending)
+	}
+}
+
+func TestWriteBehindReads(t *testing.T) {
+	store, under := newTestWriteBehind()
+	defer store.Close()
+	for _, node := range []*NodeInfo{{Ip: "1.1.1.1", Port: 1, Country: "FR"}, {Ip: "2.2.2.2", Port: 2, Country: "DE"}} {
+		if err := under.PutNode(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the buffered version of a stored node replaces it, a new one is added
+	err := store.UpdateNode("2.2.2.2:2", func(old *NodeInfo) (*NodeInfo, error) {
+		old.Country = "FR"
+		return old, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutNode(&NodeInfo{Ip: "3.3.3.3", Port: 3, Country: "US"}); err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := store.QueryNodes(&NodeFilter{Country: "FR"})
+	if err != nil || !reflect.DeepEqual(nodeAddrs(nodes), []string{"1.1.1.1:1", "2.2.2.2:2"}) {
+		t.Errorf("query = %v (%v), want the stored and the buffered FR nodes", nodeAddrs(nodes), err)
+	}
+	nodes, err = store.ListNodes()
+	if err != nil || !reflect.DeepEqual(nodeAddrs(nodes), []string{"1.1.1.1:1", "2.2.2.2:2", "3.3.3.3:3"}) {
+		t.Errorf("list = %v (%v), want every node once", nodeAddrs(nodes), err)
+	}
+}
+
+func TestWriteBehindProbe(t *testing.T) {
+	store, _ := newTestWriteBehind()
+	defer store.Close()
+	if err := store.UpdateNode("1.1.1.1:1", setHeight(10)); err != nil {
+		t.Fatal(err)
+	}
+	// the probe applies to the buffered node
+	if err := store.RecordProbe("1.1.1.1:1", NowInMs(), true); err != nil {
+		t.Fatal(err)
+	}
+	node, err := store.GetNode("1.1.1.1:1")
+	if err != nil || node.Height != 10 || !reflect.DeepEqual(node.Availability24h, float32Ptr(100)) {
+		t.Errorf("probed node = %+v (%v), want height 10 and 100%% available", node, err)
+	}
+}
+
+func TestWriteBehindAttemptsAndProbes(t *testing.T) {
+	store, under := newTestWriteBehind()
+	defer store.Close()
+	now := NowInMs()
+	if err := store.UpdateNode("1.1.1.1:1", setHeight(10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AppendConnectAttempt("1.1.1.1:1", &ConnectAttempt{Time: now, Reason: CONNECT_OK}); err != nil {
+		t.Fatal(err)
+	}
+	batch := &NodeBatch{Probes: map[string][]*Probe{
+		"1.1.1.1:1": {{Time: now, Success: true}},
+		"2.2.2.2:2": {{Time: now, Success: true}},
+	}}
+	if err := store.WriteBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	// the buffered writes are read back before they are flushed
+	if attempts, err := store.ListConnectAttempts("1.1.1.1:1", 0, now); err != nil || len(attempts) != 1 {
+		t.Errorf("buffered attempts = %v (%v)", attempts, err)
+	}
+	if slots, err := store.ListProbes("1.1.1.1:1", 0, now); err != nil || len(slots) != 1 || slots[0].Successes != 1 {
+		t.Errorf("buffered probe slots = %v (%v)", slots, err)
+	}
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if attempts, err := under.ListConnectAttempts("1.1.1.1:1", 0, now); err != nil || len(attempts) != 1 {
+		t.Errorf("flushed attempts = %v (%v)", attempts, err)
+	}
+	// the probes of unknown addresses are dropped
+	if addrs, err := under.ListProbedAddrs(); err != nil || !reflect.DeepEqual(addrs, []string{"1.1.1.1:1"}) {
+		t.Errorf("flushed probed addrs = %v (%v)", addrs, err)
+	}
+}
+
+func TestWriteBehindBatchThrottle(t *testing.T) {
+	store, under := newTestWriteBehind()
+	defer store.Close()
+	store.config.MaxPending = 3
+	if err := under.PutNode(&NodeInfo{Ip: "1.1.1.1", Port: 1}); err != nil {
+		t.Fatal(err)
+	}
+	var probes []*Probe
+	for i := 0; i < 5; i++ {
+		probes = append(probes, &Probe{Time: uint64(i), Success: true})
+	}
+	if err := store.WriteBatch(&NodeBatch{Probes: map[string][]*Probe{"1.1.1.1:1": probes}}); err != nil {
+		t.Fatal(err)
+	}
+	// the probes reaching the buffer size are flushed
+	if stats := store.Stats(); stats.Pending != 2 || stats.Stalls != 1 {
+		t.Errorf("stats %+v, want 2 pending after a stall", stats)
+	}
+}
+
+// slowStore blocks its ListNodes until release is closed.
+type slowStore struct {
+	NodeStore
+	reading chan bool
+	release chan bool
+}
+
+func (self *slowStore) ListNodes() ([]*NodeInfo, error) {
+	close(self.reading)
+	<-self.release
+	return self.NodeStore.ListNodes()
+}
+
+func TestWriteBehindReadNotBlocking(t *testing.T) {
+	under := &slowStore{NodeStore: NewMemNodeStore(), reading: make(chan bool), release: make(chan bool)}
+	store := NewWriteBehindStore(under, WriteBehindConfig{FlushInterval: time.Hour, MaxPending: 100})
+	defer store.Close()
+	if err := store.PutNode(&NodeInfo{Ip: "1.1.1.1", Port: 1}); err != nil {
+		t.Fatal(err)
+	}
+	listed := make(chan []*NodeInfo)
+	go func() {
+		nodes, err := store.ListNodes()
+		if err != nil {
+			t.Error(err)
+		}
+		listed <- nodes
+	}()
+	<-under.reading
+	// the nodes are written while the underlying store is read
+	if err := store.UpdateNode("1.1.1.1:1", setHeight(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutNode(&NodeInfo{Ip: "2.2.2.2", Port: 2}); err != nil {
+		t.Fatal(err)
+	}
+	close(under.release)
+	if nodes := <-listed; !reflect.DeepEqual(nodeAddrs(nodes), []string{"1.1.1.1:1"}) {
+		t.Errorf("listed %v, want the nodes buffered before the read", nodeAddrs(nodes))
+	}
+}
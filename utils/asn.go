@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AsnInfo is the autonomous system announcing an ip.
+type AsnInfo struct {
+	Number uint64 `json:"asn"`
+	Org    string `json:"as_org"`
+	// Hosting tells whether the organization is a hosting or cloud provider
+	Hosting bool `json:"is_hosting"`
+}
+
+// hostingOrgs are lower case parts of the AS organization names of the hosting
+// and cloud providers.
+var hostingOrgs = []string{
+	"akamai", "alibaba", "amazon", "aruba", "baidu", "choopa", "cloudflare", "contabo", "digitalocean",
+	"equinix", "google", "hetzner", "hostinger", "hostwinds", "huawei", "ionos", "kamatera", "leaseweb",
+	"linode", "m247", "microsoft", "naver", "netcup", "oracle", "ovh", "psychz", "rackspace", "scaleway",
+	"servers.com", "softlayer", "tencent", "ucloud", "upcloud", "vultr",
+}
+
+// IsHostingOrg reports whether org names a known hosting or cloud provider.
+func IsHostingOrg(org string) bool {
+	org = strings.ToLower(org)
+	for _, name := range hostingOrgs {
+		if strings.Contains(org, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// asnRecord is the record of the MaxMind and DB-IP ASN databases.
+type asnRecord struct {
+	Number uint64 `maxminddb:"autonomous_system_number"`
+	Org    string `maxminddb:"autonomous_system_organization"`
+}
+
+// AsnDb looks up the ips in a local MaxMind or DB-IP ASN database, reopened
+// when the file is replaced.
+type AsnDb struct {
+	db *mmdbFile
+}
+
+func NewAsnDb(file string) (*AsnDb, error) {
+	db, err := openMmdbFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return &AsnDb{db: db}, nil
+}
+
+func (self *AsnDb) Lookup(ip string) (*AsnInfo, error) {
+	var record asnRecord
+	if err := self.db.lookup(ip, &record); err != nil {
+		return nil, err
+	}
+	if record.Number == 0 {
+		return nil, fmt.Errorf("ip %s not found in %s", ip, self.db.file)
+	}
+	return &AsnInfo{Number: record.Number, Org: record.Org, Hosting: IsHostingOrg(record.Org)}, nil
+}
+
+func (self *AsnDb) Close() error {
+	return self.db.Close()
+}
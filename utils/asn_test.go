@@ -0,0 +1,26 @@
+package utils
+
+import "testing"
+
+func TestIsHostingOrg(t *testing.T) {
+	tests := []struct {
+		org  string
+		want bool
+	}{
+		{"OVH SAS", true},
+		{"AMAZON-02", true},
+		{"Hetzner Online GmbH", true},
+		{"DIGITALOCEAN-ASN", true},
+		{"Orange", false},
+		{"Comcast Cable Communications, LLC", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := IsHostingOrg(test.org); got != test.want {
+			t.Errorf("IsHostingOrg(%q) = %v, want %v", test.org, got, test.want)
+		}
+	}
+	if _, err := NewAsnDb("/nonexistent.mmdb"); err == nil {
+		t.Errorf("asn db opened from a missing file")
+	}
+}
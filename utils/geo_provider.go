@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The geo providers selectable by name.
+const (
+	GEO_PROVIDER_MMDB   = "mmdb"
+	GEO_PROVIDER_IP_API = "ip-api"
+)
+
+// GeoProvider resolves the location of an ip.
+type GeoProvider interface {
+	Lookup(ip string) (*GeoLocation, error)
+	Close() error
+}
+
+// NewGeoProvider builds the providers of the comma separated names, tried in
+// order until one succeeds. dbFile is the database of the mmdb provider, and
+// limit spaces the lookups of the remote ones, ip-api.
+func NewGeoProvider(names string, dbFile string, limit *RateLimit) (GeoProvider, error) {
+	var providers []GeoProvider
+	closeAll := func() {
+		for _, provider := range providers {
+			_ = provider.Close()
+		}
+	}
+	for _, name := range strings.Split(names, ",") {
+		switch strings.TrimSpace(name) {
+		case GEO_PROVIDER_MMDB:
+			if dbFile == "" {
+				closeAll()
+				return nil, errors.New("mmdb geo provider needs a database file")
+			}
+			provider, err := NewMmdbProvider(dbFile)
+			if err != nil {
+				closeAll()
+				return nil, err
+			}
+			providers = append(providers, provider)
+		case GEO_PROVIDER_IP_API:
+			providers = append(providers, NewIpApiProvider(limit))
+		default:
+			closeAll()
+			return nil, fmt.Errorf("unknown geo provider %q", name)
+		}
+	}
+	if len(providers) == 1 {
+		return providers[0], nil
+	}
+	return &fallbackProvider{providers: providers}, nil
+}
+
+// fallbackProvider returns the location found by the first provider that
+// succeeds, or the ErrReservedIp or ErrRateLimitStopped of any.
+type fallbackProvider struct {
+	providers []GeoProvider
+}
+
+func (self *fallbackProvider) Lookup(ip string) (*GeoLocation, error) {
+	var errs []string
+	for _, provider := range self.providers {
+		location, err := provider.Lookup(ip)
+		if err == nil || err == ErrReservedIp || err == ErrRateLimitStopped {
+			return location, err
+		}
+		errs = append(errs, err.Error())
+	}
+	return nil, fmt.Errorf("lookup %s: %s", ip, strings.Join(errs, "; "))
+}
+
+func (self *fallbackProvider) Close() error {
+	var err error
+	for _, provider := range self.providers {
+		if e := provider.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
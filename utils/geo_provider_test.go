@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type fakeProvider struct {
+	location *GeoLocation
+	err      error
+	lookups  int
+	closed   bool
+}
+
+func (self *fakeProvider) Lookup(ip string) (*GeoLocation, error) {
+	self.lookups++
+	return self.location, self.err
+}
+
+func (self *fakeProvider) Close() error {
+	self.closed = true
+	return nil
+}
+
+func TestNewGeoProvider(t *testing.T) {
+	if provider, err := NewGeoProvider(GEO_PROVIDER_IP_API, "", nil); err != nil {
+		t.Fatal(err)
+	} else if _, ok := provider.(*IpApiProvider); !ok {
+		t.Errorf("ip-api provider is a %T", provider)
+	}
+	for _, names := range []string{"mmdb", "ip-api,nowhere", "mmdb,ip-api"} {
+		if _, err := NewGeoProvider(names, "", nil); err == nil {
+			t.Errorf("provider %q built without a database", names)
+		}
+	}
+	if _, err := NewGeoProvider(GEO_PROVIDER_MMDB, "/nonexistent.mmdb", nil); err == nil {
+		t.Errorf("mmdb provider built from a missing database")
+	}
+}
+
+func TestFallbackProvider(t *testing.T) {
+	location := &GeoLocation{Lat: 1, Lon: 2, Country: "France"}
+	failing := &fakeProvider{err: errors.New("not found")}
+	found := &fakeProvider{location: location}
+	unused := &fakeProvider{err: errors.New("unused")}
+	provider := &fallbackProvider{providers: []GeoProvider{failing, found, unused}}
+
+	got, err := provider.Lookup("1.1.1.1")
+	if err != nil || !reflect.DeepEqual(got, location) {
+		t.Errorf("lookup = %+v (%v), want %+v", got, err, location)
+	}
+	if failing.lookups != 1 || unused.lookups != 0 {
+		t.Errorf("providers looked up %d and %d times, want 1 and 0", failing.lookups, unused.lookups)
+	}
+
+	provider = &fallbackProvider{providers: []GeoProvider{failing, unused}}
+	if _, err := provider.Lookup("1.1.1.1"); err == nil {
+		t.Errorf("lookup succeeded with failing providers")
+	}
+	// a stopped rate limit is not worth trying the next providers
+	stopped := &fakeProvider{err: ErrRateLimitStopped}
+	provider = &fallbackProvider{providers: []GeoProvider{stopped, found}}
+	if _, err := provider.Lookup("1.1.1.1"); err != ErrRateLimitStopped || found.lookups != 1 {
+		t.Errorf("lookup = %v after a stopped rate limit, %d lookups", err, found.lookups)
+	}
+
+	provider = &fallbackProvider{providers: []GeoProvider{failing, unused}}
+	if err := provider.Close(); err != nil || !failing.closed || !unused.closed {
+		t.Errorf("close = %v, closed %v and %v", err, failing.closed, unused.closed)
+	}
+}
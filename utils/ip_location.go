@@ -1,23 +1,67 @@
 package utils
 
 import (
+	"errors"
+	"fmt"
+
 	"github.com/imroc/req"
-	"github.com/ontio/ontology/common/log"
 )
 
+const IP_API_URL = "http://ip-api.com/json/"
+
+// IP_API_RATE is the default max lookups per minute on ip-api, which allows 45
+const IP_API_RATE = 40
+
 type GeoLocation struct {
 	Lat     float32 `json:"lat"`
 	Lon     float32 `json:"lon"`
 	Country string  `json:"country"`
 }
 
-func GetIpLocation(ip string) *GeoLocation {
-	r, err := req.Get("http://ip-api.com/json/" + ip)
+// ErrReservedIp is returned by the providers for the ips of private or
+// reserved ranges, which have no location.
+var ErrReservedIp = errors.New("private or reserved ip")
+
+type ipApiResponse struct {
+	GeoLocation
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// IpApiProvider looks up the ips on ip-api.com.
+type IpApiProvider struct {
+	limit *RateLimit
+}
+
+// NewIpApiProvider spaces the lookups by limit, nil for none.
+func NewIpApiProvider(limit *RateLimit) *IpApiProvider {
+	return &IpApiProvider{limit: limit}
+}
+
+func (self *IpApiProvider) Lookup(ip string) (*GeoLocation, error) {
+	if self.limit != nil {
+		if err := self.limit.Wait(); err != nil {
+			return nil, err
+		}
+	}
+	r, err := req.Get(IP_API_URL + ip)
 	if err != nil {
-		log.Error("fetch ip location from remote error " + err.Error())
-		return nil
+		return nil, err
+	}
+	var resp ipApiResponse
+	if err := r.ToJSON(&resp); err != nil {
+		return nil, fmt.Errorf("decode ip-api response: %s", err)
 	}
-	var location GeoLocation
-	_ = r.ToJSON(&location)
-	return &location
+	if resp.Status != "success" {
+		switch resp.Message {
+		case "private range", "reserved range":
+			return nil, ErrReservedIp
+		}
+		return nil, fmt.Errorf("ip-api lookup of %s failed: %s", ip, resp.Message)
+	}
+	return &resp.GeoLocation, nil
+}
+
+func (self *IpApiProvider) Close() error {
+	return nil
 }
@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ontio/ontology/common/log"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// MMDB_RELOAD_INTERVAL is how often the database files are checked for replacement
+const MMDB_RELOAD_INTERVAL = time.Minute
+
+// mmdbFile is a MaxMind format database, reopened when the file is replaced.
+type mmdbFile struct {
+	file    string
+	lock    sync.RWMutex
+	reader  *maxminddb.Reader
+	modTime time.Time
+	size    int64
+	quit    chan bool
+}
+
+func openMmdbFile(file string) (*mmdbFile, error) {
+	self := &mmdbFile{file: file, quit: make(chan bool)}
+	if err := self.reload(); err != nil {
+		return nil, err
+	}
+	go self.reloadService()
+	return self, nil
+}
+
+// lookup decodes the record of ip into result.
+func (self *mmdbFile) lookup(ip string, result interface{}) error {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return fmt.Errorf("invalid ip %q", ip)
+	}
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.reader.Lookup(parsed, result)
+}
+
+func (self *mmdbFile) Close() error {
+	close(self.quit)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.reader.Close()
+}
+
+func (self *mmdbFile) reloadService() {
+	t := time.NewTicker(MMDB_RELOAD_INTERVAL)
+	for {
+		select {
+		case <-t.C:
+			if err := self.reload(); err != nil {
+				log.Errorf("reload database %s error: %s", self.file, err)
+			}
+		case <-self.quit:
+			t.Stop()
+			return
+		}
+	}
+}
+
+// reload opens the database file if it changed since it was last opened.
+func (self *mmdbFile) reload() error {
+	info, err := os.Stat(self.file)
+	if err != nil {
+		return err
+	}
+	self.lock.RLock()
+	unchanged := self.reader != nil && info.ModTime().Equal(self.modTime) && info.Size() == self.size
+	self.lock.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	reader, err := maxminddb.Open(self.file)
+	if err != nil {
+		return fmt.Errorf("open database %s: %s", self.file, err)
+	}
+	self.lock.Lock()
+	select {
+	case <-self.quit:
+		self.lock.Unlock()
+		return reader.Close()
+	default:
+	}
+	old := self.reader
+	self.reader, self.modTime, self.size = reader, info.ModTime(), info.Size()
+	self.lock.Unlock()
+	if old != nil {
+		_ = old.Close()
+		log.Infof("database %s reloaded", self.file)
+	}
+	return nil
+}
+
+// mmdbRecord is the part of the MaxMind and DB-IP city records we use.
+type mmdbRecord struct {
+	Country struct {
+		IsoCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	Location struct {
+		Latitude  float64 `maxminddb:"latitude"`
+		Longitude float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+}
+
+// MmdbProvider looks up the ips in a local MaxMind or DB-IP city database,
+// reopened when the file is replaced.
+type MmdbProvider struct {
+	db *mmdbFile
+}
+
+func NewMmdbProvider(file string) (*MmdbProvider, error) {
+	db, err := openMmdbFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return &MmdbProvider{db: db}, nil
+}
+
+func (self *MmdbProvider) Lookup(ip string) (*GeoLocation, error) {
+	var record mmdbRecord
+	if err := self.db.lookup(ip, &record); err != nil {
+		return nil, err
+	}
+	if record.Country.IsoCode == "" && record.Location.Latitude == 0 && record.Location.Longitude == 0 {
+		return nil, fmt.Errorf("ip %s not found in %s", ip, self.db.file)
+	}
+	country := record.Country.Names["en"]
+	if country == "" {
+		country = record.Country.IsoCode
+	}
+	return &GeoLocation{
+		Lat:     float32(record.Location.Latitude),
+		Lon:     float32(record.Location.Longitude),
+		Country: country,
+	}, nil
+}
+
+func (self *MmdbProvider) Close() error {
+	return self.db.Close()
+}
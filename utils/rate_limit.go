@@ -0,0 +1,39 @@
+package utils
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrRateLimitStopped aborts the requests waiting for a stopped RateLimit.
+var ErrRateLimitStopped = errors.New("rate limit stopped")
+
+// RateLimit spaces the requests to a remote service.
+type RateLimit struct {
+	ticker *time.Ticker
+	quit   chan bool
+}
+
+// NewRateLimit allows perMinute requests per minute, which must be positive.
+func NewRateLimit(perMinute int) *RateLimit {
+	return &RateLimit{
+		ticker: time.NewTicker(time.Minute / time.Duration(perMinute)),
+		quit:   make(chan bool),
+	}
+}
+
+// Wait blocks until the next request is allowed.
+func (self *RateLimit) Wait() error {
+	select {
+	case <-self.ticker.C:
+		return nil
+	case <-self.quit:
+		return ErrRateLimitStopped
+	}
+}
+
+// Stop fails the waiting and the following requests.
+func (self *RateLimit) Stop() {
+	close(self.quit)
+	self.ticker.Stop()
+}
@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	limit := NewRateLimit(int(time.Minute / (20 * time.Millisecond)))
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := limit.Wait(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("3 requests allowed in %s", elapsed)
+	}
+
+	waiting := make(chan error)
+	go func() {
+		waiting <- limit.Wait()
+	}()
+	limit.Stop()
+	select {
+	case err := <-waiting:
+		// the tick may have come first
+		if err != nil && err != ErrRateLimitStopped {
+			t.Errorf("wait = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("wait not aborted by stop")
+	}
+	// a tick may still be buffered
+	err := limit.Wait()
+	if err == nil {
+		err = limit.Wait()
+	}
+	if err != ErrRateLimitStopped {
+		t.Errorf("wait after stop = %v, want %v", err, ErrRateLimitStopped)
+	}
+}
@@ -0,0 +1,51 @@
+package utils
+
+import "net"
+
+// reservedNets are the ranges of the ips that have no geo location.
+var reservedNets = parseCIDRs(
+	"0.0.0.0/8",      // this network
+	"10.0.0.0/8",     // RFC1918
+	"100.64.0.0/10",  // carrier-grade NAT
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link local
+	"172.16.0.0/12",  // RFC1918
+	"192.168.0.0/16", // RFC1918
+	"224.0.0.0/4",    // multicast
+	"240.0.0.0/4",    // reserved
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"fc00::/7",       // unique local
+	"fe80::/10",      // link local
+	"ff00::/8",       // multicast
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	res := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		res = append(res, ipNet)
+	}
+	return res
+}
+
+// IsReservedIp reports whether ip is a private, loopback, carrier-grade NAT or
+// otherwise reserved address, or is not an ip at all.
+func IsReservedIp(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return true
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		parsed = v4
+	}
+	for _, ipNet := range reservedNets {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
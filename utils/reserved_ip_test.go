@@ -0,0 +1,33 @@
+package utils
+
+import "testing"
+
+func TestIsReservedIp(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"1.1.1.1", false},
+		{"8.8.8.8", false},
+		{"10.1.2.3", true},
+		{"100.64.0.1", true},
+		{"100.128.0.1", false},
+		{"127.0.0.1", true},
+		{"172.16.5.4", true},
+		{"172.32.0.1", false},
+		{"192.168.0.1", true},
+		{"169.254.1.1", true},
+		{"224.0.0.1", true},
+		{"::ffff:192.168.0.1", true},
+		{"2001:db8::1", false},
+		{"::1", true},
+		{"fd00::1", true},
+		{"fe80::1", true},
+		{"not an ip", true},
+	}
+	for _, test := range tests {
+		if got := IsReservedIp(test.ip); got != test.want {
+			t.Errorf("IsReservedIp(%q) = %v, want %v", test.ip, got, test.want)
+		}
+	}
+}
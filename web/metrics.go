@@ -0,0 +1,70 @@
+package web
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"map/metrics"
+	"map/storage"
+)
+
+// networkCollector exposes the NetworkStats of the crawled network, cached
+// until its nodes change.
+type networkCollector struct {
+	stores    *storage.NetworkStores
+	nodes     *prometheus.Desc
+	reachable *prometheus.Desc
+	consensus *prometheus.Desc
+	versions  *prometheus.Desc
+	countries *prometheus.Desc
+	maxHeight *prometheus.Desc
+}
+
+// RegisterNetworkMetrics exposes the stats of the networks of stores on
+// /metrics, once per process.
+func RegisterNetworkMetrics(stores *storage.NetworkStores) {
+	prometheus.MustRegister(newNetworkCollector(stores))
+}
+
+func newNetworkCollector(stores *storage.NetworkStores) *networkCollector {
+	desc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(metrics.NAMESPACE, "network", name), help, labels, nil)
+	}
+	return &networkCollector{
+		stores:    stores,
+		nodes:     desc("nodes", "Known nodes, the tombstoned ones excluded."),
+		reachable: desc("reachable_nodes", "Known nodes accepting connections."),
+		consensus: desc("consensus_nodes", "Known consensus nodes."),
+		versions:  desc("version_nodes", "Known nodes by software version.", "version"),
+		countries: desc("country_nodes", "Known nodes by country.", "country"),
+		maxHeight: desc("max_height", "Highest block height of the known nodes."),
+	}
+}
+
+func (self *networkCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- self.nodes
+	ch <- self.reachable
+	ch <- self.consensus
+	ch <- self.versions
+	ch <- self.countries
+	ch <- self.maxHeight
+}
+
+func (self *networkCollector) Collect(ch chan<- prometheus.Metric) {
+	stats, err := self.stores.Stats(self.stores.Default)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(self.nodes, err)
+		return
+	}
+	gauge := func(desc *prometheus.Desc, val float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, val, labels...)
+	}
+	gauge(self.nodes, float64(stats.Total))
+	gauge(self.reachable, float64(stats.Reachable))
+	gauge(self.consensus, float64(stats.Consensus))
+	for version, count := range stats.Versions {
+		gauge(self.versions, float64(count), version)
+	}
+	for country, count := range stats.Countries {
+		gauge(self.countries, float64(count), country)
+	}
+	gauge(self.maxHeight, float64(stats.MaxHeight))
+}
@@ -0,0 +1,64 @@
+package web
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"map/storage"
+)
+
+func TestNetworkCollector(t *testing.T) {
+	store := storage.NewMemNodeStore()
+	for _, node := range testNodes() {
+		if err := store.PutNode(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newNetworkCollector(storage.NewNetworkStores(nil, TEST_NETWORK, store)))
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			key := family.GetName()
+			for _, label := range metric.Label {
+				key += " " + label.GetValue()
+			}
+			got[key] = metric.GetGauge().GetValue()
+		}
+	}
+	// the tombstoned node is left out
+	want := map[string]float64{
+		"ontmap_network_nodes":                   3,
+		"ontmap_network_reachable_nodes":         2,
+		"ontmap_network_consensus_nodes":         0,
+		"ontmap_network_version_nodes v1.6.2":    1,
+		"ontmap_network_version_nodes v1.6.2-rc": 1,
+		"ontmap_network_version_nodes v1.7.0":    1,
+		"ontmap_network_country_nodes FR":        2,
+		"ontmap_network_country_nodes DE":        1,
+		"ontmap_network_max_height":              30,
+	}
+	for key, val := range want {
+		if got[key] != val {
+			t.Errorf("%s = %v, want %v", key, got[key], val)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("metrics %v, want %v", got, want)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	router, _, remove := newTestRouter(t, nil, nil)
+	defer remove()
+	w := get(t, router, "/metrics", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "ontmap_store_write_duration_seconds") {
+		t.Errorf("status %d: %s", w.Code, w.Body)
+	}
+}
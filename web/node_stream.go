@@ -0,0 +1,201 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"map/storage"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// STREAM_PING_INTERVAL keeps the idle streams open through the proxies.
+const STREAM_PING_INTERVAL = 30 * time.Second
+
+// STREAM_RESET tells a resuming client it missed events and must reload the nodes.
+const STREAM_RESET = "reset"
+
+// nodeStream is the subscription of a client to the node events it selected.
+type nodeStream struct {
+	sub    *storage.NodeSubscription
+	filter *storage.NodeEventFilter
+	// complete is false if the client missed events since its last one
+	complete bool
+}
+
+// openNodeStream subscribes to the events of feed selected by the query
+// parameters, resuming after the Last-Event-ID header (sent by a reconnecting
+// EventSource) or the last_event_id parameter. It replies 400 on failure.
+func openNodeStream(c *gin.Context, feed *storage.NodeFeed, stores *storage.NetworkStores) (*nodeStream, bool) {
+	network, ok := networkMagic(c, stores)
+	if !ok {
+		return nil, false
+	}
+	if network != stores.Default {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "only the crawled network is streamed"})
+		return nil, false
+	}
+	filter, err := parseNodeEventFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	val := c.GetHeader("Last-Event-ID")
+	if val == "" {
+		val = c.Query("last_event_id")
+	}
+	var lastId uint64
+	if val != "" {
+		if lastId, err = strconv.ParseUint(val, 10, 64); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid last event id: %s", val)})
+			return nil, false
+		}
+	}
+	sub, complete := feed.Subscribe(lastId)
+	return &nodeStream{sub: sub, filter: filter, complete: complete}, true
+}
+
+// parseNodeEventFilter reads the comma separated event types and the node
+// fields from the query parameters.
+func parseNodeEventFilter(c *gin.Context) (*storage.NodeEventFilter, error) {
+	nodes, err := parseNodeFilter(c)
+	if err != nil {
+		return nil, err
+	}
+	filter := &storage.NodeEventFilter{Nodes: nodes}
+	val := c.Query("types")
+	if val == "" {
+		return filter, nil
+	}
+	filter.Types = make(map[string]bool)
+	for _, typ := range strings.Split(val, ",") {
+		switch typ {
+		case storage.NODE_EVENT_ADDED, storage.NODE_EVENT_UPDATED, storage.NODE_EVENT_OFFLINE, storage.NODE_EVENT_PRUNED:
+			filter.Types[typ] = true
+		default:
+			return nil, fmt.Errorf("invalid event type: %s", typ)
+		}
+	}
+	return filter, nil
+}
+
+// streamNodeEvents sends the node events as server-sent events until the client
+// leaves or falls behind, then the EventSource reconnects from its last event.
+func streamNodeEvents(c *gin.Context, feed *storage.NodeFeed, stores *storage.NetworkStores) {
+	stream, ok := openNodeStream(c, feed, stores)
+	if !ok {
+		return
+	}
+	defer stream.sub.Close()
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	w := c.Writer
+	var err error
+	if !stream.complete {
+		_, err = fmt.Fprintf(w, "event: %s\ndata: {}\n\n", STREAM_RESET)
+	} else {
+		_, err = fmt.Fprint(w, ": subscribed\n\n")
+	}
+	if err != nil {
+		return
+	}
+	w.Flush()
+
+	ping := time.NewTicker(STREAM_PING_INTERVAL)
+	defer ping.Stop()
+	for {
+		select {
+		case event, ok := <-stream.sub.C:
+			if !ok {
+				return
+			}
+			if !stream.filter.Match(event) {
+				continue
+			}
+			data, e := json.Marshal(event)
+			if e != nil {
+				return
+			}
+			_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Type, data)
+		case <-ping.C:
+			_, err = fmt.Fprint(w, ": ping\n\n")
+		case <-c.Request.Context().Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+		w.Flush()
+	}
+}
+
+// websocketNodeEvents sends the node events as JSON messages on a WebSocket
+// until the client leaves or falls behind, then it can reconnect with the
+// last_event_id parameter.
+func websocketNodeEvents(c *gin.Context, feed *storage.NodeFeed, stores *storage.NetworkStores, upgrader *websocket.Upgrader) {
+	stream, ok := openNodeStream(c, feed, stores)
+	if !ok {
+		return
+	}
+	defer stream.sub.Close()
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// the upgrader replied the error
+		return
+	}
+	defer conn.Close()
+
+	// the client messages are discarded, reading handles the pongs and the close
+	closed := make(chan bool)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * STREAM_PING_INTERVAL))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * STREAM_PING_INTERVAL))
+	})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(msg interface{}) error {
+		if err := conn.SetWriteDeadline(time.Now().Add(STREAM_PING_INTERVAL)); err != nil {
+			return err
+		}
+		return conn.WriteJSON(msg)
+	}
+	if !stream.complete {
+		if err := send(gin.H{"type": STREAM_RESET}); err != nil {
+			return
+		}
+	}
+	ping := time.NewTicker(STREAM_PING_INTERVAL)
+	defer ping.Stop()
+	for {
+		select {
+		case event, ok := <-stream.sub.C:
+			if !ok {
+				_ = conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow"), time.Now().Add(time.Second))
+				return
+			}
+			if stream.filter.Match(event) {
+				err = send(event)
+			}
+		case <-ping.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(STREAM_PING_INTERVAL))
+		case <-closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
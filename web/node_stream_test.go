@@ -0,0 +1,163 @@
+package web
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"map/storage"
+)
+
+// newStreamServer serves the api of a store publishing its changes, with
+// CORS disabled unless cors, allowing origins.
+func newStreamServer(t *testing.T, cors bool, origins ...string) (*httptest.Server, storage.NodeStore, func()) {
+	webRoot, remove := newWebRoot(t)
+	feed := storage.NewNodeFeed(storage.DefaultNodeFeedConfig())
+	store := storage.NewFeedStore(storage.NewMemNodeStore(), feed)
+	router := newRouter(!cors, origins, webRoot, storage.NewNetworkStores(nil, TEST_NETWORK, store), testPeers{}, feed)
+	server := httptest.NewServer(router)
+	return server, store, func() {
+		server.Close()
+		remove()
+	}
+}
+
+// readEvent returns the lines of the next server-sent event of r.
+func readEvent(t *testing.T, r *bufio.Reader) []string {
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+func TestStreamNodeEvents(t *testing.T) {
+	server, store, remove := newStreamServer(t, false)
+	defer remove()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/api/stream?types=added&country=FR", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Event-ID", "0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+	if lines := readEvent(t, r); len(lines) != 1 || lines[0] != ": subscribed" {
+		t.Fatalf("first event %q", lines)
+	}
+
+	for _, node := range []*storage.NodeInfo{
+		{Ip: "1.1.1.1", Port: 1, Country: "DE"},
+		{Ip: "2.2.2.2", Port: 2, Country: "FR"},
+		{Ip: "2.2.2.2", Port: 2, Country: "FR", Height: 1},
+		{Ip: "3.3.3.3", Port: 3, Country: "FR"},
+	} {
+		if err := store.PutNode(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"id: 2", "id: 4"} {
+		lines := readEvent(t, r)
+		if len(lines) != 3 || lines[0] != want || lines[1] != "event: added" {
+			t.Errorf("event %q, want %s added", lines, want)
+		}
+	}
+
+	// a client resuming after events out of the history reloads the nodes
+	resp, err = http.Get(server.URL + "/api/stream?last_event_id=10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if lines := readEvent(t, bufio.NewReader(resp.Body)); len(lines) != 2 || lines[0] != "event: "+STREAM_RESET {
+		t.Errorf("first event %q, want a reset", lines)
+	}
+
+	for _, query := range []string{"?types=moved", "?last_event_id=last", "?network=main"} {
+		resp, err := http.Get(server.URL + "/api/stream" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s status %d, want %d", query, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestWebsocketNodeEvents(t *testing.T) {
+	server, store, remove := newStreamServer(t, false)
+	defer remove()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/ws?types=added,pruned"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// the subscription is made before the upgrade
+	if err := store.PutNode(&storage.NodeInfo{Ip: "1.1.1.1", Port: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteNode("1.1.1.1:1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{storage.NODE_EVENT_ADDED, storage.NODE_EVENT_PRUNED} {
+		var event storage.NodeEvent
+		if err := conn.ReadJSON(&event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Type != want || event.Addr != "1.1.1.1:1" {
+			t.Errorf("event %s of %s, want %s of 1.1.1.1:1", event.Type, event.Addr, want)
+		}
+	}
+}
+
+func TestWebsocketOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		cors    bool
+		origins []string
+		origin  string
+		want    bool
+	}{
+		{"no origin", true, nil, "", true},
+		{"same origin", true, nil, "http://SERVER", true},
+		{"cross origin without cors", false, nil, "http://other.example.org", false},
+		{"cross origin without allowed origins", true, nil, "http://other.example.org", false},
+		{"allowed origin", true, []string{"http://other.example.org"}, "http://other.example.org", true},
+		{"other origin", true, []string{"http://other.example.org"}, "http://evil.example.org", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, _, remove := newStreamServer(t, test.cors, test.origins...)
+			defer remove()
+			header := http.Header{}
+			if test.origin != "" {
+				header.Set("Origin", strings.Replace(test.origin, "SERVER", strings.TrimPrefix(server.URL, "http://"), 1))
+			}
+			url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/ws"
+			conn, _, err := websocket.DefaultDialer.Dial(url, header)
+			if err == nil {
+				conn.Close()
+			}
+			if (err == nil) != test.want {
+				t.Errorf("upgrade error %v, want accepted %v", err, test.want)
+			}
+		})
+	}
+}
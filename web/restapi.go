@@ -4,28 +4,500 @@ import (
 	"fmt"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/ontio/ontology/common/config"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"map/storage"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 )
 
-func StartRestServer(port uint, disableCors bool) error {
+// DEFAULT_WEB_ROOT is the directory of the web app built by fe
+const DEFAULT_WEB_ROOT = "fe/dist"
+
+// PeerStates gives the live state of the connected nodes of the crawled network.
+type PeerStates interface {
+	PeerState(addr string) *storage.PeerState
+}
+
+// nodeDetail is a stored node with its live connection state, nil if it is
+// not connected.
+type nodeDetail struct {
+	*storage.NodeInfo
+	Connection *storage.PeerState `json:"connection"`
+}
+
+// CheckWebRoot tells whether webRoot holds the built web app.
+func CheckWebRoot(webRoot string) error {
+	if _, err := os.Stat(filepath.Join(webRoot, "index.html")); err != nil {
+		return fmt.Errorf("web root %s: %s", webRoot, err)
+	}
+	return nil
+}
+
+// CheckCorsOrigins tells whether origins, if any, are valid CORS origins.
+func CheckCorsOrigins(origins []string) error {
+	if len(origins) == 0 {
+		return nil
+	}
+	config := cors.DefaultConfig()
+	config.AllowOrigins = origins
+	return config.Validate()
+}
+
+// StartRestServer serves the web app of webRoot, checked by CheckWebRoot, and
+// the api until the server fails. Unless CORS is disabled, the api is shared
+// with corsOrigins, checked by CheckCorsOrigins, or with every origin if none.
+func StartRestServer(port uint, disableCors bool, corsOrigins []string, webRoot string, stores *storage.NetworkStores, peers PeerStates, feed *storage.NodeFeed) error {
+	return newRouter(disableCors, corsOrigins, webRoot, stores, peers, feed).Run(fmt.Sprintf(":%d", port))
+}
+
+// newRouter routes the web app of webRoot and the api, with the live state
+// of the connected nodes of peers and the node changes of feed.
+func newRouter(disableCors bool, corsOrigins []string, webRoot string, stores *storage.NetworkStores, peers PeerStates, feed *storage.NodeFeed) *gin.Engine {
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.Default()
 	if !disableCors {
-		r.Use(cors.Default())
+		config := cors.DefaultConfig()
+		if len(corsOrigins) == 0 {
+			config.AllowAllOrigins = true
+		} else {
+			config.AllowOrigins = corsOrigins
+		}
+		r.Use(cors.New(config))
 	}
-	r.LoadHTMLGlob("fe/dist/index.html")
-	r.Static("/js", "fe/dist/js")
-	r.Static("/css", "fe/dist/css")
-	r.StaticFile("/favicon.ico", "fe/dist/favicon.ico")
+	r.LoadHTMLFiles(filepath.Join(webRoot, "index.html"))
+	r.Static("/js", filepath.Join(webRoot, "js"))
+	r.Static("/css", filepath.Join(webRoot, "css"))
+	r.StaticFile("/favicon.ico", filepath.Join(webRoot, "favicon.ico"))
 	r.GET("/", func(c *gin.Context) {
 		c.HTML(http.StatusOK, "index.html", gin.H{})
 	})
 	r.GET("/api/nodes", func(c *gin.Context) {
-		nodes := storage.ListAllNodes()
+		store, ok := networkStore(c, stores)
+		if !ok {
+			return
+		}
+		filter, err := parseNodeFilter(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		order, err := parseNodeOrder(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		limit, err := parseUintParam(c, "limit")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		nodes, err := storage.QueryNodes(store, filter)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if c.Query("include_tombstoned") != "true" {
+			nodes = storage.ExcludeTombstoned(nodes)
+		}
+		if term := c.Query("search"); term != "" {
+			nodes = storage.SearchNodes(nodes, term)
+		}
+		order.Sort(nodes)
+		total := len(nodes)
+		if cursor := c.Query("cursor"); cursor != "" {
+			last, err := order.ParseCursor(cursor)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			nodes = order.After(nodes, last)
+		}
+		if limit != nil && *limit != 0 && uint64(len(nodes)) > *limit {
+			nodes = nodes[:*limit]
+			c.Header("X-Next-Cursor", order.Cursor(nodes[len(nodes)-1]))
+		}
+		c.Header("X-Total-Count", strconv.Itoa(total))
 		c.JSON(200,
 			nodes,
 		)
 	})
-	return r.Run(fmt.Sprintf(":%d", port))
+	r.GET("/api/nodes/:addr", func(c *gin.Context) {
+		network, ok := parseNetwork(c, stores)
+		if !ok {
+			return
+		}
+		store, err := stores.Get(network)
+		if !checkNetwork(c, err) {
+			return
+		}
+		addr, err := storage.NormalizeAddr(c.Param("addr"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		node, err := store.GetNode(addr)
+		if err == storage.ErrNodeNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "node not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		detail := &nodeDetail{NodeInfo: node}
+		if network == stores.Default {
+			detail.Connection = peers.PeerState(addr)
+		}
+		c.JSON(200,
+			detail,
+		)
+	})
+	r.GET("/api/nodes/:addr/history", func(c *gin.Context) {
+		store, ok := networkStore(c, stores)
+		if !ok {
+			return
+		}
+		from, err := parseMsParam(c, "from", 0)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		to, err := parseMsParam(c, "to", storage.NowInMs())
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		addr, err := storage.NormalizeAddr(c.Param("addr"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		history, err := store.ListObservations(addr, from, to)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200,
+			history,
+		)
+	})
+	r.GET("/api/nodes/:addr/attempts", func(c *gin.Context) {
+		store, ok := networkStore(c, stores)
+		if !ok {
+			return
+		}
+		from, err := parseMsParam(c, "from", 0)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		to, err := parseMsParam(c, "to", storage.NowInMs())
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		addr, err := storage.NormalizeAddr(c.Param("addr"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		attempts, err := store.ListConnectAttempts(addr, from, to)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200,
+			attempts,
+		)
+	})
+	r.GET("/api/attempts", func(c *gin.Context) {
+		store, ok := networkStore(c, stores)
+		if !ok {
+			return
+		}
+		from, err := parseMsParam(c, "from", 0)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		to, err := parseMsParam(c, "to", storage.NowInMs())
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		counts, err := storage.CountConnectAttempts(store, from, to)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200,
+			counts,
+		)
+	})
+	r.GET("/api/peers/:id", func(c *gin.Context) {
+		store, ok := networkStore(c, stores)
+		if !ok {
+			return
+		}
+		addrs, err := store.ListPeerAddresses(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if len(addrs) == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "peer not found"})
+			return
+		}
+		c.JSON(200, gin.H{
+			"id":        c.Param("id"),
+			"addresses": addrs,
+		})
+	})
+	r.GET("/api/stats", func(c *gin.Context) {
+		network, ok := networkMagic(c, stores)
+		if !ok {
+			return
+		}
+		stats, err := stores.Stats(network)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200,
+			stats,
+		)
+	})
+	r.GET("/api/stats/asn", func(c *gin.Context) {
+		store, ok := networkStore(c, stores)
+		if !ok {
+			return
+		}
+		nodes, err := storage.QueryNodes(store, &storage.NodeFilter{})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200,
+			storage.CountByAsn(storage.ExcludeTombstoned(nodes)),
+		)
+	})
+	// the websocket upgrades are not covered by CORS, they are accepted from
+	// the same origin only unless others are allowed
+	upgrader := &websocket.Upgrader{}
+	if !disableCors && len(corsOrigins) != 0 {
+		upgrader.CheckOrigin = checkOrigin(corsOrigins)
+	}
+	r.GET("/api/stream", func(c *gin.Context) {
+		streamNodeEvents(c, feed, stores)
+	})
+	r.GET("/api/ws", func(c *gin.Context) {
+		websocketNodeEvents(c, feed, stores, upgrader)
+	})
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	r.GET("/api/census", func(c *gin.Context) {
+		store, ok := networkStore(c, stores)
+		if !ok {
+			return
+		}
+		from, err := parseMsParam(c, "from", 0)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		to, err := parseMsParam(c, "to", storage.NowInMs())
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		step, err := parseMsParam(c, "step", 0)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		census, err := store.ListCensus(from, to)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200,
+			storage.SampleCensus(census, step),
+		)
+	})
+	return r
+}
+
+// checkOrigin accepts the requests without an Origin header, or from the same
+// origin, or from one of origins, "*" being any.
+func checkOrigin(origins []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+			return true
+		}
+		for _, allowed := range origins {
+			if allowed == "*" || strings.EqualFold(allowed, origin) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// networkStore resolves the store of the network id given by the network query
+// parameter, the crawled network by default. It replies 400 on failure, 404 if
+// the network is unknown.
+func networkStore(c *gin.Context, stores *storage.NetworkStores) (storage.NodeStore, bool) {
+	network, ok := parseNetwork(c, stores)
+	if !ok {
+		return nil, false
+	}
+	store, err := stores.Get(network)
+	if !checkNetwork(c, err) {
+		return nil, false
+	}
+	return store, true
+}
+
+// networkMagic resolves the magic of the network id given by the network query
+// parameter, the crawled network by default. It replies 400 on failure, 404 if
+// the network is unknown.
+func networkMagic(c *gin.Context, stores *storage.NetworkStores) (uint32, bool) {
+	network, ok := parseNetwork(c, stores)
+	if !ok {
+		return 0, false
+	}
+	known, err := stores.Has(network)
+	if err == nil && !known {
+		err = storage.ErrNetworkNotFound
+	}
+	return network, checkNetwork(c, err)
+}
+
+// parseNetwork reads the network query parameter, replying 400 on failure.
+func parseNetwork(c *gin.Context, stores *storage.NetworkStores) (uint32, bool) {
+	val := c.Query("network")
+	if val == "" {
+		return stores.Default, true
+	}
+	id, err := strconv.ParseUint(val, 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid network: %s", val)})
+		return 0, false
+	}
+	return config.GetNetworkMagic(uint32(id)), true
+}
+
+// checkNetwork replies 404 if err is ErrNetworkNotFound, 500 on other errors.
+func checkNetwork(c *gin.Context, err error) bool {
+	if err == storage.ErrNetworkNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// parseMsParam reads the ms timestamp (or duration) query parameter name, or def if absent.
+func parseMsParam(c *gin.Context, name string, def uint64) (uint64, error) {
+	val := c.Query(name)
+	if val == "" {
+		return def, nil
+	}
+	ms, err := strconv.ParseUint(val, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %s", name, val)
+	}
+	return ms, nil
+}
+
+// parseNodeFilter reads the node fields from the query parameters.
+func parseNodeFilter(c *gin.Context) (*storage.NodeFilter, error) {
+	filter := &storage.NodeFilter{
+		Country:           c.Query("country"),
+		SoftVersion:       c.Query("soft_version"),
+		SoftVersionPrefix: c.Query("soft_version_prefix"),
+		Reachability:      c.Query("reachability"),
+	}
+	var err error
+	if filter.CanConnect, err = parseBoolParam(c, "can_connect"); err != nil {
+		return nil, err
+	}
+	consensus := "is_consensus"
+	if c.Query(consensus) == "" {
+		consensus = "consensus"
+	}
+	if filter.IsConsensus, err = parseBoolParam(c, consensus); err != nil {
+		return nil, err
+	}
+	if filter.Services, err = parseUintParam(c, "services"); err != nil {
+		return nil, err
+	}
+	minHeight, err := parseUintParam(c, "min_height")
+	if err != nil {
+		return nil, err
+	}
+	if minHeight != nil {
+		filter.MinHeight = *minHeight
+	}
+	if filter.MaxHeight, err = parseUintParam(c, "max_height"); err != nil {
+		return nil, err
+	}
+	if filter.ActiveFrom, err = parseMsParam(c, "active_from", 0); err != nil {
+		return nil, err
+	}
+	if filter.ActiveTo, err = parseMsParam(c, "active_to", 0); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// parseNodeOrder reads the sort key and the asc or desc order, desc by default
+// when a key is given.
+func parseNodeOrder(c *gin.Context) (*storage.NodeOrder, error) {
+	key := c.Query("sort")
+	def := "asc"
+	if key != "" {
+		def = "desc"
+	}
+	dir := c.DefaultQuery("order", def)
+	if dir != "asc" && dir != "desc" {
+		return nil, fmt.Errorf("invalid order: %s", dir)
+	}
+	return storage.NewNodeOrder(key, dir == "desc")
+}
+
+// parseUintParam reads the uint query parameter name, or nil if absent.
+func parseUintParam(c *gin.Context, name string) (*uint64, error) {
+	val := c.Query(name)
+	if val == "" {
+		return nil, nil
+	}
+	n, err := strconv.ParseUint(val, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", name, val)
+	}
+	return &n, nil
+}
+
+// parseBoolParam reads the bool query parameter name, or nil if absent.
+func parseBoolParam(c *gin.Context, name string) (*bool, error) {
+	val := c.Query(name)
+	if val == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", name, val)
+	}
+	return &b, nil
 }
@@ -0,0 +1,484 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"map/storage"
+)
+
+const TEST_NETWORK = 0x12345
+
+// newWebRoot creates a web root holding an index.html, removed by the returned func.
+func newWebRoot(t *testing.T) (string, func()) {
+	webRoot, err := ioutil.TempDir("", "webroot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(webRoot, "index.html"), []byte("<html></html>"), 0600); err != nil {
+		os.RemoveAll(webRoot)
+		t.Fatal(err)
+	}
+	return webRoot, func() { os.RemoveAll(webRoot) }
+}
+
+type testPeers map[string]*storage.PeerState
+
+func (self testPeers) PeerState(addr string) *storage.PeerState {
+	return self[addr]
+}
+
+// newTestRouter routes the api of a MemNodeStore holding nodes, with the
+// connected peers of peers. The returned func removes its web root.
+func newTestRouter(t *testing.T, nodes []*storage.NodeInfo, peers testPeers) (http.Handler, storage.NodeStore, func()) {
+	webRoot, remove := newWebRoot(t)
+	store := storage.NewMemNodeStore()
+	for _, node := range nodes {
+		if err := store.PutNode(node); err != nil {
+			remove()
+			t.Fatal(err)
+		}
+	}
+	return newRouter(true, nil, webRoot, storage.NewNetworkStores(nil, TEST_NETWORK, store), peers,
+		storage.NewNodeFeed(storage.DefaultNodeFeedConfig())), store, remove
+}
+
+// get serves path and decodes its json body into res, unless it is nil.
+func get(t *testing.T, router http.Handler, path string, res interface{}) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	if res != nil && w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), res); err != nil {
+			t.Fatalf("decode %s: %s", path, err)
+		}
+	}
+	return w
+}
+
+func addrsOf(nodes []*storage.NodeInfo) []string {
+	addrs := make([]string, len(nodes))
+	for i, node := range nodes {
+		addrs[i] = node.RemoteListenAddress()
+	}
+	return addrs
+}
+
+func float32Ptr(v float32) *float32 {
+	return &v
+}
+
+func testNodes() []*storage.NodeInfo {
+	return []*storage.NodeInfo{
+		{Ip: "1.1.1.1", Port: 20338, Height: 10, Country: "FR", SoftVersion: "v1.6.2", CanConnect: true,
+			LastActiveTime: 100, Availability24h: float32Ptr(90)},
+		{Ip: "2.2.2.2", Port: 20338, Height: 20, Country: "DE", SoftVersion: "v1.6.2-rc", LastActiveTime: 200,
+			Availability24h: float32Ptr(50), Reachability: storage.REACHABILITY_INBOUND},
+		{Ip: "3.3.3.3", Port: 20338, Height: 30, Country: "FR", SoftVersion: "v1.7.0", CanConnect: true,
+			LastActiveTime: 300, Hostname: "node3.example.org"},
+		{Ip: "4.4.4.4", Port: 20338, Height: 40, Country: "FR", SoftVersion: "v1.6.2", LastActiveTime: 400,
+			Status: storage.NODE_STATUS_TOMBSTONE},
+	}
+}
+
+func TestNodesHandler(t *testing.T) {
+	router, _, remove := newTestRouter(t, testNodes(), nil)
+	defer remove()
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantAddrs  []string
+	}{
+		// reachable first, then the most recently active
+		{"default order", "", http.StatusOK, []string{"3.3.3.3:20338", "1.1.1.1:20338", "2.2.2.2:20338"}},
+		{"tombstoned", "?include_tombstoned=true", http.StatusOK,
+			[]string{"3.3.3.3:20338", "1.1.1.1:20338", "4.4.4.4:20338", "2.2.2.2:20338"}},
+		{"country", "?country=FR&sort=height&order=asc", http.StatusOK, []string{"1.1.1.1:20338", "3.3.3.3:20338"}},
+		{"exact soft version", "?soft_version=v1.6.2&include_tombstoned=true", http.StatusOK,
+			[]string{"1.1.1.1:20338", "4.4.4.4:20338"}},
+		{"soft version prefix", "?soft_version_prefix=v1.6&sort=addr&order=asc", http.StatusOK,
+			[]string{"1.1.1.1:20338", "2.2.2.2:20338"}},
+		{"can connect", "?can_connect=false", http.StatusOK, []string{"2.2.2.2:20338"}},
+		{"is consensus", "?is_consensus=true", http.StatusOK, []string{}},
+		{"reachability", "?reachability=inbound", http.StatusOK, []string{"2.2.2.2:20338"}},
+		{"min height", "?include_tombstoned=true&min_height=40", http.StatusOK, []string{"4.4.4.4:20338"}},
+		{"max height", "?max_height=10", http.StatusOK, []string{"1.1.1.1:20338"}},
+		{"active", "?active_from=150&active_to=250", http.StatusOK, []string{"2.2.2.2:20338"}},
+		{"search hostname", "?search=EXAMPLE", http.StatusOK, []string{"3.3.3.3:20338"}},
+		{"search address", "?search=2.2.2&country=DE", http.StatusOK, []string{"2.2.2.2:20338"}},
+		{"sorted by availability", "?sort=availability_24h", http.StatusOK,
+			[]string{"1.1.1.1:20338", "2.2.2.2:20338", "3.3.3.3:20338"}},
+		{"order without a sort key", "?order=asc", http.StatusOK,
+			[]string{"3.3.3.3:20338", "1.1.1.1:20338", "2.2.2.2:20338"}},
+		{"unknown sort key", "?sort=unknown", http.StatusBadRequest, nil},
+		{"invalid order", "?order=up", http.StatusBadRequest, nil},
+		{"invalid bool", "?can_connect=maybe", http.StatusBadRequest, nil},
+		{"invalid height", "?min_height=high", http.StatusBadRequest, nil},
+		{"invalid limit", "?limit=-1", http.StatusBadRequest, nil},
+		{"invalid cursor", "?cursor=!", http.StatusBadRequest, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var nodes []*storage.NodeInfo
+			w := get(t, router, "/api/nodes"+test.query, &nodes)
+			if w.Code != test.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, test.wantStatus, w.Body)
+			}
+			if test.wantAddrs != nil && !reflect.DeepEqual(addrsOf(nodes), test.wantAddrs) {
+				t.Errorf("nodes %v, want %v", addrsOf(nodes), test.wantAddrs)
+			}
+		})
+	}
+}
+
+// failingStore fails its queries.
+type failingStore struct {
+	storage.NodeStore
+}
+
+func (failingStore) QueryNodes(*storage.NodeFilter) ([]*storage.NodeInfo, error) {
+	return nil, errors.New("test query failure")
+}
+
+func TestQueryErrors(t *testing.T) {
+	webRoot, remove := newWebRoot(t)
+	defer remove()
+	store := failingStore{storage.NewMemNodeStore()}
+	router := newRouter(true, nil, webRoot, storage.NewNetworkStores(nil, TEST_NETWORK, store), testPeers{},
+		storage.NewNodeFeed(storage.DefaultNodeFeedConfig()))
+	for _, path := range []string{"/api/nodes", "/api/stats/asn"} {
+		if w := get(t, router, path, nil); w.Code != http.StatusInternalServerError {
+			t.Errorf("%s status %d, want %d", path, w.Code, http.StatusInternalServerError)
+		}
+	}
+}
+
+func TestNodesPages(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		// change runs on the store between the pages
+		change func(store storage.NodeStore) error
+		want   [][]string
+	}{
+		{"by height", "sort=height&order=desc", nil,
+			[][]string{{"3.3.3.3:20338", "2.2.2.2:20338"}, {"1.1.1.1:20338"}}},
+		{"last node purged", "sort=height&order=desc",
+			func(store storage.NodeStore) error { return store.DeleteNode("2.2.2.2:20338") },
+			[][]string{{"3.3.3.3:20338", "2.2.2.2:20338"}, {"1.1.1.1:20338"}}},
+		{"last node active again", "", func(store storage.NodeStore) error {
+			return store.UpdateNode("1.1.1.1:20338", func(old *storage.NodeInfo) (*storage.NodeInfo, error) {
+				old.LastActiveTime = 1000
+				return old, nil
+			})
+		}, [][]string{{"3.3.3.3:20338", "1.1.1.1:20338"}, {"2.2.2.2:20338"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			router, store, remove := newTestRouter(t, testNodes(), nil)
+			defer remove()
+			cursor := ""
+			for i, want := range test.want {
+				path := "/api/nodes?limit=2&" + test.query
+				if cursor != "" {
+					path += "&cursor=" + cursor
+				}
+				var nodes []*storage.NodeInfo
+				w := get(t, router, path, &nodes)
+				if w.Code != http.StatusOK {
+					t.Fatalf("page %d status %d: %s", i, w.Code, w.Body)
+				}
+				if !reflect.DeepEqual(addrsOf(nodes), want) {
+					t.Errorf("page %d %v, want %v", i, addrsOf(nodes), want)
+				}
+				if total := w.Header().Get("X-Total-Count"); i == 0 && total != "3" {
+					t.Errorf("total count %s, want 3", total)
+				}
+				cursor = w.Header().Get("X-Next-Cursor")
+				if (cursor == "") != (i == len(test.want)-1) {
+					t.Fatalf("page %d next cursor %q", i, cursor)
+				}
+				if i == 0 && test.change != nil {
+					if err := test.change(store); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestNodeHandler(t *testing.T) {
+	connected := &storage.PeerState{PeerId: "a1b2", ConnectedSince: 100}
+	router, _, remove := newTestRouter(t, testNodes(), testPeers{"1.1.1.1:20338": connected})
+	defer remove()
+
+	tests := []struct {
+		name       string
+		addr       string
+		wantStatus int
+		wantPeer   *storage.PeerState
+	}{
+		{"connected", "1.1.1.1:20338", http.StatusOK, connected},
+		{"not connected", "2.2.2.2:20338", http.StatusOK, nil},
+		{"unknown", "5.5.5.5:20338", http.StatusNotFound, nil},
+		{"invalid address", "nowhere", http.StatusBadRequest, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var detail struct {
+				storage.NodeInfo
+				Connection *storage.PeerState `json:"connection"`
+			}
+			w := get(t, router, "/api/nodes/"+test.addr, &detail)
+			if w.Code != test.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, test.wantStatus, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			if detail.RemoteListenAddress() != test.addr || !reflect.DeepEqual(detail.Connection, test.wantPeer) {
+				t.Errorf("node %s connected as %+v, want %s and %+v", detail.RemoteListenAddress(),
+					detail.Connection, test.addr, test.wantPeer)
+			}
+		})
+	}
+}
+
+func TestHistoryHandler(t *testing.T) {
+	router, store, remove := newTestRouter(t, testNodes(), nil)
+	defer remove()
+	for _, tm := range []uint64{100, 200, 300} {
+		if err := store.AppendObservation("1.1.1.1:20338", &storage.Observation{Time: tm}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		query      string
+		wantStatus int
+		wantTimes  []uint64
+	}{
+		{"", http.StatusOK, []uint64{100, 200, 300}},
+		{"?from=150&to=250", http.StatusOK, []uint64{200}},
+		{"?from=yesterday", http.StatusBadRequest, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			var history []*storage.Observation
+			w := get(t, router, "/api/nodes/1.1.1.1:20338/history"+test.query, &history)
+			if w.Code != test.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, test.wantStatus, w.Body)
+			}
+			var times []uint64
+			for _, obs := range history {
+				times = append(times, obs.Time)
+			}
+			if !reflect.DeepEqual(times, test.wantTimes) {
+				t.Errorf("history %v, want %v", times, test.wantTimes)
+			}
+		})
+	}
+}
+
+func TestCensusHandler(t *testing.T) {
+	router, store, remove := newTestRouter(t, testNodes(), nil)
+	defer remove()
+	for _, tm := range []uint64{0, 30000, 60000, 90000} {
+		if err := store.PutCensus(&storage.Census{Time: tm}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		query      string
+		wantStatus int
+		wantTimes  []uint64
+	}{
+		{"", http.StatusOK, []uint64{0, 30000, 60000, 90000}},
+		{"?from=30000&step=60000", http.StatusOK, []uint64{30000, 60000}},
+		{"?to=30000", http.StatusOK, []uint64{0, 30000}},
+		{"?step=minute", http.StatusBadRequest, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			var census []*storage.Census
+			w := get(t, router, "/api/census"+test.query, &census)
+			if w.Code != test.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, test.wantStatus, w.Body)
+			}
+			var times []uint64
+			for _, c := range census {
+				times = append(times, c.Time)
+			}
+			if !reflect.DeepEqual(times, test.wantTimes) {
+				t.Errorf("census %v, want %v", times, test.wantTimes)
+			}
+		})
+	}
+}
+
+func TestNetworkParam(t *testing.T) {
+	dir, remove := newWebRoot(t)
+	defer remove()
+	db, err := storage.NewBoltNodeDb(filepath.Join(dir, storage.NODE_DB_FILE_NAME), TEST_NETWORK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Network(TEST_NETWORK).PutNode(&storage.NodeInfo{Ip: "1.1.1.1", Port: 20338}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Network(7).PutNode(&storage.NodeInfo{Ip: "7.7.7.7", Port: 20338}); err != nil {
+		t.Fatal(err)
+	}
+	router := newRouter(true, nil, dir, storage.NewNetworkStores(db, TEST_NETWORK, db.Network(TEST_NETWORK)), testPeers{},
+		storage.NewNodeFeed(storage.DefaultNodeFeedConfig()))
+
+	for query, want := range map[string][]string{
+		"":           {"1.1.1.1:20338"},
+		"?network=7": {"7.7.7.7:20338"},
+	} {
+		var nodes []*storage.NodeInfo
+		if w := get(t, router, "/api/nodes"+query, &nodes); w.Code != http.StatusOK {
+			t.Fatalf("%q status %d: %s", query, w.Code, w.Body)
+		}
+		if !reflect.DeepEqual(addrsOf(nodes), want) {
+			t.Errorf("%q nodes %v, want %v", query, addrsOf(nodes), want)
+		}
+	}
+	if w := get(t, router, "/api/nodes?network=main", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid network status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	for _, path := range []string{"/api/nodes?network=9", "/api/nodes/9.9.9.9:20338?network=9", "/api/stats?network=9"} {
+		if w := get(t, router, path, nil); w.Code != http.StatusNotFound {
+			t.Errorf("%s status %d, want %d", path, w.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestPeerHandler(t *testing.T) {
+	router, store, remove := newTestRouter(t, nil, nil)
+	defer remove()
+	if err := store.RecordPeerAddress("abcd", "1.1.1.1:20338", 10); err != nil {
+		t.Fatal(err)
+	}
+
+	var res struct {
+		Id        string                 `json:"id"`
+		Addresses []*storage.PeerAddress `json:"addresses"`
+	}
+	if w := get(t, router, "/api/peers/abcd", &res); w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if res.Id != "abcd" || len(res.Addresses) != 1 || res.Addresses[0].Addr != "1.1.1.1:20338" {
+		t.Errorf("peer = %+v", res)
+	}
+	if w := get(t, router, "/api/peers/ef01", nil); w.Code != http.StatusNotFound {
+		t.Errorf("unknown peer status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestAsnStatsHandler(t *testing.T) {
+	nodes := testNodes()
+	nodes[0].Asn, nodes[0].AsOrg, nodes[0].IsHosting = 16276, "OVH SAS", true
+	nodes[3].Asn, nodes[3].AsOrg, nodes[3].IsHosting = 16276, "OVH SAS", true
+	router, _, remove := newTestRouter(t, nodes, nil)
+	defer remove()
+
+	var stats storage.AsnStats
+	if w := get(t, router, "/api/stats/asn", &stats); w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	// the tombstoned node is not counted
+	if stats.Nodes != 3 || stats.Hosting != 1 || len(stats.Ases) != 2 || stats.Ases[0].Asn != 0 ||
+		stats.Ases[1].Asn != 16276 || stats.Ases[1].Nodes != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestAttemptsHandler(t *testing.T) {
+	router, store, remove := newTestRouter(t, nil, nil)
+	defer remove()
+	attempts := []*storage.ConnectAttempt{
+		{Time: 10, Reason: storage.CONNECT_OK},
+		{Time: 20, Reason: storage.CONNECT_REFUSED, Error: "connection refused"},
+	}
+	for _, attempt := range attempts {
+		if err := store.AppendConnectAttempt("1.1.1.1:20338", attempt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var listed []*storage.ConnectAttempt
+	if w := get(t, router, "/api/nodes/1.1.1.1:20338/attempts?from=15", &listed); w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if !reflect.DeepEqual(listed, attempts[1:]) {
+		t.Errorf("attempts %v, want %v", listed, attempts[1:])
+	}
+	var counts map[string]uint64
+	if w := get(t, router, "/api/attempts", &counts); w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if want := map[string]uint64{storage.CONNECT_OK: 1, storage.CONNECT_REFUSED: 1}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("counts %v, want %v", counts, want)
+	}
+	if w := get(t, router, "/api/nodes/1.1.1.1/attempts", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid address status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestCheckWebRoot(t *testing.T) {
+	webRoot, remove := newWebRoot(t)
+	defer remove()
+	if err := CheckWebRoot(webRoot); err != nil {
+		t.Errorf("check of a built web root: %s", err)
+	}
+	if err := CheckWebRoot(filepath.Join(webRoot, "js")); err == nil {
+		t.Errorf("check of a web root without index.html succeeded")
+	}
+}
+
+func TestCheckCorsOrigins(t *testing.T) {
+	if err := CheckCorsOrigins(nil); err != nil {
+		t.Errorf("check of no origins: %s", err)
+	}
+	if err := CheckCorsOrigins([]string{"https://example.org", "http://localhost:8080"}); err != nil {
+		t.Errorf("check of valid origins: %s", err)
+	}
+	if err := CheckCorsOrigins([]string{"example.org"}); err == nil {
+		t.Errorf("check of an origin without scheme succeeded")
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	router, store, remove := newTestRouter(t, testNodes(), nil)
+	defer remove()
+
+	var stats storage.NetworkStats
+	if w := get(t, router, "/api/stats", &stats); w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	// the tombstoned node is left out
+	if stats.Total != 3 || stats.Reachable != 2 || stats.Tip != 30 || stats.Countries["FR"] != 2 {
+		t.Errorf("stats %+v, want 3 nodes, 2 reachable and 2 in FR up to 30", stats)
+	}
+	if err := store.DeleteNode("1.1.1.1:20338"); err != nil {
+		t.Fatal(err)
+	}
+	if w := get(t, router, "/api/stats", &stats); w.Code != http.StatusOK || stats.Total != 2 {
+		t.Errorf("status %d, %d nodes once one is deleted, want 2", w.Code, stats.Total)
+	}
+	if w := get(t, router, "/api/stats?network=main", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid network status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}